@@ -0,0 +1,63 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritonaccount "github.com/joyent/triton-go/v2/account"
+	"github.com/joyent/triton-shim/utils"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// requestPrincipal returns the owner of the access key used to sign the
+// request, which the Triton clients act for
+func requestPrincipal(c *gin.Context) *tritonutils.Principal {
+	principal, _ := c.Value(utils.PrincipalKey).(*tritonutils.Principal)
+	return principal
+}
+
+// getAccount retrieves the Triton account the request is performed for. It
+// is used to record the owner of the resources which exist only into the
+// shim store.
+func getAccount(c *gin.Context) (*tritonaccount.Account, error) {
+	client, err := tritonutils.GetTritonAccountClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create triton account client: %w", err)
+	}
+
+	account, err := client.Get(context.Background(), &tritonaccount.GetInput{})
+	if err != nil {
+		log.Printf("[ERROR] get account error: %v\n", err)
+		return nil, fmt.Errorf("Unable to get triton account: %w", err)
+	}
+
+	return account, nil
+}
+
+// getDefaultNetwork retrieves the ID of the account default network, which
+// tells the default fabric VLAN (default VPC) apart
+func getDefaultNetwork(region string, principal *tritonutils.Principal) (string, error) {
+	client, err := tritonutils.GetTritonAccountClient(region, principal)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create triton account client: %w", err)
+	}
+
+	config, err := client.Config().Get(context.Background(), &tritonaccount.GetConfigInput{})
+	if err != nil {
+		log.Printf("[ERROR] get account config error: %v\n", err)
+		return "", fmt.Errorf("Unable to get triton account config: %w", err)
+	}
+
+	return config.DefaultNetwork, nil
+}
@@ -0,0 +1,636 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	"github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Triton has no floating IPs. Elastic IPs are emulated by the shim: an
+// allocation is just a shim record until it is associated, which adds a NIC
+// on the public network (see publicNetwork) to the instance. The address is
+// the IP given to that NIC, so it is only known while associated, and it
+// changes with every association. Disassociating removes the NIC. Since the
+// address is not stable, allocations can only be associated and released by
+// their allocation ID, not by their public IP.
+
+// addressesCollection is the store collection for Elastic IP allocations
+const addressesCollection = "addresses"
+
+// addressRecord is the shim record of an Elastic IP allocation
+type addressRecord struct {
+	ID            string `json:"id"`
+	Owner         string `json:"owner"`
+	Region        string `json:"region"`
+	PublicIP      string `json:"public_ip,omitempty"`
+	NetworkID     string `json:"network_id,omitempty"`
+	AssociationID string `json:"association_id,omitempty"`
+	InstanceID    string `json:"instance_id,omitempty"`
+	MAC           string `json:"mac,omitempty"`
+}
+
+// key returns the store key of the record
+func (a *addressRecord) key() string {
+	return ownedKey(a.Region, a.Owner, a.ID)
+}
+
+// toEC2 converts the record into an EC2 address
+func (a *addressRecord) toEC2(tags map[string]string, region string) *ec2.Address {
+	address := &ec2.Address{
+		AllocationId:       aws.String(a.ID),
+		Domain:             aws.String(ec2.DomainTypeVpc),
+		NetworkBorderGroup: aws.String(region),
+		Tags:               ec2Tags(tags),
+	}
+	if a.AssociationID != "" {
+		address.AssociationId = aws.String(a.AssociationID)
+		address.InstanceId = aws.String(a.InstanceID)
+		address.NetworkInterfaceId = aws.String(macID("eni", a.MAC))
+		address.NetworkInterfaceOwnerId = aws.String(a.Owner)
+		address.PublicIp = aws.String(a.PublicIP)
+	}
+	return address
+}
+
+// loadAddresses returns the Elastic IP allocations of the given owner into
+// the given region
+func loadAddresses(db *store.Store, region string, owner string) ([]*addressRecord, error) {
+	var addresses []*addressRecord
+	for _, key := range db.Keys(addressesCollection) {
+		address := &addressRecord{}
+		if err := db.Get(addressesCollection, key, address); err != nil {
+			return nil, fmt.Errorf("Unable to load address: %w", err)
+		}
+		if address.Region == region && address.Owner == owner {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
+
+// refreshAddress clears the association of an address when its NIC, or
+// its instance, does not exist anymore. It returns true when the record
+// has been updated.
+func refreshAddress(client *tritoncompute.ComputeClient, region string, address *addressRecord) (bool, error) {
+	if address.AssociationID == "" {
+		return false, nil
+	}
+
+	vm, err := client.Instances().Get(context.Background(), &tritoncompute.GetInstanceInput{
+		ID: address.InstanceID,
+	})
+	if err != nil {
+		if !tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) &&
+			!tritonerrors.IsSpecificStatusCode(err, http.StatusGone) {
+			log.Printf("[ERROR] get vm error: %v\n", err)
+			return false, fmt.Errorf("Unable to get triton compute instance: %w", err)
+		}
+		clearAssociation(address)
+		return true, nil
+	}
+	if vm.State == "deleted" {
+		clearAssociation(address)
+		return true, nil
+	}
+
+	nics, err := listInstanceNICs(client, region, address.InstanceID)
+	if err != nil {
+		return false, err
+	}
+	for _, nic := range nics {
+		if nic.MAC == address.MAC {
+			address.PublicIP = nic.IP
+			return false, nil
+		}
+	}
+
+	clearAssociation(address)
+	return true, nil
+}
+
+// clearAssociation turns the address into a not associated one
+func clearAssociation(address *addressRecord) {
+	address.PublicIP = ""
+	address.NetworkID = ""
+	address.AssociationID = ""
+	address.InstanceID = ""
+	address.MAC = ""
+}
+
+// findAddress returns the address of the owner into the region with the
+// given allocation ID or, when the ID is empty, with the given public IP or
+// association ID
+func findAddress(db *store.Store, region string, owner string, allocationID string, publicIP string,
+	associationID string) (*addressRecord, error) {
+
+	addresses, err := loadAddresses(db, region, owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		switch {
+		case allocationID != "":
+			if address.ID == allocationID {
+				return address, nil
+			}
+		case associationID != "":
+			if address.AssociationID == associationID {
+				return address, nil
+			}
+		case publicIP != "":
+			if address.PublicIP == publicIP {
+				return address, nil
+			}
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+// abortWithAddressNotFound is used when the given address does not exist
+func abortWithAddressNotFound(c *gin.Context, allocationID string, publicIP string) {
+	if allocationID != "" {
+		abortWithNotFound(c, "InvalidAllocationID.NotFound", allocationID)
+		return
+	}
+	abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidAddress.NotFound",
+		fmt.Sprintf("Address '%s' not found.", publicIP), requestID(c)))
+}
+
+// abortWithUnstablePublicIP is used when an allocation is given by its public
+// IP, which only exists while it is associated
+func abortWithUnstablePublicIP(c *gin.Context, publicIP string) {
+	abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidParameterCombination",
+		fmt.Sprintf("Address '%s' cannot be used: Elastic IPs get a new address at every association, "+
+			"use their AllocationId instead", publicIP), requestID(c)))
+}
+
+// removeAddressNIC removes the NIC of an associated address. NICs already
+// gone are fine.
+func removeAddressNIC(client *tritoncompute.ComputeClient, address *addressRecord) error {
+	err := client.Instances().RemoveNIC(context.Background(), &tritoncompute.RemoveNICInput{
+		InstanceID: address.InstanceID,
+		MAC:        address.MAC,
+	})
+	if err != nil && !tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+		log.Printf("[ERROR] remove vm nic error: %v\n", err)
+		return fmt.Errorf("Unable to remove triton compute instance nic: %w", err)
+	}
+	return nil
+}
+
+// AllocateAddress records a new Elastic IP allocation. Unlike EC2, it has no
+// address until associated, so the response has no PublicIp.
+func AllocateAddress(c *gin.Context) {
+	if domain := param(c, "Domain"); domain != "" && domain != ec2.DomainTypeVpc {
+		abortWithInvalidParameter(c, "Domain", domain)
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	address := &addressRecord{
+		ID:     newResourceID("eipalloc"),
+		Owner:  account.ID,
+		Region: regionName(c),
+	}
+	if err := db.Put(addressesCollection, address.key(), address); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save address: %w", err))
+		return
+	}
+
+	tags := tagSpecifications(c, ec2.ResourceTypeElasticIp)
+	if err := saveTags(db, address.Region, account.ID, address.ID, tags); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save address tags: %w", err))
+		return
+	}
+
+	ec2Output := ec2.AllocateAddressOutput{
+		AllocationId:       aws.String(address.ID),
+		Domain:             aws.String(ec2.DomainTypeVpc),
+		NetworkBorderGroup: aws.String(regionName(c)),
+	}
+
+	writeResponse(c, "AllocateAddress", ec2Output)
+}
+
+// AssociateAddress adds a NIC on the public network to the instance. When
+// the address is already associated, AllowReassociation is required, and
+// the previous NIC is removed first.
+func AssociateAddress(c *gin.Context) {
+	allocationID, publicIP := param(c, "AllocationId"), param(c, "PublicIp")
+	if allocationID == "" && publicIP == "" {
+		abortWithMissingParameter(c, "AllocationId")
+		return
+	}
+	if allocationID == "" {
+		abortWithUnstablePublicIP(c, publicIP)
+		return
+	}
+
+	instanceID := param(c, "InstanceId")
+	eniID := param(c, "NetworkInterfaceId")
+	if instanceID == "" && eniID == "" {
+		abortWithMissingParameter(c, "InstanceId")
+		return
+	}
+
+	allowReassociation := false
+	if value := param(c, "AllowReassociation"); value != "" {
+		var err error
+		if allowReassociation, err = strconv.ParseBool(value); err != nil {
+			abortWithInvalidParameter(c, "AllowReassociation", value)
+			return
+		}
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	network, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	address, err := findAddress(db, regionName(c), account.ID, allocationID, "", "")
+	if err == store.ErrNotFound {
+		abortWithAddressNotFound(c, allocationID, "")
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// The address is associated to the instance of the given interface
+	if instanceID == "" {
+		interfaces, err := loadNetworkInterfaces(c, account.ID)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		// Interfaces kept by the shim know their instance, while the
+		// others are found by their MAC address
+		for _, record := range interfaces.Records {
+			if record.ID == eniID {
+				instanceID = record.InstanceID
+			}
+		}
+		if mac, ok := parseMacID("eni", eniID); ok && instanceID == "" {
+			nic, err := findInstanceNIC(client, regionName(c), mac)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			if nic != nil && interfaces.interfaceID(nic.Instance.ID, nic.NIC.MAC) == eniID {
+				instanceID = nic.Instance.ID
+			}
+		}
+		if instanceID == "" {
+			abortWithNotFound(c, "InvalidNetworkInterfaceID.NotFound", eniID)
+			return
+		}
+	} else if getInstance(c, client, instanceID) == nil {
+		return
+	}
+
+	if _, err := refreshAddress(client, regionName(c), address); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if address.AssociationID != "" {
+		if address.InstanceID == instanceID {
+			ec2Output := ec2.AssociateAddressOutput{
+				AssociationId: aws.String(address.AssociationID),
+			}
+			writeResponse(c, "AssociateAddress", ec2Output)
+			return
+		}
+		if !allowReassociation {
+			abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("Resource.AlreadyAssociated",
+				fmt.Sprintf("resource %s is already associated with associate-id %s",
+					address.ID, address.AssociationID), requestID(c)))
+			return
+		}
+		if err := removeAddressNIC(client, address); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		clearAssociation(address)
+	}
+
+	public, err := publicNetwork(network)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	nic, err := client.Instances().AddNIC(context.Background(), &tritoncompute.AddNICInput{
+		InstanceID: instanceID,
+		Network:    public.Id,
+	})
+	if err != nil {
+		log.Printf("[ERROR] add vm nic error: %v\n", err)
+		// Keep track of any removed association
+		db.Put(addressesCollection, address.key(), address)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to add triton compute instance nic: %w", err))
+		return
+	}
+
+	address.PublicIP = nic.IP
+	address.NetworkID = public.Id
+	address.AssociationID = newResourceID("eipassoc")
+	address.InstanceID = instanceID
+	address.MAC = nic.MAC
+	if err := db.Put(addressesCollection, address.key(), address); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save address: %w", err))
+		return
+	}
+
+	log.Printf("[DEBUG] associated address %s (%s) to vm %s\n", address.ID, nic.IP, instanceID)
+
+	ec2Output := ec2.AssociateAddressOutput{
+		AssociationId: aws.String(address.AssociationID),
+	}
+
+	writeResponse(c, "AssociateAddress", ec2Output)
+}
+
+// DisassociateAddress removes the NIC of the address from its instance
+func DisassociateAddress(c *gin.Context) {
+	associationID, publicIP := param(c, "AssociationId"), param(c, "PublicIp")
+	if associationID == "" && publicIP == "" {
+		abortWithMissingParameter(c, "AssociationId")
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	address, err := findAddress(db, regionName(c), account.ID, "", publicIP, associationID)
+	if err == store.ErrNotFound {
+		if associationID != "" {
+			abortWithNotFound(c, "InvalidAssociationID.NotFound", associationID)
+			return
+		}
+		abortWithAddressNotFound(c, "", publicIP)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := removeAddressNIC(client, address); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	clearAssociation(address)
+	if err := db.Put(addressesCollection, address.key(), address); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save address: %w", err))
+		return
+	}
+
+	writeResponse(c, "DisassociateAddress", returnOutput{Return: aws.Bool(true)})
+}
+
+// ReleaseAddress deletes an Elastic IP allocation, which must not be
+// associated
+func ReleaseAddress(c *gin.Context) {
+	allocationID, publicIP := param(c, "AllocationId"), param(c, "PublicIp")
+	if allocationID == "" && publicIP == "" {
+		abortWithMissingParameter(c, "AllocationId")
+		return
+	}
+	if allocationID == "" {
+		abortWithUnstablePublicIP(c, publicIP)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	address, err := findAddress(db, regionName(c), account.ID, allocationID, "", "")
+	if err == store.ErrNotFound {
+		abortWithAddressNotFound(c, allocationID, "")
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := refreshAddress(client, regionName(c), address); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if address.AssociationID != "" {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidIPAddress.InUse",
+			fmt.Sprintf("Address %s is in use.", address.ID), requestID(c)))
+		return
+	}
+
+	if err := db.Delete(addressesCollection, address.key()); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to delete address: %w", err))
+		return
+	}
+	if err := saveTags(db, address.Region, account.ID, address.ID, nil); err != nil {
+		log.Printf("[ERROR] delete address %s tags error: %v\n", address.ID, err)
+	}
+
+	writeResponse(c, "ReleaseAddress", returnOutput{Return: aws.Bool(true)})
+}
+
+// addressFiltersMatch tells if the address satisfies the request filters
+func addressFiltersMatch(filters map[string][]string, address *ec2.Address) bool {
+	tags := make(map[string]string)
+	for _, tag := range address.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+
+	return filterMatch(filters, "allocation-id", *address.AllocationId) &&
+		filterMatch(filters, "association-id", aws.StringValue(address.AssociationId)) &&
+		filterMatch(filters, "domain", *address.Domain) &&
+		filterMatch(filters, "instance-id", aws.StringValue(address.InstanceId)) &&
+		filterMatch(filters, "network-border-group", *address.NetworkBorderGroup) &&
+		filterMatch(filters, "network-interface-id", aws.StringValue(address.NetworkInterfaceId)) &&
+		filterMatch(filters, "public-ip", aws.StringValue(address.PublicIp)) &&
+		tagFiltersMatch(filters, tags)
+}
+
+// DescribeAddresses lists the Elastic IP allocations of the account. The
+// associations whose NIC or instance is gone are cleared first.
+func DescribeAddresses(c *gin.Context) {
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	addresses, err := loadAddresses(db, regionName(c), account.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, address := range addresses {
+		updated, err := refreshAddress(client, regionName(c), address)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if !updated {
+			continue
+		}
+		if err := db.Put(addressesCollection, address.key(), address); err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to save address: %w", err))
+			return
+		}
+	}
+
+	allocationIDs, publicIPs := paramList(c, "AllocationId"), paramList(c, "PublicIp")
+	for _, id := range allocationIDs {
+		if _, err := findAddress(db, regionName(c), account.ID, id, "", ""); err != nil {
+			abortWithAddressNotFound(c, id, "")
+			return
+		}
+	}
+	for _, ip := range publicIPs {
+		found := false
+		for _, address := range addresses {
+			found = found || address.PublicIP == ip
+		}
+		if !found {
+			abortWithAddressNotFound(c, "", ip)
+			return
+		}
+	}
+
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeAddressesOutput{}
+	for _, address := range addresses {
+		if len(allocationIDs) > 0 && !containsString(allocationIDs, address.ID) {
+			continue
+		}
+		if len(publicIPs) > 0 && !containsString(publicIPs, address.PublicIP) {
+			continue
+		}
+		tags, err := loadTags(db, address.Region, account.ID, address.ID)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to load address tags: %w", err))
+			return
+		}
+		ec2Address := address.toEC2(tags, regionName(c))
+		if addressFiltersMatch(ec2Filters, ec2Address) {
+			ec2Output.Addresses = append(ec2Output.Addresses, ec2Address)
+		}
+	}
+
+	writeResponse(c, "DescribeAddresses", ec2Output)
+}
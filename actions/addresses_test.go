@@ -0,0 +1,71 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSAddresses(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		allocated, err := ec2Svc.AllocateAddress(&ec2.AllocateAddressInput{
+			Domain: aws.String(ec2.DomainTypeVpc),
+		})
+		if err != nil {
+			t.Errorf("allocate address error %v", err)
+			return
+		}
+		allocationID := allocated.AllocationId
+
+		described, err := ec2Svc.DescribeAddresses(&ec2.DescribeAddressesInput{
+			AllocationIds: []*string{allocationID},
+		})
+		if err != nil {
+			t.Errorf("describe addresses error %v", err)
+		} else if len(described.Addresses) != 1 ||
+			described.Addresses[0].AssociationId != nil {
+			t.Errorf("describe addresses did not return the new address")
+		}
+
+		// Addresses are not stable, so they cannot be used instead of allocations
+		_, err = ec2Svc.ReleaseAddress(&ec2.ReleaseAddressInput{
+			PublicIp: aws.String("203.0.113.1"),
+		})
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "InvalidParameterCombination" {
+			t.Errorf("release address should fail for public IPs, got %v", err)
+		}
+
+		_, err = ec2Svc.DisassociateAddress(&ec2.DisassociateAddressInput{
+			AssociationId: aws.String("eipassoc-00000000000000000"),
+		})
+		if err == nil {
+			t.Errorf("disassociate address should fail for unknown associations")
+		}
+
+		_, err = ec2Svc.ReleaseAddress(&ec2.ReleaseAddressInput{
+			AllocationId: allocationID,
+		})
+		if err != nil {
+			t.Errorf("release address error %v", err)
+		}
+
+		_, err = ec2Svc.DescribeAddresses(&ec2.DescribeAddressesInput{
+			AllocationIds: []*string{allocationID},
+		})
+		if err == nil {
+			t.Errorf("describe addresses should fail for released addresses")
+		}
+	})
+}
@@ -0,0 +1,205 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/joyent/triton-shim/api"
+	"github.com/joyent/triton-shim/utils"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// A Triton datacenter is an EC2 region. Availability zones are taken from
+// the region configuration (see tritonutils.RegionConfig) or, when there is
+// none, the region has a single zone named after the region plus "a". In
+// operator mode (CNAPI_URL), compute nodes are placed into zones using their
+// "availability_zone" trait, or their rack when it belongs to a configured
+// zone. Those without any of them belong to the default zone, which is the
+// first one.
+
+// availabilityZoneTrait is the compute node trait naming its zone
+const availabilityZoneTrait = "availability_zone"
+
+// availabilityZone is one of the availability zones of a region
+type availabilityZone struct {
+	Name string
+	ID   string
+	// Compute nodes of the zone, only known in operator mode
+	Servers []*api.Server
+}
+
+// regionName returns the region the request was signed for
+func regionName(c *gin.Context) string {
+	return c.GetString(utils.RegionKey)
+}
+
+// configuredZones returns the zone names of the region configuration, and
+// the zone of every configured rack
+func configuredZones(region string) ([]string, map[string]string, error) {
+	regions, err := tritonutils.LoadRegionsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	racks := make(map[string]string)
+	if config, found := regions[region]; found {
+		for name, zoneRacks := range config.Zones {
+			names = append(names, name)
+			for _, rack := range zoneRacks {
+				racks[rack] = name
+			}
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		names = []string{region + "a"}
+	}
+	return names, racks, nil
+}
+
+// listAvailabilityZones returns the availability zones of the given region
+func listAvailabilityZones(region string) ([]*availabilityZone, error) {
+	names, racks, err := configuredZones(region)
+	if err != nil {
+		return nil, err
+	}
+	defaultZone := names[0]
+
+	byName := make(map[string]*availabilityZone)
+	for _, name := range names {
+		byName[name] = &availabilityZone{Name: name}
+	}
+
+	cnapi, err := tritonutils.GetCnapiClient(region)
+	switch {
+	case errors.Is(err, api.ErrMissingURL):
+		cnapi = nil
+	case err != nil:
+		return nil, fmt.Errorf("Unable to create CNAPI client: %w", err)
+	}
+
+	if cnapi != nil {
+		servers, err := cnapi.ListServers(context.Background(), &api.ListServersInput{
+			Setup: true,
+		})
+		if err != nil {
+			log.Printf("[ERROR] list servers error: %v\n", err)
+			return nil, fmt.Errorf("Unable to list triton compute nodes: %w", err)
+		}
+
+		for _, zone := range byName {
+			zone.Servers = []*api.Server{}
+		}
+		for _, server := range servers {
+			name := defaultZone
+			if zone, found := racks[server.RackIdentifier]; found {
+				name = zone
+			}
+			if zone, ok := server.Traits[availabilityZoneTrait].(string); ok && zone != "" {
+				name = zone
+			}
+			if byName[name] == nil {
+				byName[name] = &availabilityZone{Name: name}
+			}
+			byName[name].Servers = append(byName[name].Servers, server)
+		}
+	}
+
+	zones := make([]*availabilityZone, 0, len(byName))
+	for _, zone := range byName {
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].Name < zones[j].Name
+	})
+	for i, zone := range zones {
+		zone.ID = fmt.Sprintf("%s-az%d", region, i+1)
+	}
+
+	return zones, nil
+}
+
+// traitValues returns the values of a trait. Arrays mean any of their
+// values, on both the package and the compute node sides.
+func traitValues(value interface{}) []interface{} {
+	if list, ok := value.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{value}
+}
+
+// traitsSatisfied tells if the traits have all the required ones. Trait
+// values can be booleans, strings or arrays of them, which match when any of
+// their values does.
+func traitsSatisfied(required map[string]interface{}, traits map[string]interface{}) bool {
+	for name, value := range required {
+		actual, found := traits[name]
+		if !found {
+			return false
+		}
+		matched := false
+		for _, want := range traitValues(value) {
+			for _, have := range traitValues(actual) {
+				if want == have {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// traitsMatch tells if DAPI would place an instance of a package with the
+// given traits into a compute node with the given ones: the compute node
+// must have all the package traits, and compute nodes with traits only
+// take instances requesting all of them.
+func traitsMatch(pkgTraits map[string]interface{}, serverTraits map[string]interface{}) bool {
+	return traitsSatisfied(pkgTraits, serverTraits) && traitsSatisfied(serverTraits, pkgTraits)
+}
+
+// serverFitsPackage tells if a new instance of the given package could be
+// placed into the compute node
+func serverFitsPackage(server *api.Server, pkg *api.Package) bool {
+	if server.Reserved || server.Status != "running" {
+		return false
+	}
+	if server.MemoryAvailableBytes < pkg.Memory*1024*1024 {
+		return false
+	}
+	return traitsMatch(pkg.Traits, server.Traits)
+}
+
+// zoneOffersPackage tells if the package can be used into the zone. Without
+// compute node details we assume it can.
+func zoneOffersPackage(zone *availabilityZone, pkg *api.Package) bool {
+	if zone.Servers == nil {
+		return pkg.Active
+	}
+	if !pkg.Active {
+		return false
+	}
+	for _, server := range zone.Servers {
+		if serverFitsPackage(server, pkg) {
+			return true
+		}
+	}
+	return false
+}
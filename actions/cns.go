@@ -0,0 +1,160 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+)
+
+// Triton CNS publishes DNS names for the instances of the accounts having it
+// enabled. Every instance gets "<instance>.inst.<zone>" names, by UUID and by
+// name, and the instances listing services into their triton.cns.services
+// tag also get "<service>.svc.<zone>" names, shared by all the instances of
+// the service. Zones are "<account UUID>.<datacenter>.<CNS suffix>", with one
+// zone per CNS suffix, usually a public and a private one. CloudAPI gives the
+// names of every instance (dns_names), which is where zones are taken from.
+
+const (
+	cnsInstanceKind = "inst"
+	cnsServiceKind  = "svc"
+)
+
+// cnsTTL is the TTL CNS uses for its records
+const cnsTTL = 60
+
+// cnsLabelRe matches the service names CNS accepts
+var cnsLabelRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// cnsName splits a CNS name into its first label, its kind (inst or svc)
+// and its zone. It returns false for names which are not CNS names.
+func cnsName(name string) (string, string, string, bool) {
+	parts := strings.SplitN(strings.TrimSuffix(strings.ToLower(name), "."), ".", 3)
+	if len(parts) < 3 || (parts[1] != cnsInstanceKind && parts[1] != cnsServiceKind) {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// cnsPrivateZone tells if the zone belongs to the CNS private suffix, given
+// by TRITON_SHIM_CNS_PRIVATE_SUFFIX. Without it, every zone is public.
+func cnsPrivateZone(zone string) bool {
+	suffix := strings.Trim(strings.ToLower(os.Getenv("TRITON_SHIM_CNS_PRIVATE_SUFFIX")), ".")
+	return suffix != "" && (zone == suffix || strings.HasSuffix(zone, "."+suffix))
+}
+
+// cnsZoneIPs returns the IPs of the instance published into the zone: the
+// ones from public networks for public zones, and the others for private
+// zones. CloudAPI lists instance IPs and networks in the same NIC order.
+func cnsZoneIPs(vm *tritoncompute.Instance, zone string, publicNetworks map[string]bool) []string {
+	private := cnsPrivateZone(zone)
+	var ips []string
+	for i, ip := range vm.IPs {
+		if i >= len(vm.Networks) {
+			break
+		}
+		if publicNetworks[vm.Networks[i]] != private {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// cnsServiceName returns the name of an entry of the triton.cns.services
+// tag, which can include a port like "web:8080"
+func cnsServiceName(entry string) string {
+	return strings.ToLower(strings.SplitN(strings.TrimSpace(entry), ":", 2)[0])
+}
+
+// cnsDNSNames returns the private and public DNS names of an instance, which
+// are its names by UUID into the private and public CNS zones
+func cnsDNSNames(vm *tritoncompute.Instance) (string, string) {
+	var private, public string
+	names := append([]string{}, vm.DomainNames...)
+	sort.Strings(names)
+	for _, name := range names {
+		label, kind, zone, ok := cnsName(name)
+		if !ok || kind != cnsInstanceKind || label != strings.ToLower(vm.ID) {
+			continue
+		}
+		if cnsPrivateZone(zone) {
+			if private == "" {
+				private = name
+			}
+		} else if public == "" {
+			public = name
+		}
+	}
+	return private, public
+}
+
+// cnsZone is a CNS zone with its records, as a map of the record names,
+// without the final dot, to their IPs
+type cnsZone struct {
+	Name    string
+	Records map[string][]string
+}
+
+// listCNSZones builds the CNS zones of the given instances, sorted by name.
+// Records only include running instances, like CNS does.
+func listCNSZones(vms []*tritoncompute.Instance, publicNetworks map[string]bool) []*cnsZone {
+	zones := make(map[string]*cnsZone)
+	for _, vm := range vms {
+		for _, name := range vm.DomainNames {
+			_, _, zoneName, ok := cnsName(name)
+			if !ok {
+				continue
+			}
+			zone, found := zones[zoneName]
+			if !found {
+				zone = &cnsZone{Name: zoneName, Records: make(map[string][]string)}
+				zones[zoneName] = zone
+			}
+			if vm.State != "running" || vm.CNS.Disable {
+				continue
+			}
+			recordName := strings.TrimSuffix(strings.ToLower(name), ".")
+			for _, ip := range cnsZoneIPs(vm, zoneName, publicNetworks) {
+				if !containsString(zone.Records[recordName], ip) {
+					zone.Records[recordName] = append(zone.Records[recordName], ip)
+				}
+			}
+		}
+	}
+
+	result := make([]*cnsZone, 0, len(zones))
+	for _, zone := range zones {
+		for name, ips := range zone.Records {
+			if len(ips) == 0 {
+				delete(zone.Records, name)
+				continue
+			}
+			sort.Strings(ips)
+		}
+		result = append(result, zone)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// recordNames returns the names of the zone records, sorted
+func (z *cnsZone) recordNames() []string {
+	names := make([]string, 0, len(z.Records))
+	for name := range z.Records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -51,7 +51,7 @@ func convertTagMapToTagset(tags map[string]string) []*ec2.Tag {
 }
 
 func DescribeImages(c *gin.Context) {
-	client, err := tritonutils.GetTritonComputeClient()
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError,
 			fmt.Errorf("Unable to create triton compute client: %w", err))
@@ -0,0 +1,120 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+
+	"github.com/joyent/triton-shim/api"
+)
+
+// DescribeInstanceTypeOfferings lists the instance types usable into the
+// region or into each of its availability zones (see availability_zones.go)
+func DescribeInstanceTypeOfferings(c *gin.Context) {
+	locationType := param(c, "LocationType")
+	if locationType == "" {
+		locationType = ec2.LocationTypeRegion
+	}
+	switch locationType {
+	case ec2.LocationTypeRegion,
+		ec2.LocationTypeAvailabilityZone,
+		ec2.LocationTypeAvailabilityZoneId:
+	default:
+		abortWithInvalidParameter(c, "LocationType", locationType)
+		return
+	}
+
+	config, err := loadInstanceTypesConfig()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	packages, err := listPackages(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	region := regionName(c)
+	zones, err := listAvailabilityZones(region)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Every instance type name, including the aliases, with its package
+	instanceTypes := make(map[string]*api.Package)
+	for _, pkg := range latestPackages(packages) {
+		if _, aliased := config.Aliases[pkg.Name]; aliased {
+			continue
+		}
+		instanceTypes[pkg.Name] = pkg
+	}
+	for alias, pkg := range instanceTypeAliases(packages, config) {
+		instanceTypes[alias] = pkg
+	}
+
+	names := make([]string, 0, len(instanceTypes))
+	for name := range instanceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ec2Filters := filters(c)
+	include := func(name string, location string) bool {
+		if values, found := ec2Filters["instance-type"]; found && !containsString(values, name) {
+			return false
+		}
+		if values, found := ec2Filters["location"]; found && !containsString(values, location) {
+			return false
+		}
+		return true
+	}
+
+	ec2Output := ec2.DescribeInstanceTypeOfferingsOutput{}
+	addOffering := func(name string, location string) {
+		if !include(name, location) {
+			return
+		}
+		ec2Output.InstanceTypeOfferings = append(ec2Output.InstanceTypeOfferings,
+			&ec2.InstanceTypeOffering{
+				InstanceType: aws.String(name),
+				Location:     aws.String(location),
+				LocationType: aws.String(locationType),
+			})
+	}
+
+	for _, name := range names {
+		pkg := instanceTypes[name]
+		offered := false
+		for _, zone := range zones {
+			if !zoneOffersPackage(zone, pkg) {
+				continue
+			}
+			offered = true
+			switch locationType {
+			case ec2.LocationTypeAvailabilityZone:
+				addOffering(name, zone.Name)
+			case ec2.LocationTypeAvailabilityZoneId:
+				addOffering(name, zone.ID)
+			}
+		}
+		if offered && locationType == ec2.LocationTypeRegion {
+			addOffering(name, region)
+		}
+	}
+
+	writeResponse(c, "DescribeInstanceTypeOfferings", ec2Output)
+}
@@ -0,0 +1,104 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSDescribeInstanceTypeOfferings(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		result, err := ec2Svc.DescribeInstanceTypeOfferings(nil)
+		if err != nil {
+			t.Errorf("describe instance type offerings error %v", err)
+		}
+
+		if len(result.InstanceTypeOfferings) == 0 {
+			t.Errorf("describe instance type offerings did not return any results")
+		}
+
+		for _, offering := range result.InstanceTypeOfferings {
+			if *offering.LocationType != ec2.LocationTypeRegion {
+				t.Errorf("unexpected location type %s", *offering.LocationType)
+			}
+		}
+
+		result, err = ec2Svc.DescribeInstanceTypeOfferings(&ec2.DescribeInstanceTypeOfferingsInput{
+			LocationType: aws.String(ec2.LocationTypeAvailabilityZone),
+		})
+		if err != nil {
+			t.Errorf("describe instance type offerings by zone error %v", err)
+		}
+
+		if len(result.InstanceTypeOfferings) == 0 {
+			t.Errorf("describe instance type offerings by zone did not return any results")
+		}
+
+		for _, offering := range result.InstanceTypeOfferings {
+			if *offering.Location == "" {
+				t.Errorf("instance type offering has no availability zone")
+			}
+		}
+	})
+}
+
+func TestAccAWSDescribeInstanceTypeOfferingsTraits(t *testing.T) {
+	papi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"uuid": "4667d1b8-8b8b-4ef6-bd5a-d1d7a4c3e1bb", "name": "shim-plain",
+				"max_physical_memory": 1024, "active": true},
+			{"uuid": "a5f1c8c5-7d3b-4b05-8d52-7a47f2b1d0c4", "name": "shim-ssd",
+				"max_physical_memory": 1024, "active": true, "traits": map[string]interface{}{"ssd": true}},
+		})
+	}))
+	defer papi.Close()
+
+	// The only compute node has a trait, so it does not take packages
+	// without it
+	cnapi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"uuid": "564d8f2a-0d8e-4f6f-9bd3-1d9d2a1f6f0e", "hostname": "cn1", "status": "running",
+				"setup": true, "memory_available_bytes": 8 << 30, "traits": map[string]interface{}{"ssd": true}},
+		})
+	}))
+	defer cnapi.Close()
+
+	os.Setenv("PAPI_URL", papi.URL)
+	defer os.Unsetenv("PAPI_URL")
+	os.Setenv("CNAPI_URL", cnapi.URL)
+	defer os.Unsetenv("CNAPI_URL")
+
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		result, err := ec2Svc.DescribeInstanceTypeOfferings(&ec2.DescribeInstanceTypeOfferingsInput{
+			LocationType: aws.String(ec2.LocationTypeAvailabilityZone),
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("instance-type"),
+				Values: aws.StringSlice([]string{"shim-plain", "shim-ssd"}),
+			}},
+		})
+		if err != nil {
+			t.Errorf("describe instance type offerings error %v", err)
+			return
+		}
+
+		if len(result.InstanceTypeOfferings) != 1 || *result.InstanceTypeOfferings[0].InstanceType != "shim-ssd" {
+			t.Errorf("only the package requiring the compute node traits should be offered, got %v",
+				result.InstanceTypeOfferings)
+		}
+	})
+}
@@ -9,72 +9,95 @@
 package actions
 
 import (
-	"bytes"
-	"context"
-	"encoding/xml"
-	"fmt"
 	"net/http"
+	"sort"
 
-	"github.com/aws/aws-sdk-go/private/protocol/xml/xmlutil"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 
-	tritoncompute "github.com/joyent/triton-go/v2/compute"
-	tritonutils "github.com/joyent/triton-shim/utils/triton"
+	"github.com/joyent/triton-shim/api"
 )
 
+// latestPackages keeps a single package for every package name: the latest
+// active version or, when none is active, the latest version
+func latestPackages(packages []*api.Package) []*api.Package {
+	byName := make(map[string]*api.Package)
+	for _, pkg := range packages {
+		current, found := byName[pkg.Name]
+		switch {
+		case !found:
+			byName[pkg.Name] = pkg
+		case pkg.Active != current.Active:
+			if pkg.Active {
+				byName[pkg.Name] = pkg
+			}
+		case compareVersions(pkg.Version, current.Version) > 0:
+			byName[pkg.Name] = pkg
+		}
+	}
+
+	latest := make([]*api.Package, 0, len(byName))
+	for _, pkg := range byName {
+		latest = append(latest, pkg)
+	}
+	sort.Slice(latest, func(i, j int) bool {
+		return latest[i].Name < latest[j].Name
+	})
+	return latest
+}
+
+// DescribeInstanceTypes lists the Triton packages and their AWS-style
+// aliases (see instance_type_aliases.go) as EC2 instance types
 func DescribeInstanceTypes(c *gin.Context) {
-	client, err := tritonutils.GetTritonComputeClient()
+	config, err := loadInstanceTypesConfig()
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError,
-			fmt.Errorf("Unable to create triton compute client: %w", err))
+		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	packageListInput := &tritoncompute.ListPackagesInput{}
-
-	packages, err := client.Packages().List(context.Background(), packageListInput)
-
+	packages, err := listPackages(regionName(c), requestPrincipal(c))
 	if err != nil {
-		log.Printf("[ERROR] list packages error: %v\n", err)
-		c.AbortWithError(http.StatusInternalServerError,
-			fmt.Errorf("Unable to list triton compute packages: %w", err))
+		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
 	log.Printf("[DEBUG] loaded %d packages\n", len(packages))
 
-	// Convert Triton package to AWS AMI.
+	wanted := paramList(c, "InstanceType")
+	include := func(name string) bool {
+		return len(wanted) == 0 || containsString(wanted, name)
+	}
+
+	// Convert Triton package to AWS instance type.
 	ec2Output := ec2.DescribeInstanceTypesOutput{}
 
-	if len(packages) > 0 {
-		for _, pkg := range packages {
-			instType := &ec2.InstanceTypeInfo{
-				InstanceType: &pkg.Name,
-				MemoryInfo:   &ec2.MemoryInfo{SizeInMiB: &pkg.Memory},
-			}
-			ec2Output.InstanceTypes = append(ec2Output.InstanceTypes, instType)
+	for _, pkg := range latestPackages(packages) {
+		// Configured aliases take precedence over package names
+		if _, aliased := config.Aliases[pkg.Name]; aliased {
+			continue
+		}
+		if include(pkg.Name) {
+			ec2Output.InstanceTypes = append(ec2Output.InstanceTypes, packageToInstanceType(pkg))
 		}
 	}
 
-	// Generate the XML response.
-	var buf bytes.Buffer
-	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
-	buf.WriteString(`<DescribeInstanceTypesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">` + "\n")
-
-	// Build the XML from the AWS struct.
-	err = xmlutil.BuildXML(ec2Output, xml.NewEncoder(&buf))
-	if err != nil {
-		log.Printf("[ERROR] xmlutil.BuildXML error: %v\n", err)
-		c.AbortWithError(http.StatusInternalServerError,
-			fmt.Errorf("Unable to translate triton compute instances: %w", err))
-		return
+	aliases := instanceTypeAliases(packages, config)
+	names := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		names = append(names, alias)
 	}
+	sort.Strings(names)
 
-	buf.WriteString(`</DescribeInstanceTypesResponse>` + "\n")
+	for _, alias := range names {
+		if !include(alias) {
+			continue
+		}
+		instType := packageToInstanceType(aliases[alias])
+		instType.InstanceType = aws.String(alias)
+		ec2Output.InstanceTypes = append(ec2Output.InstanceTypes, instType)
+	}
 
-	// Send the XML response.
-	c.Header("content-type", "text/xml;charset=UTF-8")
-	c.Data(http.StatusOK, "", buf.Bytes())
+	writeResponse(c, "DescribeInstanceTypes", ec2Output)
 }
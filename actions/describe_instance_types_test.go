@@ -31,6 +31,15 @@ func TestAccAWSDescribeInstanceTypes(t *testing.T) {
 			if *inst.MemoryInfo.SizeInMiB == 0 {
 				t.Errorf("instancetype memory is zero")
 			}
+			if *inst.VCpuInfo.DefaultVCpus == 0 {
+				t.Errorf("instancetype vcpus is zero")
+			}
+			if len(inst.SupportedVirtualizationTypes) == 0 {
+				t.Errorf("instancetype has no supported virtualization types")
+			}
+			if *inst.InstanceStorageSupported || inst.InstanceStorageInfo != nil {
+				t.Errorf("instancetype disk should only be described as its EBS root")
+			}
 		}
 	})
 }
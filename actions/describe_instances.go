@@ -9,24 +9,102 @@
 package actions
 
 import (
-	"bytes"
 	"context"
-	"encoding/xml"
 	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/private/protocol/xml/xmlutil"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 
 	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	"github.com/joyent/triton-shim/api"
 	tritonutils "github.com/joyent/triton-shim/utils/triton"
 )
 
+// instanceConvertState maps Triton instance states to EC2 instance states
+func instanceConvertState(state string) *ec2.InstanceState {
+	switch state {
+	case "provisioning":
+		return &ec2.InstanceState{Code: aws.Int64(0), Name: aws.String(ec2.InstanceStateNamePending)}
+	case "running":
+		return &ec2.InstanceState{Code: aws.Int64(16), Name: aws.String(ec2.InstanceStateNameRunning)}
+	case "stopping":
+		return &ec2.InstanceState{Code: aws.Int64(64), Name: aws.String(ec2.InstanceStateNameStopping)}
+	case "stopped", "offline":
+		return &ec2.InstanceState{Code: aws.Int64(80), Name: aws.String(ec2.InstanceStateNameStopped)}
+	case "deleted", "failed":
+		return &ec2.InstanceState{Code: aws.Int64(48), Name: aws.String(ec2.InstanceStateNameTerminated)}
+	default:
+		return &ec2.InstanceState{Code: aws.Int64(0), Name: aws.String(ec2.InstanceStateNamePending)}
+	}
+}
+
+// instanceGroups returns the security groups of an instance, since their
+// membership is kept as machine tags
+func instanceGroups(vm *tritoncompute.Instance) []*ec2.GroupIdentifier {
+	var groupIDs []string
+	for key := range vm.Tags {
+		if id, ok := tagSecurityGroup(key); ok {
+			groupIDs = append(groupIDs, id)
+		}
+	}
+	sort.Strings(groupIDs)
+
+	var groups []*ec2.GroupIdentifier
+	for _, id := range groupIDs {
+		groups = append(groups, &ec2.GroupIdentifier{
+			GroupId: aws.String(id),
+		})
+	}
+	return groups
+}
+
+// instanceToEC2 converts a Triton vm to an AWS instance
+func instanceToEC2(vm *tritoncompute.Instance) *ec2.Instance {
+	inst := &ec2.Instance{
+		InstanceId:         aws.String(vm.ID),
+		VirtualizationType: aws.String("hvm"), // Is this correct?
+		ImageId:            aws.String(vm.Image),
+		InstanceType:       aws.String(instanceTypeName(vm)),
+		State:              instanceConvertState(vm.State),
+		LaunchTime:         aws.Time(vm.Created),
+		SecurityGroups:     instanceGroups(vm),
+		RootDeviceName:     aws.String(rootDeviceName),
+		RootDeviceType:     aws.String(ec2.DeviceTypeEbs),
+		BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{{
+			DeviceName: aws.String(rootDeviceName),
+			Ebs: &ec2.EbsInstanceBlockDevice{
+				VolumeId:            aws.String(rootVolumeID(vm.ID)),
+				Status:              aws.String(ec2.AttachmentStatusAttached),
+				AttachTime:          aws.Time(vm.Created),
+				DeleteOnTermination: aws.Bool(true),
+			},
+		}},
+	}
+	if keyName, ok := vm.Metadata[keyNameMetadataKey].(string); ok && keyName != "" {
+		inst.KeyName = aws.String(keyName)
+	}
+	return inst
+}
+
+// addInstanceDNSNames sets the instance DNS names from its CNS names. Like
+// EC2, only instances with a public IP get a public DNS name.
+func addInstanceDNSNames(inst *ec2.Instance, vm *tritoncompute.Instance) {
+	private, public := cnsDNSNames(vm)
+	inst.PrivateDnsName = aws.String(private)
+	if inst.PublicIpAddress != nil {
+		inst.PublicDnsName = aws.String(public)
+	} else {
+		inst.PublicDnsName = aws.String("")
+	}
+}
+
 func DescribeInstances(c *gin.Context) {
-	client, err := tritonutils.GetTritonComputeClient()
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError,
 			fmt.Errorf("Unable to create triton compute client: %w", err))
@@ -46,6 +124,19 @@ func DescribeInstances(c *gin.Context) {
 
 	log.Printf("[DEBUG] loaded %d vms\n", len(vms))
 
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	interfaces := loadInstanceNetworkInterfaces(c, account.ID)
+
+	var nics map[string][]*api.NIC
+	if interfaces != nil {
+		nics = listInstancesAddressNICs(client, regionName(c), vms)
+	}
+
 	// Convert Triton vm to AWS instance.
 	ec2Output := ec2.DescribeInstancesOutput{}
 
@@ -53,34 +144,35 @@ func DescribeInstances(c *gin.Context) {
 		res := &ec2.Reservation{}
 
 		for _, vm := range vms {
-			inst := &ec2.Instance{
-				InstanceId:         &vm.ID,
-				VirtualizationType: aws.String("hvm"), // Is this correct?
-				ImageId:            &vm.Image,
+			inst := instanceToEC2(vm)
+			if interfaces != nil {
+				interfaces.addInstanceNetworkInterfaces(inst, vm, nics[vm.ID])
 			}
+			addInstanceDNSNames(inst, vm)
 			res.Instances = append(res.Instances, inst)
 		}
 
 		ec2Output.Reservations = append(ec2Output.Reservations, res)
 	}
 
-	// Generate the XML response.
-	var buf bytes.Buffer
-	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
-	buf.WriteString(`<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">` + "\n")
+	writeResponse(c, "DescribeInstances", ec2Output)
+}
 
-	// Build the XML from the AWS struct.
-	err = xmlutil.BuildXML(ec2Output, xml.NewEncoder(&buf))
+// getInstance retrieves the Triton instance with the given ID. When it fails
+// the request is aborted with the proper error, and nil is returned.
+func getInstance(c *gin.Context, client *tritoncompute.ComputeClient, id string) *tritoncompute.Instance {
+	vm, err := client.Instances().Get(context.Background(), &tritoncompute.GetInstanceInput{
+		ID: id,
+	})
 	if err != nil {
-		log.Printf("[ERROR] xmlutil.BuildXML error: %v\n", err)
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithNotFound(c, "InvalidInstanceID.NotFound", id)
+			return nil
+		}
+		log.Printf("[ERROR] get vm error: %v\n", err)
 		c.AbortWithError(http.StatusInternalServerError,
-			fmt.Errorf("Unable to translate triton compute instances: %w", err))
-		return
+			fmt.Errorf("Unable to get triton compute instance: %w", err))
+		return nil
 	}
-
-	buf.WriteString(`</DescribeInstancesResponse>` + "\n")
-
-	// Send the XML response.
-	c.Header("content-type", "text/xml;charset=UTF-8")
-	c.Data(http.StatusOK, "", buf.Bytes())
+	return vm
 }
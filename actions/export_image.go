@@ -0,0 +1,453 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	"github.com/joyent/triton-shim/api"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// exportImageTasksCollection is the store collection for ExportImage tasks.
+// Neither IMGAPI nor Manta keep track of image exports, so the shim does.
+const exportImageTasksCollection = "export-image-tasks"
+
+// Export image task status values
+const (
+	exportTaskActive    = "active"
+	exportTaskCompleted = "completed"
+	exportTaskDeleted   = "deleted"
+)
+
+// diskImageFormats are the accepted ExportImage DiskImageFormat values
+var diskImageFormats = []string{
+	ec2.DiskImageFormatVmdk,
+	ec2.DiskImageFormatRaw,
+	ec2.DiskImageFormatVhd,
+}
+
+// exportImageTask is the shim record of an ExportImage request
+type exportImageTask struct {
+	ID              string `json:"id"`
+	Owner           string `json:"owner"`
+	Region          string `json:"region"`
+	ImageID         string `json:"image_id"`
+	Description     string `json:"description"`
+	DiskImageFormat string `json:"disk_image_format"`
+	S3Bucket        string `json:"s3_bucket"`
+	S3Prefix        string `json:"s3_prefix"`
+	MantaPath       string `json:"manta_path,omitempty"`
+	LocalPath       string `json:"local_path,omitempty"`
+	ImagePath       string `json:"image_path,omitempty"`
+	ManifestPath    string `json:"manifest_path,omitempty"`
+	Status          string `json:"status"`
+	StatusMessage   string `json:"status_message,omitempty"`
+	Progress        string `json:"progress"`
+}
+
+// key returns the store key of the task
+func (t *exportImageTask) key() string {
+	return ownedKey(t.Region, t.Owner, t.ID)
+}
+
+func (t *exportImageTask) toEC2() *ec2.ExportImageTask {
+	task := &ec2.ExportImageTask{
+		ExportImageTaskId: aws.String(t.ID),
+		ImageId:           aws.String(t.ImageID),
+		Progress:          aws.String(t.Progress),
+		S3ExportLocation: &ec2.ExportTaskS3Location{
+			S3Bucket: aws.String(t.S3Bucket),
+		},
+		Status: aws.String(t.Status),
+	}
+	if t.Description != "" {
+		task.Description = aws.String(t.Description)
+	}
+	if t.S3Prefix != "" {
+		task.S3ExportLocation.S3Prefix = aws.String(t.S3Prefix)
+	}
+	if t.StatusMessage != "" {
+		task.StatusMessage = aws.String(t.StatusMessage)
+	}
+	return task
+}
+
+// s3BucketRe matches the S3 bucket naming rules: 3 to 63 lowercase letters,
+// numbers, dots and hyphens, starting and ending with a letter or number
+var s3BucketRe = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// validS3Bucket tells if the bucket follows the S3 bucket naming rules,
+// which also keeps it from being a relative path
+func validS3Bucket(bucket string) bool {
+	return s3BucketRe.MatchString(bucket) && !strings.Contains(bucket, "..")
+}
+
+// validS3Prefix tells if the prefix has no ".." segment, which would take
+// the export out of its bucket
+func validS3Prefix(prefix string) bool {
+	for _, segment := range strings.FieldsFunc(prefix, func(r rune) bool {
+		return r == '/' || r == '\\'
+	}) {
+		if segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// errExportOutsideRoot The export path is not under its root directory
+var errExportOutsideRoot = errors.New("export path outside of the export root")
+
+// exportMantaPath maps the S3 bucket and prefix of an export request to the
+// Manta directory where the image will be exported. Buckets are directories
+// under TRITON_SHIM_EXPORT_MANTA_PATH, which defaults to the account's
+// /:login/stor directory.
+func exportMantaPath(login string, bucket string, prefix string) (string, error) {
+	root := os.Getenv("TRITON_SHIM_EXPORT_MANTA_PATH")
+	if root == "" {
+		root = path.Join("/", login, "stor")
+	}
+	root = path.Clean(root)
+	exportPath := path.Join(root, bucket, prefix)
+	if !strings.HasPrefix(exportPath, strings.TrimSuffix(root, "/")+"/") {
+		return "", errExportOutsideRoot
+	}
+	// The trailing slash tells IMGAPI to take the path as a directory
+	return exportPath + "/", nil
+}
+
+// exportLocalPath maps the S3 bucket and prefix of an export request to a
+// local directory of the account under TRITON_SHIM_EXPORT_DIR. Local exports
+// are a stand-in for Manta, useful for testing or when the shim shares
+// storage with the consumer of the exported images.
+func exportLocalPath(login string, bucket string, prefix string) (string, error) {
+	exportDir := os.Getenv("TRITON_SHIM_EXPORT_DIR")
+	if exportDir == "" {
+		return "", nil
+	}
+	root := filepath.Join(exportDir, login)
+	exportPath := filepath.Join(root, bucket, prefix)
+	if !strings.HasPrefix(exportPath, root+string(filepath.Separator)) {
+		return "", errExportOutsideRoot
+	}
+	return exportPath, nil
+}
+
+// imageFileExtension gives the usual Triton image file extension for the
+// given file compression
+func imageFileExtension(compression string) string {
+	switch compression {
+	case "gzip":
+		return ".zfs.gz"
+	case "bzip2":
+		return ".zfs.bz2"
+	case "xz":
+		return ".zfs.xz"
+	default:
+		return ".zfs"
+	}
+}
+
+// exportImageToDir downloads the image manifest and file from IMGAPI into
+// the task local path, named after the image name and version, like IMGAPI
+// does for Manta exports. Task progress is updated while downloading.
+func exportImageToDir(db *store.Store, imgapi *api.ImgapiClient, task *exportImageTask) error {
+	ctx := context.Background()
+
+	img, err := imgapi.GetImage(ctx, &api.GetImageInput{UUID: task.ImageID})
+	if err != nil {
+		return err
+	}
+	if len(img.Files) == 0 {
+		return api.ErrNoImageFile
+	}
+
+	if err := os.MkdirAll(task.LocalPath, 0755); err != nil {
+		return err
+	}
+
+	baseName := fmt.Sprintf("%s-%s", img.Name, img.Version)
+	task.ManifestPath = filepath.Join(task.LocalPath, baseName+".imgmanifest")
+	task.ImagePath = filepath.Join(task.LocalPath,
+		baseName+imageFileExtension(img.Files[0].Compression))
+
+	manifest, err := imgapi.GetImageManifest(ctx, &api.GetImageInput{UUID: task.ImageID})
+	if err != nil {
+		return err
+	}
+	defer manifest.Close()
+
+	manifestFile, err := os.Create(task.ManifestPath)
+	if err != nil {
+		return err
+	}
+	defer manifestFile.Close()
+
+	if _, err := io.Copy(manifestFile, manifest); err != nil {
+		return err
+	}
+
+	lastProgress := task.Progress
+	fileInput := &api.GetImageFileInput{
+		UUID: task.ImageID,
+		Progress: func(transferred int64, total int64) {
+			if total == 0 {
+				return
+			}
+			progress := fmt.Sprintf("%d", transferred*100/total)
+			if progress == lastProgress {
+				return
+			}
+			lastProgress = progress
+			task.Progress = progress
+			if err := db.Put(exportImageTasksCollection, task.key(), task); err != nil {
+				log.Printf("[ERROR] save export image task %s error: %v\n", task.ID, err)
+			}
+		},
+	}
+
+	return imgapi.DownloadImageFile(ctx, fileInput, task.ImagePath)
+}
+
+// exportImageToManta asks IMGAPI to export the image into the task Manta
+// path. IMGAPI does not report any progress while uploading the image.
+func exportImageToManta(imgapi *api.ImgapiClient, task *exportImageTask) error {
+	input := &api.ExportImageInput{
+		UUID:      task.ImageID,
+		MantaPath: task.MantaPath,
+		Account:   task.Owner,
+	}
+
+	location, err := imgapi.ExportImage(context.Background(), input)
+	if err != nil {
+		return err
+	}
+
+	task.ImagePath = location.ImagePath
+	task.ManifestPath = location.ManifestPath
+	return nil
+}
+
+// runExportImageTask performs the export and updates the task record with
+// the results. It is expected to run on its own goroutine, since exports
+// take a while for big images.
+func runExportImageTask(db *store.Store, imgapi *api.ImgapiClient, task *exportImageTask) {
+	var err error
+	if task.LocalPath != "" {
+		err = exportImageToDir(db, imgapi, task)
+	} else {
+		err = exportImageToManta(imgapi, task)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] export image %s error: %v\n", task.ImageID, err)
+		task.Status = exportTaskDeleted
+		task.StatusMessage = fmt.Sprintf("Image export failed: %v", err)
+	} else {
+		task.Status = exportTaskCompleted
+		task.Progress = "100"
+	}
+
+	if err := db.Put(exportImageTasksCollection, task.key(), task); err != nil {
+		log.Printf("[ERROR] save export image task %s error: %v\n", task.ID, err)
+	}
+}
+
+// ExportImage exports a Triton image file and manifest into Manta, which is
+// Triton's native export target. The S3 bucket and prefix are mapped to a
+// Manta directory (see exportMantaPath), or to a local directory when
+// TRITON_SHIM_EXPORT_DIR is set (see exportLocalPath). Images are exported
+// using their Triton format, whatever the requested DiskImageFormat.
+func ExportImage(c *gin.Context) {
+	imageID := param(c, "ImageId")
+	if imageID == "" {
+		abortWithMissingParameter(c, "ImageId")
+		return
+	}
+
+	diskImageFormat := param(c, "DiskImageFormat")
+	if diskImageFormat == "" {
+		abortWithMissingParameter(c, "DiskImageFormat")
+		return
+	}
+	if !containsString(diskImageFormats, diskImageFormat) {
+		abortWithInvalidParameter(c, "DiskImageFormat", diskImageFormat)
+		return
+	}
+
+	bucket := param(c, "S3ExportLocation.S3Bucket")
+	if bucket == "" {
+		abortWithMissingParameter(c, "S3ExportLocation.S3Bucket")
+		return
+	}
+	if !validS3Bucket(bucket) {
+		abortWithInvalidParameter(c, "S3ExportLocation.S3Bucket", bucket)
+		return
+	}
+	prefix := param(c, "S3ExportLocation.S3Prefix")
+	if !validS3Prefix(prefix) {
+		abortWithInvalidParameter(c, "S3ExportLocation.S3Prefix", prefix)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	_, err = client.Images().Get(context.Background(), &tritoncompute.GetImageInput{
+		ImageID: imageID,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithNotFound(c, "InvalidAMIID.NotFound", imageID)
+			return
+		}
+		log.Printf("[ERROR] get image error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to get triton compute image: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	imgapi, err := tritonutils.GetImgapiClient(regionName(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create IMGAPI client: %w", err))
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	task := &exportImageTask{
+		ID:              newResourceID("export-ami"),
+		Owner:           account.ID,
+		Region:          regionName(c),
+		ImageID:         imageID,
+		Description:     param(c, "Description"),
+		DiskImageFormat: diskImageFormat,
+		S3Bucket:        bucket,
+		S3Prefix:        prefix,
+		Status:          exportTaskActive,
+		Progress:        "0",
+	}
+	task.LocalPath, err = exportLocalPath(account.Login, bucket, prefix)
+	if err == nil && task.LocalPath == "" {
+		task.MantaPath, err = exportMantaPath(account.Login, bucket, prefix)
+	}
+	if err != nil {
+		abortWithInvalidParameter(c, "S3ExportLocation.S3Prefix", prefix)
+		return
+	}
+
+	if err := db.Put(exportImageTasksCollection, task.key(), task); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save export image task: %w", err))
+		return
+	}
+
+	log.Printf("[DEBUG] exporting image %s to %s%s\n", imageID, task.MantaPath, task.LocalPath)
+
+	ec2Task := task.toEC2()
+	ec2Output := ec2.ExportImageOutput{
+		Description:       ec2Task.Description,
+		DiskImageFormat:   aws.String(task.DiskImageFormat),
+		ExportImageTaskId: ec2Task.ExportImageTaskId,
+		ImageId:           ec2Task.ImageId,
+		Progress:          ec2Task.Progress,
+		S3ExportLocation:  ec2Task.S3ExportLocation,
+		Status:            ec2Task.Status,
+	}
+
+	go runExportImageTask(db, imgapi, task)
+
+	writeResponse(c, "ExportImage", ec2Output)
+}
+
+// DescribeExportImageTasks lists the image export tasks recorded by the shim
+// for the current account
+func DescribeExportImageTasks(c *gin.Context) {
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	taskIDs := paramList(c, "ExportImageTaskId")
+	listAll := len(taskIDs) == 0
+	if listAll {
+		taskIDs = db.Keys(exportImageTasksCollection)
+	}
+
+	ec2Output := ec2.DescribeExportImageTasksOutput{}
+
+	for _, taskID := range taskIDs {
+		key := taskID
+		if !listAll {
+			key = ownedKey(regionName(c), account.ID, taskID)
+		}
+		var task exportImageTask
+		err := db.Get(exportImageTasksCollection, key, &task)
+		if err == nil && (task.Region != regionName(c) || task.Owner != account.ID) {
+			if listAll {
+				continue
+			}
+			err = store.ErrNotFound
+		}
+		if err == store.ErrNotFound {
+			abortWithNotFound(c, "InvalidExportImageTaskId.NotFound", taskID)
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to load export image task: %w", err))
+			return
+		}
+		ec2Output.ExportImageTasks = append(ec2Output.ExportImageTasks, task.toEC2())
+	}
+
+	writeResponse(c, "DescribeExportImageTasks", ec2Output)
+}
@@ -0,0 +1,88 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSExportImage(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		images, err := ec2Svc.DescribeImages(nil)
+		if err != nil {
+			t.Errorf("describe images error %v", err)
+			return
+		}
+		if len(images.Images) == 0 {
+			t.Errorf("describe images did not return any images")
+			return
+		}
+
+		result, err := ec2Svc.ExportImage(&ec2.ExportImageInput{
+			ImageId:         images.Images[0].ImageId,
+			DiskImageFormat: aws.String(ec2.DiskImageFormatRaw),
+			S3ExportLocation: &ec2.ExportTaskS3LocationRequest{
+				S3Bucket: aws.String("triton-shim-test"),
+				S3Prefix: aws.String("exports"),
+			},
+		})
+		if err != nil {
+			t.Errorf("export image error %v", err)
+			return
+		}
+
+		if *result.Status != "active" {
+			t.Errorf("export image task status should be 'active', got '%s'",
+				*result.Status)
+		}
+
+		tasks, err := ec2Svc.DescribeExportImageTasks(&ec2.DescribeExportImageTasksInput{
+			ExportImageTaskIds: []*string{result.ExportImageTaskId},
+		})
+		if err != nil {
+			t.Errorf("describe export image tasks error %v", err)
+			return
+		}
+
+		if len(tasks.ExportImageTasks) != 1 {
+			t.Errorf("describe export image tasks did not return the task")
+			return
+		}
+		if *tasks.ExportImageTasks[0].ImageId != *images.Images[0].ImageId {
+			t.Errorf("export image task has the wrong image id '%s'",
+				*tasks.ExportImageTasks[0].ImageId)
+		}
+	})
+}
+
+func TestAccAWSExportImageLocation(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		for _, location := range []*ec2.ExportTaskS3LocationRequest{
+			{S3Bucket: aws.String("../../etc")},
+			{S3Bucket: aws.String("Triton_Shim")},
+			{S3Bucket: aws.String("triton-shim-test"), S3Prefix: aws.String("../../etc")},
+			{S3Bucket: aws.String("triton-shim-test"), S3Prefix: aws.String("exports/../../..")},
+		} {
+			_, err := ec2Svc.ExportImage(&ec2.ExportImageInput{
+				ImageId:          aws.String("ami-00000000"),
+				DiskImageFormat:  aws.String(ec2.DiskImageFormatRaw),
+				S3ExportLocation: location,
+			})
+			if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "InvalidParameterValue" {
+				t.Errorf("export location %v should be rejected, got %v", location, err)
+			}
+		}
+	})
+}
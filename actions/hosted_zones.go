@@ -0,0 +1,419 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Route 53 hosted zones are the CNS zones of the account (see cns.go). Their
+// records are the CNS instance and service names, as A records. Only the
+// service records can be changed, which is done editing the
+// triton.cns.services tag of the instances owning the record IPs.
+
+const hostedZonePrefix = "/hostedzone/"
+
+// hostedZoneID returns the Route 53 ID of a CNS zone, derived from its name
+func hostedZoneID(zone string) string {
+	sum := sha1.Sum([]byte(zone))
+	return "Z" + strings.ToUpper(hex.EncodeToString(sum[:]))[:20]
+}
+
+// maxItems returns the value of the maxitems query parameter, or the given
+// default when it is not set or invalid
+func maxItems(c *gin.Context, defaultValue int) int {
+	value, err := strconv.Atoi(c.Query("maxitems"))
+	if err != nil || value < 1 {
+		return defaultValue
+	}
+	return value
+}
+
+// loadCNSZones lists the instances of the account and the CNS zones built
+// from them
+func loadCNSZones(c *gin.Context, client *tritoncompute.ComputeClient) ([]*tritoncompute.Instance, []*cnsZone, error) {
+	vms, err := listInstances(client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	network, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to create triton network client: %w", err)
+	}
+
+	publicNetworks, err := listPublicNetworks(network)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return vms, listCNSZones(vms, publicNetworks), nil
+}
+
+// findHostedZone returns the zone identified by the Id path parameter. When
+// it does not exist the request is aborted, and nil is returned.
+func findHostedZone(c *gin.Context, zones []*cnsZone) *cnsZone {
+	id := strings.TrimPrefix(c.Param("Id"), hostedZonePrefix)
+	for _, zone := range zones {
+		if hostedZoneID(zone.Name) == id {
+			return zone
+		}
+	}
+	abortWithRestXMLError(c, http.StatusNotFound, route53.ErrCodeNoSuchHostedZone,
+		fmt.Sprintf("No hosted zone found with ID: %s", id))
+	return nil
+}
+
+// zoneToRoute53 converts a CNS zone to a Route 53 hosted zone
+func zoneToRoute53(zone *cnsZone) *route53.HostedZone {
+	return &route53.HostedZone{
+		Id:              aws.String(hostedZonePrefix + hostedZoneID(zone.Name)),
+		Name:            aws.String(zone.Name + "."),
+		CallerReference: aws.String(zone.Name),
+		Config: &route53.HostedZoneConfig{
+			Comment:     aws.String("Triton CNS"),
+			PrivateZone: aws.Bool(cnsPrivateZone(zone.Name)),
+		},
+		ResourceRecordSetCount: aws.Int64(int64(len(zone.Records))),
+	}
+}
+
+// ListHostedZones lists the CNS zones of the account into the region
+func ListHostedZones(c *gin.Context) {
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	_, zones, err := loadCNSZones(c, client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	marker := c.Query("marker")
+	limit := maxItems(c, 100)
+	output := route53.ListHostedZonesOutput{
+		HostedZones: []*route53.HostedZone{},
+		IsTruncated: aws.Bool(false),
+		MaxItems:    aws.String(strconv.Itoa(limit)),
+	}
+	if marker != "" {
+		output.Marker = aws.String(marker)
+	}
+
+	started := marker == ""
+	for _, zone := range zones {
+		id := hostedZoneID(zone.Name)
+		if !started {
+			started = id == marker
+			if !started {
+				continue
+			}
+		}
+		if len(output.HostedZones) == limit {
+			output.IsTruncated = aws.Bool(true)
+			output.NextMarker = aws.String(id)
+			break
+		}
+		output.HostedZones = append(output.HostedZones, zoneToRoute53(zone))
+	}
+
+	c.Header("x-amzn-RequestId", requestID(c))
+	writeXMLResponse(c, "ListHostedZones", route53Namespace, output)
+}
+
+// ListResourceRecordSets lists the CNS names of a zone as A records
+func ListResourceRecordSets(c *gin.Context) {
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	_, zones, err := loadCNSZones(c, client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	zone := findHostedZone(c, zones)
+	if zone == nil {
+		return
+	}
+
+	startName := strings.TrimSuffix(strings.ToLower(c.Query("name")), ".")
+	startType := c.Query("type")
+	if startType != "" && startName == "" {
+		abortWithRestXMLError(c, http.StatusBadRequest, route53.ErrCodeInvalidInput,
+			"The input is not valid: type requires name")
+		return
+	}
+
+	limit := maxItems(c, 300)
+	output := route53.ListResourceRecordSetsOutput{
+		ResourceRecordSets: []*route53.ResourceRecordSet{},
+		IsTruncated:        aws.Bool(false),
+		MaxItems:           aws.String(strconv.Itoa(limit)),
+	}
+
+	for _, name := range zone.recordNames() {
+		// All the records are A records, so any other type sorts after them
+		if name < startName || (name == startName && startType > route53.RRTypeA) {
+			continue
+		}
+		if len(output.ResourceRecordSets) == limit {
+			output.IsTruncated = aws.Bool(true)
+			output.NextRecordName = aws.String(name + ".")
+			output.NextRecordType = aws.String(route53.RRTypeA)
+			break
+		}
+		rrset := &route53.ResourceRecordSet{
+			Name: aws.String(name + "."),
+			Type: aws.String(route53.RRTypeA),
+			TTL:  aws.Int64(cnsTTL),
+		}
+		for _, ip := range zone.Records[name] {
+			rrset.ResourceRecords = append(rrset.ResourceRecords,
+				&route53.ResourceRecord{Value: aws.String(ip)})
+		}
+		output.ResourceRecordSets = append(output.ResourceRecordSets, rrset)
+	}
+
+	c.Header("x-amzn-RequestId", requestID(c))
+	writeXMLResponse(c, "ListResourceRecordSets", route53Namespace, output)
+}
+
+// changeBatchRequest is the body of ChangeResourceRecordSets requests
+type changeBatchRequest struct {
+	Changes []struct {
+		Action string   `xml:"Action"`
+		Name   string   `xml:"ResourceRecordSet>Name"`
+		Type   string   `xml:"ResourceRecordSet>Type"`
+		Values []string `xml:"ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+	} `xml:"ChangeBatch>Changes>Change"`
+}
+
+// instanceServices returns the entries of the triton.cns.services tag of
+// every instance
+func instanceServices(vms []*tritoncompute.Instance) map[string][]string {
+	services := make(map[string][]string)
+	for _, vm := range vms {
+		services[vm.ID] = append([]string{}, vm.CNS.Services...)
+	}
+	return services
+}
+
+// removeService removes a service from the tag entries
+func removeService(entries []string, service string) []string {
+	var result []string
+	for _, entry := range entries {
+		if cnsServiceName(entry) != service {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// hasService tells if the tag entries include the service
+func hasService(entries []string, service string) bool {
+	return len(removeService(entries, service)) != len(entries)
+}
+
+// applyChanges validates the requested changes and applies them to the
+// service entries of the instances. It returns the errors found, if any.
+func applyChanges(zone *cnsZone, vms []*tritoncompute.Instance, batch *changeBatchRequest,
+	services map[string][]string) []string {
+
+	byIP := make(map[string]string)
+	for _, vm := range vms {
+		if vm.State != "running" {
+			continue
+		}
+		for _, ip := range vm.IPs {
+			byIP[ip] = vm.ID
+		}
+	}
+
+	var messages []string
+	for _, change := range batch.Changes {
+		name := strings.TrimSuffix(strings.ToLower(change.Name), ".")
+		service, kind, zoneName, ok := cnsName(name)
+		if !ok || kind != cnsServiceKind || zoneName != zone.Name || !cnsLabelRe.MatchString(service) {
+			messages = append(messages, fmt.Sprintf(
+				"%s is not a CNS service name (<service>.svc.%s)", change.Name, zone.Name))
+			continue
+		}
+		if change.Type != route53.RRTypeA {
+			messages = append(messages, fmt.Sprintf(
+				"Only A records can be changed, not %s records", change.Type))
+			continue
+		}
+
+		var members []string
+		for id, entries := range services {
+			if hasService(entries, service) {
+				members = append(members, id)
+			}
+		}
+
+		var wanted []string
+		for _, ip := range change.Values {
+			id, found := byIP[ip]
+			if !found {
+				messages = append(messages, fmt.Sprintf(
+					"%s is not the IP address of any running instance", ip))
+				continue
+			}
+			if !containsString(wanted, id) {
+				wanted = append(wanted, id)
+			}
+		}
+
+		switch change.Action {
+		case route53.ChangeActionCreate:
+			if len(members) > 0 {
+				messages = append(messages, fmt.Sprintf(
+					"Tried to create resource record set [name='%s', type='A'] but it already exists",
+					name+"."))
+				continue
+			}
+		case route53.ChangeActionDelete:
+			if len(members) == 0 {
+				messages = append(messages, fmt.Sprintf(
+					"Tried to delete resource record set [name='%s', type='A'] but it was not found",
+					name+"."))
+				continue
+			}
+			wanted = nil
+		case route53.ChangeActionUpsert:
+		default:
+			messages = append(messages, fmt.Sprintf("Invalid change action %s", change.Action))
+			continue
+		}
+
+		for _, id := range members {
+			if !containsString(wanted, id) {
+				services[id] = removeService(services[id], service)
+			}
+		}
+		for _, id := range wanted {
+			if !hasService(services[id], service) {
+				services[id] = append(services[id], service)
+			}
+		}
+	}
+
+	return messages
+}
+
+// ChangeResourceRecordSets creates, updates and deletes CNS service records,
+// adding and removing the services from the triton.cns.services tag of the
+// instances owning the record IPs
+func ChangeResourceRecordSets(c *gin.Context) {
+	var batch changeBatchRequest
+	if err := xml.NewDecoder(c.Request.Body).Decode(&batch); err != nil {
+		abortWithRestXMLError(c, http.StatusBadRequest, route53.ErrCodeInvalidInput,
+			fmt.Sprintf("Unable to decode the change batch: %v", err))
+		return
+	}
+	if len(batch.Changes) == 0 {
+		abortWithRestXMLError(c, http.StatusBadRequest, route53.ErrCodeInvalidInput,
+			"The change batch must contain at least one change")
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	vms, zones, err := loadCNSZones(c, client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	zone := findHostedZone(c, zones)
+	if zone == nil {
+		return
+	}
+
+	current := instanceServices(vms)
+	services := instanceServices(vms)
+	if messages := applyChanges(zone, vms, &batch, services); len(messages) > 0 {
+		abortWithRestXMLError(c, http.StatusBadRequest, route53.ErrCodeInvalidChangeBatch,
+			strings.Join(messages, "; "))
+		return
+	}
+
+	ids := make([]string, 0, len(services))
+	for id := range services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		tag := strings.Join(services[id], ",")
+		if tag == strings.Join(current[id], ",") {
+			continue
+		}
+		if tag == "" {
+			err = client.Instances().DeleteTag(context.Background(), &tritoncompute.DeleteTagInput{
+				ID:  id,
+				Key: tritoncompute.CNSTagServices,
+			})
+		} else {
+			err = client.Instances().AddTags(context.Background(), &tritoncompute.AddTagsInput{
+				ID:   id,
+				Tags: map[string]interface{}{tritoncompute.CNSTagServices: tag},
+			})
+		}
+		if err != nil {
+			log.Printf("[ERROR] update vm %s cns services error: %v\n", id, err)
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to update triton instance CNS services: %w", err))
+			return
+		}
+	}
+
+	changeID := strings.ToUpper(strings.TrimPrefix(newResourceID("c"), "c-"))
+	output := route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &route53.ChangeInfo{
+			Id:          aws.String("/change/C" + changeID),
+			Status:      aws.String(route53.ChangeStatusInsync),
+			SubmittedAt: aws.Time(time.Now().UTC()),
+		},
+	}
+
+	c.Header("x-amzn-RequestId", requestID(c))
+	writeXMLResponse(c, "ChangeResourceRecordSets", route53Namespace, output)
+}
@@ -0,0 +1,42 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSListHostedZones(t *testing.T) {
+	test.GetRoute53Svc(t, func(route53Svc *route53.Route53) {
+		result, err := route53Svc.ListHostedZones(nil)
+		if err != nil {
+			t.Errorf("list hosted zones error %v", err)
+			return
+		}
+
+		for _, zone := range result.HostedZones {
+			records, err := route53Svc.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+				HostedZoneId: zone.Id,
+			})
+			if err != nil {
+				t.Errorf("list resource record sets error %v", err)
+				return
+			}
+			for _, rrset := range records.ResourceRecordSets {
+				if *rrset.Type != route53.RRTypeA || len(rrset.ResourceRecords) == 0 {
+					t.Errorf("unexpected resource record set %v", rrset)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,33 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// newResourceID generates an EC2 like ID for the resources which only exist
+// into the shim, like "export-ami-0123456789abcdef0" for prefix "export-ami"
+func newResourceID(prefix string) string {
+	hex := strings.Replace(uuid.New().String(), "-", "", -1)
+	return prefix + "-" + hex[:17]
+}
+
+// accountRegion is the region of the records about account-wide Triton
+// objects, like SSH keys, which are the same in every datacenter
+const accountRegion = ""
+
+// ownedKey is the store key of a record identified by an ID which is only
+// unique per account and datacenter, like the IDs derived from Triton fabric
+// VLANs
+func ownedKey(region string, owner string, id string) string {
+	return region + "/" + owner + "/" + id
+}
@@ -0,0 +1,344 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// EC2 Instance Connect pushes short-lived SSH keys to instances. The shim
+// adds them to the root_authorized_keys metadata of the instance, which the
+// instance keeps in sync with its authorized keys, and a background worker
+// removes them once they expire. Pushed keys are recorded into the shim
+// store, so keys pushed before a restart still expire.
+
+// instanceConnectKeysCollection is the store collection for the pushed keys
+// waiting to expire
+const instanceConnectKeysCollection = "instance-connect-keys"
+
+// instanceConnectKeyTTL is how long pushed keys stay authorized, like EC2
+// Instance Connect ones
+const instanceConnectKeyTTL = 60 * time.Second
+
+// instanceConnectInterval is how often the worker looks for expired keys
+const instanceConnectInterval = 5 * time.Second
+
+var (
+	instanceConnectWorkerOnce sync.Once
+
+	// authorizedKeysMu serializes the updates of the instances authorized
+	// keys, which are read, changed and written back
+	authorizedKeysMu sync.Mutex
+)
+
+// instanceConnectKey is the shim record of a pushed key
+type instanceConnectKey struct {
+	Region     string    `json:"region"`
+	Owner      string    `json:"owner"`
+	Account    string    `json:"account"`
+	InstanceID string    `json:"instance_id"`
+	Key        string    `json:"key"`
+	Added      bool      `json:"added"`
+	Expires    time.Time `json:"expires"`
+}
+
+// sendSSHPublicKeyInput is the SendSSHPublicKey request
+type sendSSHPublicKeyInput struct {
+	InstanceID       string `json:"InstanceId"`
+	InstanceOSUser   string `json:"InstanceOSUser"`
+	SSHPublicKey     string `json:"SSHPublicKey"`
+	AvailabilityZone string `json:"AvailabilityZone"`
+}
+
+// sendSSHPublicKeyOutput is the SendSSHPublicKey response
+type sendSSHPublicKeyOutput struct {
+	RequestID string `json:"RequestId"`
+	Success   bool   `json:"Success"`
+}
+
+// instanceConnectKeyID is the store key of a key pushed to an instance
+func instanceConnectKeyID(instanceID string, pub ssh.PublicKey) string {
+	sum := sha256.Sum256(pub.Marshal())
+	return instanceID + "/" + hex.EncodeToString(sum[:])
+}
+
+// authorizedKeysContain tells if the authorized keys include the key
+func authorizedKeysContain(authorizedKeys string, pub ssh.PublicKey) bool {
+	for _, line := range strings.Split(authorizedKeys, "\n") {
+		other, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && bytes.Equal(other.Marshal(), pub.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeAuthorizedKey returns the authorized keys without the key
+func removeAuthorizedKey(authorizedKeys string, pub ssh.PublicKey) string {
+	var lines []string
+	for _, line := range strings.Split(authorizedKeys, "\n") {
+		other, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && bytes.Equal(other.Marshal(), pub.Marshal()) {
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// instanceAuthorizedKeys returns the root_authorized_keys metadata of the
+// instance
+func instanceAuthorizedKeys(vm *tritoncompute.Instance) string {
+	value, _ := vm.Metadata[authorizedKeysMetadataKey].(string)
+	return value
+}
+
+// saveAuthorizedKeys replaces the root_authorized_keys metadata of the
+// instance
+func saveAuthorizedKeys(client *tritoncompute.ComputeClient, id string, authorizedKeys string) error {
+	_, err := client.Instances().UpdateMetadata(context.Background(), &tritoncompute.UpdateMetadataInput{
+		ID:       id,
+		Metadata: map[string]interface{}{authorizedKeysMetadataKey: authorizedKeys},
+	})
+	return err
+}
+
+// expireInstanceConnectKey removes an expired key from its instance
+// authorized keys. Keys which were already authorized when they were pushed
+// are left alone.
+func expireInstanceConnectKey(record *instanceConnectKey) error {
+	if !record.Added {
+		return nil
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(record.Key))
+	if err != nil {
+		return nil
+	}
+
+	// The worker acts as the account which pushed the key
+	principal := &tritonutils.Principal{Account: record.Account}
+	client, err := tritonutils.GetTritonComputeClient(record.Region, principal)
+	if err != nil {
+		return fmt.Errorf("Unable to create triton compute client: %w", err)
+	}
+
+	authorizedKeysMu.Lock()
+	defer authorizedKeysMu.Unlock()
+
+	vm, err := client.Instances().Get(context.Background(), &tritoncompute.GetInstanceInput{
+		ID: record.InstanceID,
+	})
+	if err != nil {
+		// Instances gone have nothing left to remove
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) ||
+			tritonerrors.IsSpecificStatusCode(err, http.StatusGone) {
+			return nil
+		}
+		return fmt.Errorf("Unable to get triton compute instance: %w", err)
+	}
+
+	authorizedKeys := instanceAuthorizedKeys(vm)
+	if !authorizedKeysContain(authorizedKeys, pub) {
+		return nil
+	}
+	return saveAuthorizedKeys(client, vm.ID, removeAuthorizedKey(authorizedKeys, pub))
+}
+
+// expireInstanceConnectKeys removes the keys expired at the given time. Keys
+// which cannot be removed are retried on the next run.
+func expireInstanceConnectKeys(db *store.Store, now time.Time) {
+	for _, id := range db.Keys(instanceConnectKeysCollection) {
+		var record instanceConnectKey
+		if err := db.Get(instanceConnectKeysCollection, id, &record); err != nil {
+			continue
+		}
+		if record.Expires.After(now) {
+			continue
+		}
+		if err := expireInstanceConnectKey(&record); err != nil {
+			log.Printf("[ERROR] expire vm %s pushed key error: %v\n", record.InstanceID, err)
+			continue
+		}
+		if err := db.Delete(instanceConnectKeysCollection, id); err != nil {
+			log.Printf("[ERROR] delete vm %s pushed key record error: %v\n", record.InstanceID, err)
+			continue
+		}
+		log.Printf("[DEBUG] expired key pushed to vm %s\n", record.InstanceID)
+	}
+}
+
+// StartInstanceConnectWorker starts the background worker expiring the keys
+// pushed by SendSSHPublicKey, unless it is already running
+func StartInstanceConnectWorker() {
+	instanceConnectWorkerOnce.Do(func() {
+		db, err := store.Default()
+		if err != nil {
+			log.Printf("[ERROR] open shim store error: %v\n", err)
+			return
+		}
+
+		go func() {
+			for range time.Tick(instanceConnectInterval) {
+				expireInstanceConnectKeys(db, time.Now())
+			}
+		}()
+	})
+}
+
+// SendSSHPublicKey authorizes an SSH key into an instance for 60 seconds.
+// Triton instances only have root authorized keys, which images may also
+// install for their default user, so InstanceOSUser is ignored.
+func SendSSHPublicKey(c *gin.Context) {
+	var input sendSSHPublicKeyInput
+	if err := json.NewDecoder(c.Request.Body).Decode(&input); err != nil {
+		abortWithJSONError(c, http.StatusBadRequest, "SerializationException",
+			"The request body is not valid JSON")
+		return
+	}
+	required := []struct{ name, value string }{
+		{"InstanceId", input.InstanceID},
+		{"InstanceOSUser", input.InstanceOSUser},
+		{"SSHPublicKey", input.SSHPublicKey},
+	}
+	for _, p := range required {
+		if p.value == "" {
+			abortWithJSONError(c, http.StatusBadRequest, "InvalidArgsException",
+				fmt.Sprintf("The request must contain the parameter %s", p.name))
+			return
+		}
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(input.SSHPublicKey))
+	if err != nil || publicKeyType(pub) == "" {
+		abortWithJSONError(c, http.StatusBadRequest, "InvalidArgsException",
+			"The SSHPublicKey is not a valid RSA or ED25519 OpenSSH public key")
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	StartInstanceConnectWorker()
+
+	authorizedKeysMu.Lock()
+	defer authorizedKeysMu.Unlock()
+
+	vm, err := client.Instances().Get(context.Background(), &tritoncompute.GetInstanceInput{
+		ID: input.InstanceID,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithJSONError(c, http.StatusBadRequest, "EC2InstanceNotFoundException",
+				fmt.Sprintf("Instance %s not found", input.InstanceID))
+			return
+		}
+		log.Printf("[ERROR] get vm error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to get triton compute instance: %w", err))
+		return
+	}
+	if vm.State != "running" {
+		abortWithJSONError(c, http.StatusBadRequest, "EC2InstanceStateInvalidException",
+			fmt.Sprintf("Instance %s is not running", vm.ID))
+		return
+	}
+
+	id := instanceConnectKeyID(vm.ID, pub)
+	record := instanceConnectKey{}
+	err = db.Get(instanceConnectKeysCollection, id, &record)
+	if err != nil && err != store.ErrNotFound {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to load pushed key: %w", err))
+		return
+	}
+
+	// Pushing a key again only extends its expiration
+	pushed := err == store.ErrNotFound
+	authorizedKeys := instanceAuthorizedKeys(vm)
+	if pushed {
+		record = instanceConnectKey{
+			Region:     regionName(c),
+			Owner:      account.ID,
+			Account:    account.Login,
+			InstanceID: vm.ID,
+			Key:        strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+			Added:      !authorizedKeysContain(authorizedKeys, pub),
+		}
+	}
+	record.Expires = time.Now().Add(instanceConnectKeyTTL)
+
+	// The record is saved before the key is authorized, so the worker always
+	// knows when to remove it
+	if err := db.Put(instanceConnectKeysCollection, id, record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save pushed key: %w", err))
+		return
+	}
+
+	if pushed && record.Added {
+		if authorizedKeys != "" && !strings.HasSuffix(authorizedKeys, "\n") {
+			authorizedKeys += "\n"
+		}
+		err := saveAuthorizedKeys(client, vm.ID, authorizedKeys+record.Key)
+		if err != nil {
+			log.Printf("[ERROR] update vm metadata error: %v\n", err)
+			if err := db.Delete(instanceConnectKeysCollection, id); err != nil {
+				log.Printf("[ERROR] delete pushed key error: %v\n", err)
+			}
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to update triton compute instance metadata: %w", err))
+			return
+		}
+	}
+
+	log.Printf("[DEBUG] pushed key to vm %s until %s\n", vm.ID, record.Expires.Format(time.RFC3339))
+
+	writeJSONResponse(c, sendSSHPublicKeyOutput{
+		RequestID: requestID(c),
+		Success:   true,
+	})
+}
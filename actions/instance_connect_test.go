@@ -0,0 +1,78 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSSendSSHPublicKey(t *testing.T) {
+	var instanceID *string
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		instances, err := ec2Svc.DescribeInstances(nil)
+		if err != nil {
+			t.Errorf("describe instances error %v", err)
+			return
+		}
+		for _, res := range instances.Reservations {
+			for _, inst := range res.Instances {
+				if *inst.State.Name == ec2.InstanceStateNameRunning {
+					instanceID = inst.InstanceId
+				}
+			}
+		}
+	})
+	if instanceID == nil {
+		t.Skip("no running instance to push a key to")
+	}
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Errorf("generate key error %v", err)
+		return
+	}
+	pub, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Errorf("ssh public key error %v", err)
+		return
+	}
+
+	test.GetEC2InstanceConnectSvc(t, func(connectSvc *ec2instanceconnect.EC2InstanceConnect) {
+		_, err := connectSvc.SendSSHPublicKey(&ec2instanceconnect.SendSSHPublicKeyInput{
+			InstanceId:       aws.String("00000000-0000-0000-0000-000000000000"),
+			InstanceOSUser:   aws.String("root"),
+			SSHPublicKey:     aws.String(string(ssh.MarshalAuthorizedKey(pub))),
+			AvailabilityZone: aws.String("unused"),
+		})
+		if err == nil {
+			t.Errorf("send ssh public key should fail for unknown instances")
+		}
+
+		result, err := connectSvc.SendSSHPublicKey(&ec2instanceconnect.SendSSHPublicKeyInput{
+			InstanceId:       instanceID,
+			InstanceOSUser:   aws.String("root"),
+			SSHPublicKey:     aws.String(string(ssh.MarshalAuthorizedKey(pub))),
+			AvailabilityZone: aws.String("unused"),
+		})
+		if err != nil {
+			t.Errorf("send ssh public key error %v", err)
+		} else if !*result.Success {
+			t.Errorf("send ssh public key did not succeed")
+		}
+	})
+}
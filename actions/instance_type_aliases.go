@@ -0,0 +1,271 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	"github.com/joyent/triton-shim/api"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Tools written for EC2 usually hard-code AWS instance type names, like
+// "t3.small" or "m5.large". The shim can advertise AWS-style aliases for the
+// Triton packages, so these names can be used wherever an instance type is
+// expected. Aliases come from the JSON file given by the environment variable
+// TRITON_SHIM_INSTANCE_TYPES_FILE, with the format:
+//
+//    {
+//        "heuristic": true,
+//        "aliases": {
+//            "t3.small": "g4-highcpu-2G",
+//            "m5.large": "b2b5ba5a-8a1b-4f31-a02a-ea5ba6d20a3e"
+//        }
+//    }
+//
+// Aliases point to package names or UUIDs. When "heuristic" is true (the
+// default, also used when there is no file) every well known AWS instance
+// type not explicitly configured is aliased to the smallest active package
+// having at least its vCPUs and memory, but not more than twice its memory.
+
+// ErrUnknownInstanceType The instance type is not a package nor an alias
+var ErrUnknownInstanceType = errors.New("unknown instance type")
+
+// instanceTypeMetadataKey is the instance metadata key with the alias the
+// instance was launched or resized with, since Triton only knows its package
+const instanceTypeMetadataKey = "instance-type"
+
+// instanceTypesConfig is the contents of TRITON_SHIM_INSTANCE_TYPES_FILE
+type instanceTypesConfig struct {
+	Heuristic *bool             `json:"heuristic"`
+	Aliases   map[string]string `json:"aliases"`
+}
+
+// awsInstanceType is the size of an AWS instance type
+type awsInstanceType struct {
+	Name      string
+	VCPUs     int64
+	MemoryMiB int64
+}
+
+// awsInstanceTypes are the AWS instance types aliased by the heuristic
+var awsInstanceTypes = []awsInstanceType{
+	{"t3.nano", 2, 512},
+	{"t3.micro", 2, 1024},
+	{"t3.small", 2, 2048},
+	{"t3.medium", 2, 4096},
+	{"t3.large", 2, 8192},
+	{"t3.xlarge", 4, 16384},
+	{"t3.2xlarge", 8, 32768},
+	{"c5.large", 2, 4096},
+	{"c5.xlarge", 4, 8192},
+	{"c5.2xlarge", 8, 16384},
+	{"c5.4xlarge", 16, 32768},
+	{"c5.9xlarge", 36, 73728},
+	{"m5.large", 2, 8192},
+	{"m5.xlarge", 4, 16384},
+	{"m5.2xlarge", 8, 32768},
+	{"m5.4xlarge", 16, 65536},
+	{"m5.8xlarge", 32, 131072},
+	{"m5.12xlarge", 48, 196608},
+	{"r5.large", 2, 16384},
+	{"r5.xlarge", 4, 32768},
+	{"r5.2xlarge", 8, 65536},
+	{"r5.4xlarge", 16, 131072},
+	{"r5.8xlarge", 32, 262144},
+}
+
+// loadInstanceTypesConfig reads TRITON_SHIM_INSTANCE_TYPES_FILE, if any
+func loadInstanceTypesConfig() (*instanceTypesConfig, error) {
+	config := &instanceTypesConfig{}
+
+	configPath := os.Getenv("TRITON_SHIM_INSTANCE_TYPES_FILE")
+	if configPath != "" {
+		content, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read instance types file: %w", err)
+		}
+		if err := json.Unmarshal(content, config); err != nil {
+			return nil, fmt.Errorf("Unable to decode instance types file: %w", err)
+		}
+	}
+
+	if config.Heuristic == nil {
+		heuristic := true
+		config.Heuristic = &heuristic
+	}
+
+	return config, nil
+}
+
+// compareVersions compares dot separated package versions numerically,
+// returning a negative number when a < b, zero when equal and a positive
+// number when a > b
+func compareVersions(a string, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aNum, bNum int
+		if i < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[i])
+		}
+		if aNum != bNum {
+			return aNum - bNum
+		}
+	}
+	return 0
+}
+
+// findPackage returns the active package with the given UUID or, for names,
+// the latest version of the active packages with that name
+func findPackage(packages []*api.Package, nameOrUUID string) *api.Package {
+	var found *api.Package
+	for _, pkg := range packages {
+		if !pkg.Active {
+			continue
+		}
+		if pkg.UUID == nameOrUUID {
+			return pkg
+		}
+		if pkg.Name != nameOrUUID {
+			continue
+		}
+		if found == nil || compareVersions(pkg.Version, found.Version) > 0 {
+			found = pkg
+		}
+	}
+	return found
+}
+
+// heuristicPackage returns the smallest active package fitting the given
+// AWS instance type, if any
+func heuristicPackage(packages []*api.Package, awsType awsInstanceType) *api.Package {
+	var candidates []*api.Package
+	for _, pkg := range packages {
+		if !pkg.Active {
+			continue
+		}
+		if packageVCPUs(pkg) < awsType.VCPUs ||
+			pkg.Memory < awsType.MemoryMiB ||
+			pkg.Memory > 2*awsType.MemoryMiB {
+			continue
+		}
+		candidates = append(candidates, pkg)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Memory != b.Memory {
+			return a.Memory < b.Memory
+		}
+		if packageVCPUs(a) != packageVCPUs(b) {
+			return packageVCPUs(a) < packageVCPUs(b)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return compareVersions(a.Version, b.Version) > 0
+	})
+
+	return candidates[0]
+}
+
+// instanceTypeAliases maps every alias to its package
+func instanceTypeAliases(packages []*api.Package, config *instanceTypesConfig) map[string]*api.Package {
+	aliases := make(map[string]*api.Package)
+
+	for alias, target := range config.Aliases {
+		if pkg := findPackage(packages, target); pkg != nil {
+			aliases[alias] = pkg
+		}
+	}
+
+	if !*config.Heuristic {
+		return aliases
+	}
+
+	for _, awsType := range awsInstanceTypes {
+		if _, configured := config.Aliases[awsType.Name]; configured {
+			continue
+		}
+		// Actual package names always win over heuristic aliases
+		if findPackage(packages, awsType.Name) != nil {
+			continue
+		}
+		if pkg := heuristicPackage(packages, awsType); pkg != nil {
+			aliases[awsType.Name] = pkg
+		}
+	}
+
+	return aliases
+}
+
+// resolveInstanceType returns the package for the given instance type, which
+// can be a package name, a package UUID or one of the aliases
+func resolveInstanceType(region string, principal *tritonutils.Principal, instanceType string) (*api.Package, error) {
+	config, err := loadInstanceTypesConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	packages, err := listPackages(region, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Explicitly configured aliases take precedence over package names
+	if target, found := config.Aliases[instanceType]; found {
+		if pkg := findPackage(packages, target); pkg != nil {
+			return pkg, nil
+		}
+	}
+
+	if pkg := findPackage(packages, instanceType); pkg != nil {
+		return pkg, nil
+	}
+
+	if pkg, found := instanceTypeAliases(packages, config)[instanceType]; found {
+		return pkg, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownInstanceType, instanceType)
+}
+
+// instanceTypeAlias returns the alias used for the given instance type, or
+// an empty string when it is the package name or UUID itself
+func instanceTypeAlias(pkg *api.Package, instanceType string) string {
+	if instanceType == pkg.Name || instanceType == pkg.UUID {
+		return ""
+	}
+	return instanceType
+}
+
+// instanceTypeName returns the instance type of a vm: the alias it was
+// launched or resized with, if any, or its package name
+func instanceTypeName(vm *tritoncompute.Instance) string {
+	if alias, ok := vm.Metadata[instanceTypeMetadataKey].(string); ok && alias != "" {
+		return alias
+	}
+	return vm.Package
+}
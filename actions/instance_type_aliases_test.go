@@ -0,0 +1,66 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSInstanceTypeAliases(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		result, err := ec2Svc.DescribeInstanceTypes(nil)
+		if err != nil {
+			t.Errorf("describe instance types error %v", err)
+			return
+		}
+		if len(result.InstanceTypes) == 0 {
+			t.Errorf("describe instance types did not return any results")
+			return
+		}
+		pkgName := *result.InstanceTypes[0].InstanceType
+
+		configFile, err := ioutil.TempFile("", "triton-shim-instance-types")
+		if err != nil {
+			t.Errorf("unable to create instance types file %v", err)
+			return
+		}
+		defer os.Remove(configFile.Name())
+
+		fmt.Fprintf(configFile, `{"heuristic": false, "aliases": {"shim.test": "%s"}}`, pkgName)
+		configFile.Close()
+
+		os.Setenv("TRITON_SHIM_INSTANCE_TYPES_FILE", configFile.Name())
+		defer os.Unsetenv("TRITON_SHIM_INSTANCE_TYPES_FILE")
+
+		aliased, err := ec2Svc.DescribeInstanceTypes(&ec2.DescribeInstanceTypesInput{
+			InstanceTypes: aws.StringSlice([]string{"shim.test"}),
+		})
+		if err != nil {
+			t.Errorf("describe instance types error %v", err)
+			return
+		}
+
+		if len(aliased.InstanceTypes) != 1 {
+			t.Errorf("describe instance types should return the alias, got %d results",
+				len(aliased.InstanceTypes))
+			return
+		}
+		if *aliased.InstanceTypes[0].MemoryInfo.SizeInMiB != *result.InstanceTypes[0].MemoryInfo.SizeInMiB {
+			t.Errorf("instance type alias memory does not match package memory")
+		}
+	})
+}
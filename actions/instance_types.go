@@ -0,0 +1,190 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	"github.com/joyent/triton-shim/api"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Triton packages are the equivalent of EC2 instance types. PAPI has the
+// complete package definitions, including inactive packages and CPU caps,
+// so we use it when available. Otherwise, CloudAPI packages are converted
+// into the same api.Package type, with the fields CloudAPI doesn't provide
+// left empty.
+
+// Hardware virtualization brands, everything else is an OS zone
+var hvmBrands = map[string]bool{
+	"bhyve": true,
+	"kvm":   true,
+}
+
+// cloudapiToPackage converts a CloudAPI package into an api.Package. CloudAPI
+// only lists active packages.
+func cloudapiToPackage(pkg *tritoncompute.Package) *api.Package {
+	disks := make([]api.PackageDisk, 0, len(pkg.Disks))
+	for _, disk := range pkg.Disks {
+		disks = append(disks, api.PackageDisk{
+			Size:       disk.Size,
+			SizeInMiB:  disk.SizeInMiB,
+			Remaining:  disk.Remaining,
+			OSDiskSize: disk.OSDiskSize,
+		})
+	}
+
+	return &api.Package{
+		UUID:         pkg.ID,
+		Name:         pkg.Name,
+		Memory:       pkg.Memory,
+		Disk:         pkg.Disk,
+		Swap:         pkg.Swap,
+		LWPs:         pkg.LWPs,
+		VCPUs:        pkg.VCPUs,
+		Version:      pkg.Version,
+		Group:        pkg.Group,
+		Description:  pkg.Description,
+		Default:      pkg.Default,
+		Active:       true,
+		Brand:        pkg.Brand,
+		FlexibleDisk: pkg.FlexibleDisk,
+		Disks:        disks,
+	}
+}
+
+// listPackages retrieves the packages from PAPI when PAPI_URL is set, or
+// from CloudAPI otherwise. PAPI lists the packages of every account, so only
+// those available to the principal account are kept, like CloudAPI does.
+func listPackages(region string, principal *tritonutils.Principal) ([]*api.Package, error) {
+	papi, err := tritonutils.GetPapiClient(region)
+	if err == nil {
+		allPackages, err := papi.ListPackages(context.Background(), &api.ListPackagesInput{})
+		if err != nil {
+			log.Printf("[ERROR] list PAPI packages error: %v\n", err)
+			return nil, fmt.Errorf("Unable to list triton packages: %w", err)
+		}
+
+		var accountID string
+		if principal != nil {
+			accountID = principal.AccountID
+		}
+		packages := make([]*api.Package, 0, len(allPackages))
+		for _, pkg := range allPackages {
+			if pkg.AvailableTo(accountID) {
+				packages = append(packages, pkg)
+			}
+		}
+		return packages, nil
+	}
+	if !errors.Is(err, api.ErrMissingURL) {
+		return nil, fmt.Errorf("Unable to create PAPI client: %w", err)
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(region, principal)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create triton compute client: %w", err)
+	}
+
+	packageListInput := &tritoncompute.ListPackagesInput{}
+
+	cloudapiPackages, err := client.Packages().List(context.Background(), packageListInput)
+	if err != nil {
+		log.Printf("[ERROR] list packages error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton compute packages: %w", err)
+	}
+
+	packages := make([]*api.Package, 0, len(cloudapiPackages))
+	for _, pkg := range cloudapiPackages {
+		packages = append(packages, cloudapiToPackage(pkg))
+	}
+	return packages, nil
+}
+
+// packageVCPUs gives the number of vCPUs of a package. Hardware VMs have
+// vcpus; for zones we take the CPU cap, where 100 means one full CPU.
+func packageVCPUs(pkg *api.Package) int64 {
+	if pkg.VCPUs > 0 {
+		return pkg.VCPUs
+	}
+	if pkg.CPUCap > 0 {
+		return (pkg.CPUCap + 99) / 100
+	}
+	return 1
+}
+
+// packageBurstable tells if instances using the package can use more CPU
+// than their fair share: either they have no CPU cap or their cap is above
+// the FSS share. Both values use 100 per CPU units. Without FSS (CloudAPI
+// packages) we cannot tell.
+func packageBurstable(pkg *api.Package) bool {
+	if pkg.FSS == 0 {
+		return false
+	}
+	return pkg.CPUCap == 0 || pkg.CPUCap > pkg.FSS
+}
+
+// packageToInstanceType builds the EC2 instance type for a Triton package
+func packageToInstanceType(pkg *api.Package) *ec2.InstanceTypeInfo {
+	vcpus := packageVCPUs(pkg)
+
+	instType := &ec2.InstanceTypeInfo{
+		InstanceType:                  aws.String(pkg.Name),
+		MemoryInfo:                    &ec2.MemoryInfo{SizeInMiB: aws.Int64(pkg.Memory)},
+		CurrentGeneration:             aws.Bool(pkg.Active),
+		BurstablePerformanceSupported: aws.Bool(packageBurstable(pkg)),
+		BareMetal:                     aws.Bool(false),
+		FreeTierEligible:              aws.Bool(false),
+		HibernationSupported:          aws.Bool(false),
+		VCpuInfo: &ec2.VCpuInfo{
+			DefaultVCpus:          aws.Int64(vcpus),
+			DefaultCores:          aws.Int64(vcpus),
+			DefaultThreadsPerCore: aws.Int64(1),
+		},
+		ProcessorInfo: &ec2.ProcessorInfo{
+			SupportedArchitectures: aws.StringSlice([]string{ec2.ArchitectureTypeX8664}),
+		},
+		// Instances use their compute node local storage. Since it can be
+		// snapshotted, the instance disk is described as their EBS root
+		// volume (see snapshots.go), like DescribeInstances does, and not
+		// as instance storage.
+		InstanceStorageSupported: aws.Bool(false),
+		EbsInfo: &ec2.EbsInfo{
+			EbsOptimizedSupport: aws.String(ec2.EbsOptimizedSupportUnsupported),
+			EncryptionSupport:   aws.String(ec2.EbsEncryptionSupportUnsupported),
+		},
+		SupportedRootDeviceTypes: aws.StringSlice([]string{ec2.RootDeviceTypeEbs}),
+		SupportedUsageClasses:    aws.StringSlice([]string{ec2.UsageClassTypeOnDemand}),
+	}
+
+	switch {
+	case pkg.Brand == "":
+		// Packages without brand can be used with any of them
+		instType.SupportedVirtualizationTypes = aws.StringSlice([]string{
+			ec2.VirtualizationTypeHvm,
+			ec2.VirtualizationTypeParavirtual,
+		})
+	case hvmBrands[pkg.Brand]:
+		instType.SupportedVirtualizationTypes = aws.StringSlice([]string{ec2.VirtualizationTypeHvm})
+		instType.Hypervisor = aws.String(pkg.Brand)
+	default:
+		// OS virtualization (zones) is the closest thing to paravirtual
+		instType.SupportedVirtualizationTypes = aws.StringSlice([]string{ec2.VirtualizationTypeParavirtual})
+		instType.Hypervisor = aws.String(pkg.Brand)
+	}
+
+	return instType
+}
@@ -0,0 +1,600 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	tritonaccount "github.com/joyent/triton-go/v2/account"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	"github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Key pairs are the SSH keys of the Triton account, identified by their
+// name. Triton only keeps public keys, so the fingerprints of the keys
+// generated by CreateKeyPair, which AWS computes from the private key, are
+// recorded by the shim.
+
+// keyPairsCollection is the store collection for the key pair attributes
+// which have no Triton equivalent. Triton account keys are the same in every
+// datacenter, so their records and tags are kept for accountRegion.
+const keyPairsCollection = "key-pairs"
+
+// Key pair types
+const (
+	keyTypeRSA     = "rsa"
+	keyTypeED25519 = "ed25519"
+)
+
+// Instances launched with a key pair only get that key into their
+// root_authorized_keys metadata, which CloudAPI otherwise fills with all the
+// account keys, and keep the key pair name into their key-name metadata
+const (
+	authorizedKeysMetadataKey = "root_authorized_keys"
+	keyNameMetadataKey        = "key-name"
+)
+
+// rsaKeyBits is the size of the RSA keys generated by CreateKeyPair, like
+// EC2 ones
+const rsaKeyBits = 2048
+
+// keyPairRecord is the shim record of a key pair
+type keyPairRecord struct {
+	Name        string `json:"name"`
+	Owner       string `json:"owner"`
+	KeyType     string `json:"key_type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// keyPairID returns the EC2 ID of a Triton key, derived from its Triton
+// fingerprint
+func keyPairID(key *tritonaccount.Key) string {
+	sum := md5.Sum([]byte(key.Fingerprint))
+	return "key-" + hex.EncodeToString(sum[:])[:17]
+}
+
+// colonHex formats a digest the way AWS prints MD5 and SHA1 fingerprints,
+// like "1f:51:ae:28:..."
+func colonHex(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.Join(parts, ":")
+}
+
+// publicKeyType returns the key pair type of a public key, or "" for the
+// types EC2 does not support
+func publicKeyType(pub ssh.PublicKey) string {
+	switch pub.Type() {
+	case ssh.KeyAlgoRSA:
+		return keyTypeRSA
+	case ssh.KeyAlgoED25519:
+		return keyTypeED25519
+	default:
+		return ""
+	}
+}
+
+// importedKeyFingerprint returns the AWS fingerprint of an imported public
+// key: the MD5 of the DER encoded public key for RSA keys, and the base64
+// SHA256 of the SSH public key for ED25519 keys
+func importedKeyFingerprint(pub ssh.PublicKey) (string, error) {
+	if publicKeyType(pub) == keyTypeED25519 {
+		return ed25519KeyFingerprint(pub), nil
+	}
+
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return "", fmt.Errorf("Unsupported key type %s", pub.Type())
+	}
+	der, err := x509.MarshalPKIXPublicKey(cryptoPub.CryptoPublicKey())
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum(der)
+	return colonHex(sum[:]), nil
+}
+
+// ed25519KeyFingerprint returns the AWS fingerprint of an ED25519 key, which
+// is the same for imported and generated keys
+func ed25519KeyFingerprint(pub ssh.PublicKey) string {
+	sum := sha256.Sum256(pub.Marshal())
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// generateKeyPair generates a key of the given type. It returns the public
+// key, the PEM encoded private key, and the AWS fingerprint of the key: the
+// SHA1 of the PKCS#8 encoded private key for RSA keys.
+func generateKeyPair(keyType string, comment string) (ssh.PublicKey, string, string, error) {
+	if keyType == keyTypeED25519 {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", "", err
+		}
+		pub, err := ssh.NewPublicKey(public)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return pub, marshalOpenSSHPrivateKey(pub, private, comment), ed25519KeyFingerprint(pub), nil
+	}
+
+	private, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return nil, "", "", err
+	}
+	pub, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		return nil, "", "", err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, "", "", err
+	}
+	sum := sha1.Sum(pkcs8)
+	material := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(private),
+	})
+	return pub, string(material), colonHex(sum[:]), nil
+}
+
+// marshalOpenSSHPrivateKey encodes an ED25519 private key using the OpenSSH
+// format, which is the one EC2 returns and the only one OpenSSH reads for
+// these keys
+func marshalOpenSSHPrivateKey(pub ssh.PublicKey, private ed25519.PrivateKey, comment string) string {
+	var check [4]byte
+	rand.Read(check[:])
+
+	block := struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Public  []byte
+		Private []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{
+		Check1:  binary.BigEndian.Uint32(check[:]),
+		Check2:  binary.BigEndian.Uint32(check[:]),
+		KeyType: ssh.KeyAlgoED25519,
+		Public:  private.Public().(ed25519.PublicKey),
+		Private: private,
+		Comment: comment,
+	}
+	// The private section is padded to the cipher block size, which is 8
+	// for unencrypted keys
+	size := len(ssh.Marshal(block))
+	for i := 1; (size+i-1)%8 != 0; i++ {
+		block.Pad = append(block.Pad, byte(i))
+	}
+
+	key := struct {
+		CipherName   string
+		KdfName      string
+		KdfOptions   string
+		NumKeys      uint32
+		PublicKey    []byte
+		PrivateBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PublicKey:    pub.Marshal(),
+		PrivateBlock: ssh.Marshal(block),
+	}
+
+	data := append([]byte("openssh-key-v1\x00"), ssh.Marshal(key)...)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data}))
+}
+
+// keyFingerprint returns the AWS fingerprint of a Triton key. Keys added
+// outside the shim are taken as imported ones.
+func keyFingerprint(key *tritonaccount.Key, record *keyPairRecord) string {
+	if record.Fingerprint != "" {
+		return record.Fingerprint
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
+	if err != nil {
+		return key.Fingerprint
+	}
+	fingerprint, err := importedKeyFingerprint(pub)
+	if err != nil {
+		return key.Fingerprint
+	}
+	return fingerprint
+}
+
+// loadKeyPairRecord returns the shim record of a key pair, which is empty
+// for keys added outside the shim
+func loadKeyPairRecord(db *store.Store, owner string, name string) (*keyPairRecord, error) {
+	record := &keyPairRecord{Name: name, Owner: owner}
+	err := db.Get(keyPairsCollection, ownedKey(accountRegion, owner, name), record)
+	if err != nil && err != store.ErrNotFound {
+		return nil, fmt.Errorf("Unable to load key pair: %w", err)
+	}
+	return record, nil
+}
+
+// listKeys returns the SSH keys of the account
+func listKeys(client *tritonaccount.AccountClient) ([]*tritonaccount.Key, error) {
+	keys, err := client.Keys().List(context.Background(), &tritonaccount.ListKeysInput{})
+	if err != nil {
+		log.Printf("[ERROR] list keys error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton keys: %w", err)
+	}
+	return keys, nil
+}
+
+// findKey returns the account key with the given name, or nil
+func findKey(keys []*tritonaccount.Key, name string) *tritonaccount.Key {
+	for _, key := range keys {
+		if key.Name == name {
+			return key
+		}
+	}
+	return nil
+}
+
+// abortWithKeyPairNotFound is used when the requested key pair does not
+// exist
+func abortWithKeyPairNotFound(c *gin.Context, name string) {
+	abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidKeyPair.NotFound",
+		fmt.Sprintf("The key pair '%s' does not exist", name), requestID(c)))
+}
+
+// addKey adds a public key to the account, recording its AWS attributes.
+// The request is aborted when the key name is already used.
+func addKey(c *gin.Context, client *tritonaccount.AccountClient, db *store.Store, owner string,
+	name string, pub ssh.PublicKey, fingerprint string) *tritonaccount.Key {
+
+	keys, err := listKeys(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil
+	}
+	if findKey(keys, name) != nil {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidKeyPair.Duplicate",
+			fmt.Sprintf("The keypair '%s' already exists.", name), requestID(c)))
+		return nil
+	}
+
+	key, err := client.Keys().Create(context.Background(), &tritonaccount.CreateKeyInput{
+		Name: name,
+		Key:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+	})
+	if err != nil {
+		log.Printf("[ERROR] create key error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton key: %w", err))
+		return nil
+	}
+
+	record := &keyPairRecord{
+		Name:        name,
+		Owner:       owner,
+		KeyType:     publicKeyType(pub),
+		Fingerprint: fingerprint,
+	}
+	if err := db.Put(keyPairsCollection, ownedKey(accountRegion, owner, name), record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save key pair: %w", err))
+		return nil
+	}
+
+	tags := tagSpecifications(c, ec2.ResourceTypeKeyPair)
+	if err := saveTags(db, accountRegion, owner, keyPairID(key), tags); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save key pair tags: %w", err))
+		return nil
+	}
+
+	log.Printf("[DEBUG] created key %s\n", name)
+
+	return key
+}
+
+// DescribeKeyPairs lists the SSH keys of the account
+func DescribeKeyPairs(c *gin.Context) {
+	client, err := tritonutils.GetTritonAccountClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton account client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	keys, err := listKeys(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	names := paramList(c, "KeyName")
+	for _, name := range names {
+		if findKey(keys, name) == nil {
+			abortWithKeyPairNotFound(c, name)
+			return
+		}
+	}
+	ids := paramList(c, "KeyPairId")
+	for _, id := range ids {
+		found := false
+		for _, key := range keys {
+			found = found || keyPairID(key) == id
+		}
+		if !found {
+			abortWithNotFound(c, "InvalidKeyPair.NotFound", id)
+			return
+		}
+	}
+
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeKeyPairsOutput{}
+
+	for _, key := range keys {
+		id := keyPairID(key)
+		if (len(names) > 0 && !containsString(names, key.Name)) ||
+			(len(ids) > 0 && !containsString(ids, id)) {
+			continue
+		}
+		record, err := loadKeyPairRecord(db, account.ID, key.Name)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		tags, err := loadTags(db, accountRegion, account.ID, id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to load key pair tags: %w", err))
+			return
+		}
+		info := &ec2.KeyPairInfo{
+			KeyName:        aws.String(key.Name),
+			KeyPairId:      aws.String(id),
+			KeyFingerprint: aws.String(keyFingerprint(key, record)),
+			Tags:           ec2Tags(tags),
+		}
+		if filterMatch(ec2Filters, "key-name", key.Name) &&
+			filterMatch(ec2Filters, "key-pair-id", id) &&
+			filterMatch(ec2Filters, "fingerprint", *info.KeyFingerprint) &&
+			tagFiltersMatch(ec2Filters, tags) {
+			ec2Output.KeyPairs = append(ec2Output.KeyPairs, info)
+		}
+	}
+
+	writeResponse(c, "DescribeKeyPairs", ec2Output)
+}
+
+// ImportKeyPair adds a public key to the account
+func ImportKeyPair(c *gin.Context) {
+	name := param(c, "KeyName")
+	if name == "" {
+		abortWithMissingParameter(c, "KeyName")
+		return
+	}
+	material := param(c, "PublicKeyMaterial")
+	if material == "" {
+		abortWithMissingParameter(c, "PublicKeyMaterial")
+		return
+	}
+
+	// The key material is base64 encoded, like every EC2 blob
+	decoded, err := base64.StdEncoding.DecodeString(material)
+	if err != nil {
+		decoded = []byte(material)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(decoded)
+	if err != nil || publicKeyType(pub) == "" {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidKey.Format",
+			"Key is not in valid OpenSSH public key format", requestID(c)))
+		return
+	}
+	fingerprint, err := importedKeyFingerprint(pub)
+	if err != nil {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidKey.Format",
+			"Key is not in valid OpenSSH public key format", requestID(c)))
+		return
+	}
+
+	client, err := tritonutils.GetTritonAccountClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton account client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	key := addKey(c, client, db, account.ID, name, pub, fingerprint)
+	if key == nil {
+		return
+	}
+
+	writeResponse(c, "ImportKeyPair", ec2.ImportKeyPairOutput{
+		KeyName:        aws.String(key.Name),
+		KeyPairId:      aws.String(keyPairID(key)),
+		KeyFingerprint: aws.String(fingerprint),
+		Tags:           ec2Tags(tagSpecifications(c, ec2.ResourceTypeKeyPair)),
+	})
+}
+
+// CreateKeyPair generates a key, adds its public key to the account, and
+// returns the private key, which is not kept anywhere
+func CreateKeyPair(c *gin.Context) {
+	name := param(c, "KeyName")
+	if name == "" {
+		abortWithMissingParameter(c, "KeyName")
+		return
+	}
+	keyType := param(c, "KeyType")
+	if keyType == "" {
+		keyType = keyTypeRSA
+	}
+	if keyType != keyTypeRSA && keyType != keyTypeED25519 {
+		abortWithInvalidParameter(c, "KeyType", keyType)
+		return
+	}
+	if keyFormat := param(c, "KeyFormat"); keyFormat != "" && keyFormat != "pem" {
+		abortWithInvalidParameter(c, "KeyFormat", keyFormat)
+		return
+	}
+
+	client, err := tritonutils.GetTritonAccountClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton account client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	pub, material, fingerprint, err := generateKeyPair(keyType, name)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to generate key pair: %w", err))
+		return
+	}
+
+	key := addKey(c, client, db, account.ID, name, pub, fingerprint)
+	if key == nil {
+		return
+	}
+
+	writeResponse(c, "CreateKeyPair", ec2.CreateKeyPairOutput{
+		KeyName:        aws.String(key.Name),
+		KeyPairId:      aws.String(keyPairID(key)),
+		KeyFingerprint: aws.String(fingerprint),
+		KeyMaterial:    aws.String(material),
+		Tags:           ec2Tags(tagSpecifications(c, ec2.ResourceTypeKeyPair)),
+	})
+}
+
+// DeleteKeyPair removes a key from the account. Like EC2, deleting a key
+// which does not exist is not an error.
+func DeleteKeyPair(c *gin.Context) {
+	name := param(c, "KeyName")
+	id := param(c, "KeyPairId")
+	if name == "" && id == "" {
+		abortWithMissingParameter(c, "KeyName")
+		return
+	}
+
+	client, err := tritonutils.GetTritonAccountClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton account client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	keys, err := listKeys(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var key *tritonaccount.Key
+	for _, k := range keys {
+		if (name != "" && k.Name == name) || (id != "" && keyPairID(k) == id) {
+			key = k
+		}
+	}
+	if key == nil {
+		writeResponse(c, "DeleteKeyPair", returnOutput{Return: aws.Bool(true)})
+		return
+	}
+
+	err = client.Keys().Delete(context.Background(), &tritonaccount.DeleteKeyInput{
+		KeyName: key.Name,
+	})
+	if err != nil && !tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+		log.Printf("[ERROR] delete key error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to delete triton key: %w", err))
+		return
+	}
+
+	if err := db.Delete(keyPairsCollection, ownedKey(accountRegion, account.ID, key.Name)); err != nil {
+		log.Printf("[ERROR] delete key pair %s record error: %v\n", key.Name, err)
+	}
+	if err := saveTags(db, accountRegion, account.ID, keyPairID(key), nil); err != nil {
+		log.Printf("[ERROR] delete key pair %s tags error: %v\n", key.Name, err)
+	}
+
+	writeResponse(c, "DeleteKeyPair", returnOutput{Return: aws.Bool(true)})
+}
@@ -0,0 +1,88 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSKeyPairs(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Errorf("generate key error %v", err)
+			return
+		}
+		pub, err := ssh.NewPublicKey(&private.PublicKey)
+		if err != nil {
+			t.Errorf("ssh public key error %v", err)
+			return
+		}
+		der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+		if err != nil {
+			t.Errorf("marshal public key error %v", err)
+			return
+		}
+		var parts []string
+		for _, b := range md5.Sum(der) {
+			parts = append(parts, fmt.Sprintf("%02x", b))
+		}
+		fingerprint := strings.Join(parts, ":")
+
+		imported, err := ec2Svc.ImportKeyPair(&ec2.ImportKeyPairInput{
+			KeyName:           aws.String("triton-shim-test-imported"),
+			PublicKeyMaterial: ssh.MarshalAuthorizedKey(pub),
+		})
+		if err != nil {
+			t.Errorf("import key pair error %v", err)
+			return
+		}
+		if *imported.KeyFingerprint != fingerprint {
+			t.Errorf("unexpected imported key fingerprint %s, expected %s",
+				*imported.KeyFingerprint, fingerprint)
+		}
+
+		created, err := ec2Svc.CreateKeyPair(&ec2.CreateKeyPairInput{
+			KeyName: aws.String("triton-shim-test-created"),
+		})
+		if err != nil {
+			t.Errorf("create key pair error %v", err)
+		} else if _, err := ssh.ParsePrivateKey([]byte(*created.KeyMaterial)); err != nil {
+			t.Errorf("parse created key material error %v", err)
+		}
+
+		described, err := ec2Svc.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{
+			KeyNames: []*string{imported.KeyName},
+		})
+		if err != nil {
+			t.Errorf("describe key pairs error %v", err)
+		} else if len(described.KeyPairs) != 1 || *described.KeyPairs[0].KeyFingerprint != fingerprint {
+			t.Errorf("describe key pairs did not return the imported key")
+		}
+
+		for _, name := range []string{"triton-shim-test-imported", "triton-shim-test-created"} {
+			_, err = ec2Svc.DeleteKeyPair(&ec2.DeleteKeyPairInput{KeyName: aws.String(name)})
+			if err != nil {
+				t.Errorf("delete key pair %s error %v", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	shimerrors "github.com/joyent/triton-shim/errors"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// ModifyInstanceAttribute changes an instance attribute. Only instanceType is
+// supported, resizing the instance to the package the given instance type
+// resolves to. The alias given, if any, is kept into the instance metadata.
+func ModifyInstanceAttribute(c *gin.Context) {
+	instanceID := param(c, "InstanceId")
+	if instanceID == "" {
+		abortWithMissingParameter(c, "InstanceId")
+		return
+	}
+
+	// The attribute can be given either as Attribute and Value, or using
+	// the attribute parameter itself, like InstanceType.Value
+	attribute := param(c, "Attribute")
+	value := param(c, "Value")
+	if instanceType := param(c, "InstanceType.Value"); instanceType != "" {
+		attribute = "instanceType"
+		value = instanceType
+	}
+
+	if attribute != "instanceType" {
+		abortWithXMLError(c, http.StatusBadRequest, shimerrors.ResponseError(
+			"UnsupportedOperation",
+			fmt.Sprintf("Modifying the instance attribute '%s' is not supported", attribute),
+			requestID(c)))
+		return
+	}
+	if value == "" {
+		abortWithMissingParameter(c, "Value")
+		return
+	}
+
+	pkg, err := resolveInstanceType(regionName(c), requestPrincipal(c), value)
+	if err != nil {
+		if errors.Is(err, ErrUnknownInstanceType) {
+			abortWithInvalidParameter(c, "InstanceType", value)
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	vm := getInstance(c, client, instanceID)
+	if vm == nil {
+		return
+	}
+
+	err = client.Instances().Resize(context.Background(), &tritoncompute.ResizeInstanceInput{
+		ID:      instanceID,
+		Package: pkg.UUID,
+	})
+	if err != nil {
+		log.Printf("[ERROR] resize vm error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to resize triton compute instance: %w", err))
+		return
+	}
+
+	// Keep the alias, so the instance is described with the instance type
+	// it was given
+	if alias := instanceTypeAlias(pkg, value); alias != "" {
+		_, err = client.Instances().UpdateMetadata(context.Background(), &tritoncompute.UpdateMetadataInput{
+			ID:       instanceID,
+			Metadata: map[string]interface{}{instanceTypeMetadataKey: alias},
+		})
+	} else if _, found := vm.Metadata[instanceTypeMetadataKey]; found {
+		err = client.Instances().DeleteMetadata(context.Background(), &tritoncompute.DeleteMetadataInput{
+			ID:  instanceID,
+			Key: instanceTypeMetadataKey,
+		})
+	}
+	if err != nil {
+		log.Printf("[ERROR] update vm metadata error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to update triton compute instance metadata: %w", err))
+		return
+	}
+
+	writeResponse(c, "ModifyInstanceAttribute", returnOutput{Return: aws.Bool(true)})
+}
@@ -0,0 +1,969 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	tritonnetwork "github.com/joyent/triton-go/v2/network"
+	"github.com/joyent/triton-shim/api"
+	shimerrors "github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Network interfaces are the NICs of the Triton instances. Their IDs encode
+// the NIC MAC address, like "eni-90b8d0a1b2c3" for 90:b8:d0:a1:b2:c3, and
+// their attachment IDs too, like "eni-attach-90b8d0a1b2c3".
+// Triton NICs cannot exist without an instance, so the interfaces created by
+// CreateNetworkInterface, or detached from their instance, are kept by the
+// shim until attached. Those keep their "eni-<17 hex digits>" ID.
+
+// networkInterfacesCollection is the store collection for the network
+// interfaces created through the shim
+const networkInterfacesCollection = "network-interfaces"
+
+// macIDRe matches the IDs built from MAC addresses by macID
+var macIDRe = regexp.MustCompile(`^(eni|eni-attach)-([0-9a-f]{12})$`)
+
+// networkInterfaceRecord is the shim record of a network interface created
+// by CreateNetworkInterface. Once attached, it also holds the instance and
+// the MAC address of its NIC.
+type networkInterfaceRecord struct {
+	ID          string `json:"id"`
+	Owner       string `json:"owner"`
+	Region      string `json:"region"`
+	NetworkID   string `json:"network_id"`
+	Description string `json:"description,omitempty"`
+	InstanceID  string `json:"instance_id,omitempty"`
+	MAC         string `json:"mac,omitempty"`
+}
+
+// key returns the store key of the record
+func (r *networkInterfaceRecord) key() string {
+	return ownedKey(r.Region, r.Owner, r.ID)
+}
+
+// instanceNIC is a NIC together with its instance
+type instanceNIC struct {
+	Instance *tritoncompute.Instance
+	NIC      *api.NIC
+}
+
+// networkInterfaces has everything needed to convert NICs into EC2 network
+// interfaces, loaded once per request
+type networkInterfaces struct {
+	Owner    string
+	Records  []*networkInterfaceRecord
+	Networks map[string]*tritonnetwork.Network
+	Vpcs     map[string]string
+	Zone     *availabilityZone
+	// AddressesOnly is set when only the networks could be loaded, so
+	// instances are described with their addresses but without their
+	// network interfaces, subnet and VPC
+	AddressesOnly bool
+}
+
+// macID returns the interface or attachment ID for the given MAC address
+func macID(prefix string, mac string) string {
+	return prefix + "-" + strings.ToLower(strings.Replace(mac, ":", "", -1))
+}
+
+// parseMacID returns the MAC address encoded into an interface or attachment
+// ID with the given prefix
+func parseMacID(prefix string, id string) (string, bool) {
+	m := macIDRe.FindStringSubmatch(id)
+	if m == nil || m[1] != prefix {
+		return "", false
+	}
+	var parts []string
+	for i := 0; i < len(m[2]); i += 2 {
+		parts = append(parts, m[2][i:i+2])
+	}
+	return strings.Join(parts, ":"), true
+}
+
+// nicDeviceIndex returns the EC2 device index of a NIC, which is the number
+// of its interface name, like 1 for "net1"
+func nicDeviceIndex(nic *api.NIC) int64 {
+	index, err := strconv.ParseInt(strings.TrimPrefix(nic.Interface, "net"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return index
+}
+
+// listInstanceNICs returns the NICs of an instance. VMAPI is used when
+// available (operator mode), since CloudAPI does not tell the NIC interface
+// names. Otherwise they are named after the order of the NICs.
+func listInstanceNICs(client *tritoncompute.ComputeClient, region string, id string) ([]*api.NIC, error) {
+	vmapi, err := tritonutils.GetVmapiClient(region)
+	if err == nil {
+		nics, err := listVmapiNICs(vmapi, []string{id})
+		if err != nil {
+			return nil, err
+		}
+		return nics[id], nil
+	}
+	if !errors.Is(err, api.ErrMissingURL) {
+		return nil, fmt.Errorf("Unable to create VMAPI client: %w", err)
+	}
+
+	cloudapiNICs, err := client.Instances().ListNICs(context.Background(), &tritoncompute.ListNICsInput{
+		InstanceID: id,
+	})
+	if err != nil {
+		log.Printf("[ERROR] list vm nics error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton compute instance nics: %w", err)
+	}
+
+	nics := make([]*api.NIC, 0, len(cloudapiNICs))
+	for i, nic := range cloudapiNICs {
+		nics = append(nics, &api.NIC{
+			IP:        nic.IP,
+			MAC:       nic.MAC,
+			Primary:   nic.Primary,
+			Netmask:   nic.Netmask,
+			Gateway:   nic.Gateway,
+			Network:   nic.Network,
+			Interface: fmt.Sprintf("net%d", i),
+		})
+	}
+	return nics, nil
+}
+
+// vmapiNICsBatchSize is the number of instances whose NICs are retrieved by
+// a single VMAPI request
+const vmapiNICsBatchSize = 100
+
+// listVmapiNICs returns the NICs of the given instances by instance ID, using
+// as few VMAPI requests as possible
+func listVmapiNICs(vmapi *api.VmapiClient, ids []string) (map[string][]*api.NIC, error) {
+	result := make(map[string][]*api.NIC)
+	for start := 0; start < len(ids); start += vmapiNICsBatchSize {
+		end := start + vmapiNICsBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		vms, err := vmapi.ListVms(context.Background(), &api.ListVmsInput{UUIDs: ids[start:end]})
+		if err != nil {
+			log.Printf("[ERROR] list vmapi vms error: %v\n", err)
+			return nil, fmt.Errorf("Unable to list VMAPI vms: %w", err)
+		}
+		for _, vm := range vms {
+			for i := range vm.Nics {
+				result[vm.UUID] = append(result[vm.UUID], &vm.Nics[i])
+			}
+		}
+	}
+	return result, nil
+}
+
+// instanceAddressNICs builds the NICs of an instance from its IPs and
+// networks, which CloudAPI lists in the same order. They have no MAC address,
+// so they cannot be described as network interfaces.
+func instanceAddressNICs(vm *tritoncompute.Instance) []*api.NIC {
+	if len(vm.IPs) != len(vm.Networks) {
+		return nil
+	}
+	nics := make([]*api.NIC, 0, len(vm.IPs))
+	for i, ip := range vm.IPs {
+		nics = append(nics, &api.NIC{
+			IP:        ip,
+			Network:   vm.Networks[i],
+			Interface: fmt.Sprintf("net%d", i),
+		})
+	}
+	return nics
+}
+
+// listInstancesNICs returns the NICs of the given instances by instance ID.
+// VMAPI is used when available (operator mode), with a request for every
+// batch of instances. Otherwise CloudAPI lists the NICs of every instance.
+func listInstancesNICs(client *tritoncompute.ComputeClient, region string,
+	vms []*tritoncompute.Instance) (map[string][]*api.NIC, error) {
+
+	vmapi, err := tritonutils.GetVmapiClient(region)
+	if err == nil {
+		ids := make([]string, 0, len(vms))
+		for _, vm := range vms {
+			ids = append(ids, vm.ID)
+		}
+		return listVmapiNICs(vmapi, ids)
+	}
+	if !errors.Is(err, api.ErrMissingURL) {
+		return nil, fmt.Errorf("Unable to create VMAPI client: %w", err)
+	}
+
+	result := make(map[string][]*api.NIC)
+	for _, vm := range vms {
+		if result[vm.ID], err = listInstanceNICs(client, region, vm.ID); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// listInstancesAddressNICs is like listInstancesNICs, falling back to the
+// NICs built from the instance addresses when the NICs cannot be listed
+func listInstancesAddressNICs(client *tritoncompute.ComputeClient, region string,
+	vms []*tritoncompute.Instance) map[string][]*api.NIC {
+
+	nics, err := listInstancesNICs(client, region, vms)
+	if err == nil {
+		return nics
+	}
+	log.Printf("[ERROR] list vms nics error: %v\n", err)
+
+	nics = make(map[string][]*api.NIC)
+	for _, vm := range vms {
+		nics[vm.ID] = instanceAddressNICs(vm)
+	}
+	return nics
+}
+
+// loadNetworkInterfaces loads the networks and the shim records needed to
+// describe the network interfaces of the given owner
+func loadNetworkInterfaces(c *gin.Context, owner string) (*networkInterfaces, error) {
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create triton network client: %w", err)
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open shim store: %w", err)
+	}
+
+	zones, err := listAvailabilityZones(regionName(c))
+	if err != nil {
+		return nil, err
+	}
+
+	networks, err := client.List(context.Background(), &tritonnetwork.ListInput{})
+	if err != nil {
+		log.Printf("[ERROR] list networks error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton networks: %w", err)
+	}
+
+	fabrics, err := listFabricNetworks(client)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &networkInterfaces{
+		Owner:    owner,
+		Networks: make(map[string]*tritonnetwork.Network),
+		Vpcs:     make(map[string]string),
+		Zone:     zoneOrDefault(zones, ""),
+	}
+	for _, network := range networks {
+		result.Networks[network.Id] = network
+	}
+	for _, fabric := range fabrics {
+		result.Vpcs[fabric.Network.Id] = vpcID(fabric.VLANID)
+	}
+
+	for _, key := range db.Keys(networkInterfacesCollection) {
+		record := &networkInterfaceRecord{}
+		if err := db.Get(networkInterfacesCollection, key, record); err != nil {
+			return nil, fmt.Errorf("Unable to load network interface: %w", err)
+		}
+		if record.Region == regionName(c) && record.Owner == owner {
+			result.Records = append(result.Records, record)
+		}
+	}
+
+	return result, nil
+}
+
+// loadInstanceNetworkInterfaces is like loadNetworkInterfaces, for describing
+// instances. Network details are not worth failing the whole request: when
+// they cannot be loaded, instances are described with their addresses only,
+// or without any network details when even the networks cannot be listed.
+func loadInstanceNetworkInterfaces(c *gin.Context, owner string) *networkInterfaces {
+	interfaces, err := loadNetworkInterfaces(c, owner)
+	if err == nil {
+		return interfaces
+	}
+	log.Printf("[ERROR] load network interfaces error: %v\n", err)
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		log.Printf("[ERROR] create triton network client error: %v\n", err)
+		return nil
+	}
+	networks, err := client.List(context.Background(), &tritonnetwork.ListInput{})
+	if err != nil {
+		log.Printf("[ERROR] list networks error: %v\n", err)
+		return nil
+	}
+
+	interfaces = &networkInterfaces{
+		Owner:         owner,
+		Networks:      make(map[string]*tritonnetwork.Network),
+		Vpcs:          make(map[string]string),
+		Zone:          &availabilityZone{},
+		AddressesOnly: true,
+	}
+	for _, network := range networks {
+		interfaces.Networks[network.Id] = network
+	}
+	return interfaces
+}
+
+// record returns the shim record of the given NIC, if any
+func (n *networkInterfaces) record(vmID string, mac string) *networkInterfaceRecord {
+	for _, record := range n.Records {
+		if record.InstanceID == vmID && record.MAC == mac {
+			return record
+		}
+	}
+	return nil
+}
+
+// interfaceID returns the network interface ID of the given NIC
+func (n *networkInterfaces) interfaceID(vmID string, mac string) string {
+	if record := n.record(vmID, mac); record != nil {
+		return record.ID
+	}
+	return macID("eni", mac)
+}
+
+// isPublic tells if the network is a public one
+func (n *networkInterfaces) isPublic(networkID string) bool {
+	network, found := n.Networks[networkID]
+	return found && network.Public
+}
+
+// privateIP returns the private IP of a NIC, which is empty for public NICs
+func (n *networkInterfaces) privateIP(nic *api.NIC) *string {
+	if n.isPublic(nic.Network) {
+		return nil
+	}
+	return aws.String(nic.IP)
+}
+
+// toEC2 converts an instance NIC into an EC2 network interface
+func (n *networkInterfaces) toEC2(vm *tritoncompute.Instance, nic *api.NIC) *ec2.NetworkInterface {
+	eni := &ec2.NetworkInterface{
+		NetworkInterfaceId: aws.String(n.interfaceID(vm.ID, nic.MAC)),
+		AvailabilityZone:   aws.String(n.Zone.Name),
+		InterfaceType:      aws.String(ec2.NetworkInterfaceTypeInterface),
+		MacAddress:         aws.String(nic.MAC),
+		OwnerId:            aws.String(n.Owner),
+		PrivateIpAddress:   n.privateIP(nic),
+		RequesterManaged:   aws.Bool(false),
+		SourceDestCheck:    aws.Bool(true),
+		Status:             aws.String(ec2.NetworkInterfaceStatusInUse),
+		SubnetId:           aws.String(subnetID(nic.Network)),
+		Groups:             instanceGroups(vm),
+		Attachment: &ec2.NetworkInterfaceAttachment{
+			AttachmentId:        aws.String(macID("eni-attach", nic.MAC)),
+			AttachTime:          aws.Time(vm.Created),
+			DeleteOnTermination: aws.Bool(n.record(vm.ID, nic.MAC) == nil),
+			DeviceIndex:         aws.Int64(nicDeviceIndex(nic)),
+			InstanceId:          aws.String(vm.ID),
+			InstanceOwnerId:     aws.String(n.Owner),
+			Status:              aws.String(ec2.AttachmentStatusAttached),
+		},
+	}
+	if vpc, found := n.Vpcs[nic.Network]; found {
+		eni.VpcId = aws.String(vpc)
+	}
+	if eni.PrivateIpAddress != nil {
+		eni.PrivateIpAddresses = []*ec2.NetworkInterfacePrivateIpAddress{{
+			Primary:          aws.Bool(true),
+			PrivateIpAddress: eni.PrivateIpAddress,
+		}}
+	} else {
+		eni.Association = &ec2.NetworkInterfaceAssociation{
+			IpOwnerId: aws.String("amazon"),
+			PublicIp:  aws.String(nic.IP),
+		}
+	}
+	if record := n.record(vm.ID, nic.MAC); record != nil && record.Description != "" {
+		eni.Description = aws.String(record.Description)
+	}
+	return eni
+}
+
+// recordToEC2 converts a detached network interface into an EC2 one
+func (n *networkInterfaces) recordToEC2(record *networkInterfaceRecord) *ec2.NetworkInterface {
+	eni := &ec2.NetworkInterface{
+		NetworkInterfaceId: aws.String(record.ID),
+		AvailabilityZone:   aws.String(n.Zone.Name),
+		InterfaceType:      aws.String(ec2.NetworkInterfaceTypeInterface),
+		OwnerId:            aws.String(n.Owner),
+		RequesterManaged:   aws.Bool(false),
+		SourceDestCheck:    aws.Bool(true),
+		Status:             aws.String(ec2.NetworkInterfaceStatusAvailable),
+		SubnetId:           aws.String(subnetID(record.NetworkID)),
+	}
+	if vpc, found := n.Vpcs[record.NetworkID]; found {
+		eni.VpcId = aws.String(vpc)
+	}
+	if record.Description != "" {
+		eni.Description = aws.String(record.Description)
+	}
+	return eni
+}
+
+// toInstanceEC2 converts an instance NIC into an EC2 instance network
+// interface, as included into DescribeInstances
+func (n *networkInterfaces) toInstanceEC2(vm *tritoncompute.Instance, nic *api.NIC) *ec2.InstanceNetworkInterface {
+	eni := n.toEC2(vm, nic)
+	inst := &ec2.InstanceNetworkInterface{
+		NetworkInterfaceId: eni.NetworkInterfaceId,
+		Description:        eni.Description,
+		Groups:             eni.Groups,
+		InterfaceType:      eni.InterfaceType,
+		MacAddress:         eni.MacAddress,
+		OwnerId:            eni.OwnerId,
+		PrivateIpAddress:   eni.PrivateIpAddress,
+		SourceDestCheck:    eni.SourceDestCheck,
+		Status:             eni.Status,
+		SubnetId:           eni.SubnetId,
+		VpcId:              eni.VpcId,
+		Attachment: &ec2.InstanceNetworkInterfaceAttachment{
+			AttachmentId:        eni.Attachment.AttachmentId,
+			AttachTime:          eni.Attachment.AttachTime,
+			DeleteOnTermination: eni.Attachment.DeleteOnTermination,
+			DeviceIndex:         eni.Attachment.DeviceIndex,
+			Status:              eni.Attachment.Status,
+		},
+	}
+	for _, ip := range eni.PrivateIpAddresses {
+		inst.PrivateIpAddresses = append(inst.PrivateIpAddresses, &ec2.InstancePrivateIpAddress{
+			Primary:          ip.Primary,
+			PrivateIpAddress: ip.PrivateIpAddress,
+		})
+	}
+	if eni.Association != nil {
+		inst.Association = &ec2.InstanceNetworkInterfaceAssociation{
+			IpOwnerId: eni.Association.IpOwnerId,
+			PublicIp:  eni.Association.PublicIp,
+		}
+	}
+	return inst
+}
+
+// addInstanceNetworkInterfaces fills the network details of an EC2 instance
+// from its NICs
+func (n *networkInterfaces) addInstanceNetworkInterfaces(inst *ec2.Instance,
+	vm *tritoncompute.Instance, nics []*api.NIC) {
+
+	for _, nic := range nics {
+		// NICs without MAC address have no interface ID
+		if !n.AddressesOnly && nic.MAC != "" {
+			inst.NetworkInterfaces = append(inst.NetworkInterfaces, n.toInstanceEC2(vm, nic))
+		}
+		if n.isPublic(nic.Network) {
+			if inst.PublicIpAddress == nil {
+				inst.PublicIpAddress = aws.String(nic.IP)
+			}
+			continue
+		}
+		if inst.PrivateIpAddress == nil || nic.Primary {
+			inst.PrivateIpAddress = aws.String(nic.IP)
+			if n.AddressesOnly {
+				continue
+			}
+			inst.SubnetId = aws.String(subnetID(nic.Network))
+			if vpc, found := n.Vpcs[nic.Network]; found {
+				inst.VpcId = aws.String(vpc)
+			}
+		}
+	}
+}
+
+// listAllNICs returns the NICs of all the account instances or, when
+// instance IDs are given, only those of these instances
+func listAllNICs(client *tritoncompute.ComputeClient, region string, instanceIDs []string) ([]*instanceNIC, error) {
+	vms, err := client.Instances().List(context.Background(), &tritoncompute.ListInstancesInput{})
+	if err != nil {
+		log.Printf("[ERROR] list vms error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton compute instances: %w", err)
+	}
+	if len(instanceIDs) > 0 {
+		wanted := vms[:0]
+		for _, vm := range vms {
+			if containsString(instanceIDs, vm.ID) {
+				wanted = append(wanted, vm)
+			}
+		}
+		vms = wanted
+	}
+
+	byInstance, err := listInstancesNICs(client, region, vms)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*instanceNIC
+	for _, vm := range vms {
+		for _, nic := range byInstance[vm.ID] {
+			result = append(result, &instanceNIC{Instance: vm, NIC: nic})
+		}
+	}
+	return result, nil
+}
+
+// findInstanceNIC returns the NIC with the given MAC address, or nil when no
+// instance of the account has it. Without VMAPI, the NICs are listed one
+// instance at a time until found, starting with the instances with several
+// addresses, which have the NICs that can be detached.
+func findInstanceNIC(client *tritoncompute.ComputeClient, region string, mac string) (*instanceNIC, error) {
+	vms, err := client.Instances().List(context.Background(), &tritoncompute.ListInstancesInput{})
+	if err != nil {
+		log.Printf("[ERROR] list vms error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton compute instances: %w", err)
+	}
+
+	find := func(vms []*tritoncompute.Instance, byInstance map[string][]*api.NIC) *instanceNIC {
+		for _, vm := range vms {
+			for _, nic := range byInstance[vm.ID] {
+				if strings.EqualFold(nic.MAC, mac) {
+					return &instanceNIC{Instance: vm, NIC: nic}
+				}
+			}
+		}
+		return nil
+	}
+
+	vmapi, err := tritonutils.GetVmapiClient(region)
+	if err == nil {
+		ids := make([]string, 0, len(vms))
+		for _, vm := range vms {
+			ids = append(ids, vm.ID)
+		}
+		byInstance, err := listVmapiNICs(vmapi, ids)
+		if err != nil {
+			return nil, err
+		}
+		return find(vms, byInstance), nil
+	}
+	if !errors.Is(err, api.ErrMissingURL) {
+		return nil, fmt.Errorf("Unable to create VMAPI client: %w", err)
+	}
+
+	sort.SliceStable(vms, func(i, j int) bool {
+		return len(vms[i].IPs) > 1 && len(vms[j].IPs) <= 1
+	})
+	for _, vm := range vms {
+		nics, err := listInstanceNICs(client, region, vm.ID)
+		if err != nil {
+			return nil, err
+		}
+		if found := find([]*tritoncompute.Instance{vm}, map[string][]*api.NIC{vm.ID: nics}); found != nil {
+			return found, nil
+		}
+	}
+	return nil, nil
+}
+
+// networkInterfaceFiltersMatch tells if the interface satisfies the request
+// filters
+func networkInterfaceFiltersMatch(filters map[string][]string, eni *ec2.NetworkInterface) bool {
+	instanceID, deviceIndex := "", ""
+	if eni.Attachment != nil {
+		instanceID = *eni.Attachment.InstanceId
+		deviceIndex = strconv.FormatInt(*eni.Attachment.DeviceIndex, 10)
+	}
+	return filterMatch(filters, "network-interface-id", *eni.NetworkInterfaceId) &&
+		filterMatch(filters, "subnet-id", *eni.SubnetId) &&
+		filterMatch(filters, "vpc-id", aws.StringValue(eni.VpcId)) &&
+		filterMatch(filters, "status", *eni.Status) &&
+		filterMatch(filters, "mac-address", aws.StringValue(eni.MacAddress)) &&
+		filterMatch(filters, "private-ip-address", aws.StringValue(eni.PrivateIpAddress)) &&
+		filterMatch(filters, "attachment.instance-id", instanceID) &&
+		filterMatch(filters, "attachment.device-index", deviceIndex)
+}
+
+// DescribeNetworkInterfaces lists the NICs of the account instances, and
+// the detached interfaces kept by the shim
+func DescribeNetworkInterfaces(c *gin.Context) {
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	interfaces, err := loadNetworkInterfaces(c, account.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Only the NICs of the filtered instances are needed
+	ec2Filters := filters(c)
+	nics, err := listAllNICs(client, regionName(c), ec2Filters["attachment.instance-id"])
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var enis []*ec2.NetworkInterface
+	for _, nic := range nics {
+		enis = append(enis, interfaces.toEC2(nic.Instance, nic.NIC))
+	}
+	for _, record := range interfaces.Records {
+		if record.InstanceID == "" {
+			enis = append(enis, interfaces.recordToEC2(record))
+		}
+	}
+
+	wanted := paramList(c, "NetworkInterfaceId")
+	for _, id := range wanted {
+		found := false
+		for _, eni := range enis {
+			found = found || *eni.NetworkInterfaceId == id
+		}
+		if !found {
+			abortWithNotFound(c, "InvalidNetworkInterfaceID.NotFound", id)
+			return
+		}
+	}
+
+	ec2Output := ec2.DescribeNetworkInterfacesOutput{}
+	for _, eni := range enis {
+		if len(wanted) > 0 && !containsString(wanted, *eni.NetworkInterfaceId) {
+			continue
+		}
+		if networkInterfaceFiltersMatch(ec2Filters, eni) {
+			ec2Output.NetworkInterfaces = append(ec2Output.NetworkInterfaces, eni)
+		}
+	}
+
+	writeResponse(c, "DescribeNetworkInterfaces", ec2Output)
+}
+
+// CreateNetworkInterface records a network interface for the given subnet,
+// which gets a NIC once attached to an instance
+func CreateNetworkInterface(c *gin.Context) {
+	id := param(c, "SubnetId")
+	if id == "" {
+		abortWithMissingParameter(c, "SubnetId")
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	fabric, err := findFabricNetwork(client, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if fabric == nil {
+		abortWithNotFound(c, "InvalidSubnetID.NotFound", id)
+		return
+	}
+
+	record := &networkInterfaceRecord{
+		ID:          newResourceID("eni"),
+		Owner:       account.ID,
+		Region:      regionName(c),
+		NetworkID:   fabric.Network.Id,
+		Description: param(c, "Description"),
+	}
+	if err := db.Put(networkInterfacesCollection, record.key(), record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save network interface: %w", err))
+		return
+	}
+
+	interfaces, err := loadNetworkInterfaces(c, account.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ec2Output := ec2.CreateNetworkInterfaceOutput{
+		NetworkInterface: interfaces.recordToEC2(record),
+	}
+
+	writeResponse(c, "CreateNetworkInterface", ec2Output)
+}
+
+// DeleteNetworkInterface deletes a detached network interface
+func DeleteNetworkInterface(c *gin.Context) {
+	id := param(c, "NetworkInterfaceId")
+	if id == "" {
+		abortWithMissingParameter(c, "NetworkInterfaceId")
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	var record networkInterfaceRecord
+	err = db.Get(networkInterfacesCollection, ownedKey(regionName(c), account.ID, id), &record)
+	if err == store.ErrNotFound {
+		// Interfaces not recorded by the shim are always attached
+		if _, ok := parseMacID("eni", id); ok {
+			abortWithInterfaceInUse(c, id)
+			return
+		}
+		abortWithNotFound(c, "InvalidNetworkInterfaceID.NotFound", id)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to load network interface: %w", err))
+		return
+	}
+	if record.InstanceID != "" {
+		abortWithInterfaceInUse(c, id)
+		return
+	}
+
+	if err := db.Delete(networkInterfacesCollection, record.key()); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to delete network interface: %w", err))
+		return
+	}
+
+	writeResponse(c, "DeleteNetworkInterface", returnOutput{Return: aws.Bool(true)})
+}
+
+// abortWithInterfaceInUse is used when the network interface must be
+// detached first
+func abortWithInterfaceInUse(c *gin.Context, id string) {
+	abortWithXMLError(c, http.StatusBadRequest, shimerrors.ResponseError("InvalidNetworkInterface.InUse",
+		fmt.Sprintf("Interface: [%s] in use.", id), requestID(c)))
+}
+
+// AttachNetworkInterface adds a NIC on the interface network to the
+// instance. Triton reboots the instance to add the NIC. The device index is
+// decided by Triton, being the next free one.
+func AttachNetworkInterface(c *gin.Context) {
+	id := param(c, "NetworkInterfaceId")
+	if id == "" {
+		abortWithMissingParameter(c, "NetworkInterfaceId")
+		return
+	}
+	instanceID := param(c, "InstanceId")
+	if instanceID == "" {
+		abortWithMissingParameter(c, "InstanceId")
+		return
+	}
+	if param(c, "DeviceIndex") == "" {
+		abortWithMissingParameter(c, "DeviceIndex")
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	var record networkInterfaceRecord
+	err = db.Get(networkInterfacesCollection, ownedKey(regionName(c), account.ID, id), &record)
+	if err == store.ErrNotFound {
+		if _, ok := parseMacID("eni", id); ok {
+			abortWithInterfaceInUse(c, id)
+			return
+		}
+		abortWithNotFound(c, "InvalidNetworkInterfaceID.NotFound", id)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to load network interface: %w", err))
+		return
+	}
+	if record.InstanceID != "" {
+		abortWithInterfaceInUse(c, id)
+		return
+	}
+
+	if getInstance(c, client, instanceID) == nil {
+		return
+	}
+
+	nic, err := client.Instances().AddNIC(context.Background(), &tritoncompute.AddNICInput{
+		InstanceID: instanceID,
+		Network:    record.NetworkID,
+	})
+	if err != nil {
+		log.Printf("[ERROR] add vm nic error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to add triton compute instance nic: %w", err))
+		return
+	}
+
+	record.InstanceID = instanceID
+	record.MAC = nic.MAC
+	if err := db.Put(networkInterfacesCollection, record.key(), &record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save network interface: %w", err))
+		return
+	}
+
+	ec2Output := ec2.AttachNetworkInterfaceOutput{
+		AttachmentId: aws.String(macID("eni-attach", nic.MAC)),
+	}
+
+	writeResponse(c, "AttachNetworkInterface", ec2Output)
+}
+
+// DetachNetworkInterface removes a NIC from its instance. The primary NIC
+// cannot be detached. The interface is kept by the shim, so it can be
+// attached again, although it will get a new MAC address.
+func DetachNetworkInterface(c *gin.Context) {
+	attachmentID := param(c, "AttachmentId")
+	if attachmentID == "" {
+		abortWithMissingParameter(c, "AttachmentId")
+		return
+	}
+	mac, ok := parseMacID("eni-attach", attachmentID)
+	if !ok {
+		abortWithNotFound(c, "InvalidAttachmentID.NotFound", attachmentID)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	interfaces, err := loadNetworkInterfaces(c, account.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	found, err := findInstanceNIC(client, regionName(c), mac)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if found == nil {
+		abortWithNotFound(c, "InvalidAttachmentID.NotFound", attachmentID)
+		return
+	}
+	if nicDeviceIndex(found.NIC) == 0 || found.NIC.Primary {
+		abortWithXMLError(c, http.StatusBadRequest, shimerrors.ResponseError("OperationNotPermitted",
+			"The network interface at device index 0 cannot be detached.", requestID(c)))
+		return
+	}
+
+	err = client.Instances().RemoveNIC(context.Background(), &tritoncompute.RemoveNICInput{
+		InstanceID: found.Instance.ID,
+		MAC:        mac,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithNotFound(c, "InvalidAttachmentID.NotFound", attachmentID)
+			return
+		}
+		log.Printf("[ERROR] remove vm nic error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to remove triton compute instance nic: %w", err))
+		return
+	}
+
+	record := interfaces.record(found.Instance.ID, mac)
+	if record == nil {
+		record = &networkInterfaceRecord{
+			ID:        macID("eni", mac),
+			Owner:     account.ID,
+			Region:    regionName(c),
+			NetworkID: found.NIC.Network,
+		}
+	}
+	record.InstanceID = ""
+	record.MAC = ""
+	if err := db.Put(networkInterfacesCollection, record.key(), record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save network interface: %w", err))
+		return
+	}
+
+	writeResponse(c, "DetachNetworkInterface", returnOutput{Return: aws.Bool(true)})
+}
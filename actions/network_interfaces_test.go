@@ -0,0 +1,93 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSDescribeNetworkInterfaces(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		instances, err := ec2Svc.DescribeInstances(nil)
+		if err != nil {
+			t.Errorf("describe instances error %v", err)
+			return
+		}
+
+		result, err := ec2Svc.DescribeNetworkInterfaces(nil)
+		if err != nil {
+			t.Errorf("describe network interfaces error %v", err)
+			return
+		}
+
+		for _, res := range instances.Reservations {
+			for _, inst := range res.Instances {
+				if *inst.State.Name != ec2.InstanceStateNameRunning {
+					continue
+				}
+				if inst.PrivateIpAddress == nil && inst.PublicIpAddress == nil {
+					t.Errorf("instance %s has no address", *inst.InstanceId)
+				}
+				if len(inst.NetworkInterfaces) == 0 {
+					t.Errorf("instance %s has no network interfaces", *inst.InstanceId)
+				}
+				for _, eni := range inst.NetworkInterfaces {
+					if eni.MacAddress == nil || eni.Attachment == nil {
+						t.Errorf("network interface %s lacks mac address or attachment",
+							*eni.NetworkInterfaceId)
+					}
+				}
+			}
+		}
+
+		for _, eni := range result.NetworkInterfaces {
+			if eni.SubnetId == nil {
+				t.Errorf("network interface %s has no subnet", *eni.NetworkInterfaceId)
+			}
+		}
+
+		// Filtering by instance only returns the interfaces of that instance
+		for _, res := range instances.Reservations {
+			for _, inst := range res.Instances {
+				filtered, err := ec2Svc.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+					Filters: []*ec2.Filter{{
+						Name:   aws.String("attachment.instance-id"),
+						Values: []*string{inst.InstanceId},
+					}},
+				})
+				if err != nil {
+					t.Errorf("describe network interfaces by instance error %v", err)
+					return
+				}
+				if len(filtered.NetworkInterfaces) != len(inst.NetworkInterfaces) {
+					t.Errorf("instance %s has %d network interfaces, got %d", *inst.InstanceId,
+						len(inst.NetworkInterfaces), len(filtered.NetworkInterfaces))
+				}
+				for _, eni := range filtered.NetworkInterfaces {
+					if *eni.Attachment.InstanceId != *inst.InstanceId {
+						t.Errorf("network interface %s does not belong to instance %s",
+							*eni.NetworkInterfaceId, *inst.InstanceId)
+					}
+				}
+			}
+		}
+
+		_, err = ec2Svc.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+			NetworkInterfaceIds: []*string{aws.String("eni-000000000000")},
+		})
+		if err == nil {
+			t.Errorf("describe network interfaces should fail for unknown interfaces")
+		}
+	})
+}
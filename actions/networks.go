@@ -0,0 +1,105 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	tritonnetwork "github.com/joyent/triton-go/v2/network"
+)
+
+// ErrNoPublicNetwork There is no public network to get public IPs from
+var ErrNoPublicNetwork = errors.New("no public network available")
+
+// publicNetwork returns the network where instances get their public IPs.
+// It is the network given by TRITON_SHIM_PUBLIC_NETWORK, as an UUID or a
+// name, or the first public network available to the account.
+func publicNetwork(client *tritonnetwork.NetworkClient) (*tritonnetwork.Network, error) {
+	networks, err := client.List(context.Background(), &tritonnetwork.ListInput{})
+	if err != nil {
+		log.Printf("[ERROR] list networks error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton networks: %w", err)
+	}
+
+	configured := os.Getenv("TRITON_SHIM_PUBLIC_NETWORK")
+	for _, network := range networks {
+		if configured != "" {
+			if network.Id == configured || network.Name == configured {
+				return network, nil
+			}
+			continue
+		}
+		if network.Public {
+			return network, nil
+		}
+	}
+
+	return nil, ErrNoPublicNetwork
+}
+
+// listPublicNetworks returns the IDs of the public networks available to the
+// account
+func listPublicNetworks(client *tritonnetwork.NetworkClient) (map[string]bool, error) {
+	networks, err := client.List(context.Background(), &tritonnetwork.ListInput{})
+	if err != nil {
+		log.Printf("[ERROR] list networks error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton networks: %w", err)
+	}
+
+	public := make(map[string]bool)
+	for _, network := range networks {
+		if network.Public {
+			public[network.Id] = true
+		}
+	}
+	return public, nil
+}
+
+// ipToUint32 converts an IPv4 address to a number, for address arithmetic
+func ipToUint32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip4)
+}
+
+// uint32ToIP converts a number back to an IPv4 address
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// ipRangeSize returns the number of addresses between start and end, both
+// included, or zero when they are not valid IPv4 addresses
+func ipRangeSize(start string, end string) int64 {
+	startIP, endIP := net.ParseIP(start), net.ParseIP(end)
+	if startIP.To4() == nil || endIP.To4() == nil {
+		return 0
+	}
+	first, last := ipToUint32(startIP), ipToUint32(endIP)
+	if last < first {
+		return 0
+	}
+	return int64(last-first) + 1
+}
+
+// maskPrefix returns the prefix length of a network, like 16 for /16
+func maskPrefix(ipNet *net.IPNet) int {
+	prefix, _ := ipNet.Mask.Size()
+	return prefix
+}
@@ -0,0 +1,181 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EC2 Query API parameters can be sent either into the URL query string for
+// GET requests or into the form encoded body for POST requests.
+
+// param returns the value of the given request parameter
+func param(c *gin.Context, name string) string {
+	if value, found := c.GetPostForm(name); found {
+		return value
+	}
+	return c.Query(name)
+}
+
+// params returns all the request parameters, no matter if they were sent
+// into the query string or the request body
+func params(c *gin.Context) map[string]string {
+	result := make(map[string]string)
+	for name, values := range c.Request.URL.Query() {
+		if len(values) > 0 {
+			result[name] = values[0]
+		}
+	}
+	// Make sure the body has been parsed before we look at PostForm
+	c.GetPostForm("Action")
+	for name, values := range c.Request.PostForm {
+		if len(values) > 0 {
+			result[name] = values[0]
+		}
+	}
+	return result
+}
+
+// paramIndex returns the N and the suffix of a "prefix.N" or
+// "prefix.N.suffix" parameter name, or -1 when the name does not match
+func paramIndex(name string, prefix string) (int, string) {
+	if !strings.HasPrefix(name, prefix+".") {
+		return -1, ""
+	}
+	rest := strings.TrimPrefix(name, prefix+".")
+	suffix := ""
+	if dot := strings.Index(rest, "."); dot >= 0 {
+		suffix = rest[dot+1:]
+		rest = rest[:dot]
+	}
+	n, err := strconv.Atoi(rest)
+	if err != nil || n < 1 {
+		return -1, ""
+	}
+	return n, suffix
+}
+
+// paramList returns the values of a list parameter, sent using numbered
+// names like InstanceId.1, InstanceId.2, ..., sorted by their index
+func paramList(c *gin.Context, prefix string) []string {
+	return indexedValues(params(c), prefix)
+}
+
+// paramStructList returns the members of a list of structures, sent using
+// names like Filter.1.Name, Filter.1.Value.1, ..., as one map per member
+// with the member parameter names as keys, sorted by their index
+func paramStructList(c *gin.Context, prefix string) []map[string]string {
+	return indexedStructs(params(c), prefix)
+}
+
+// indexedStructs returns the members of the "prefix.N.*" entries of the
+// given parameters map, sorted by N. It is also used to get lists of
+// structures nested into other structures, like the Tag.N list of a
+// TagSpecification
+func indexedStructs(values map[string]string, prefix string) []map[string]string {
+	indexed := make(map[int]map[string]string)
+	for name, value := range values {
+		n, suffix := paramIndex(name, prefix)
+		if n < 1 || suffix == "" {
+			continue
+		}
+		if indexed[n] == nil {
+			indexed[n] = make(map[string]string)
+		}
+		indexed[n][suffix] = value
+	}
+
+	indexes := make([]int, 0, len(indexed))
+	for n := range indexed {
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+
+	members := make([]map[string]string, 0, len(indexes))
+	for _, n := range indexes {
+		members = append(members, indexed[n])
+	}
+	return members
+}
+
+// indexedValues returns the values of the "prefix.N" entries of the given
+// parameters map, sorted by N. It is also used to get lists nested into the
+// members returned by paramStructList, like the Value.N list of a Filter
+func indexedValues(values map[string]string, prefix string) []string {
+	indexed := make(map[int]string)
+	for name, value := range values {
+		if n, suffix := paramIndex(name, prefix); n > 0 && suffix == "" {
+			indexed[n] = value
+		}
+	}
+
+	indexes := make([]int, 0, len(indexed))
+	for n := range indexed {
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+
+	result := make([]string, 0, len(indexes))
+	for _, n := range indexes {
+		result = append(result, indexed[n])
+	}
+	return result
+}
+
+// filters returns the request filters (Filter.N.Name and Filter.N.Value.M)
+// as a map of filter names to their accepted values
+func filters(c *gin.Context) map[string][]string {
+	result := make(map[string][]string)
+	for _, member := range paramStructList(c, "Filter") {
+		name := member["Name"]
+		if name == "" {
+			continue
+		}
+		result[name] = append(result[name], indexedValues(member, "Value")...)
+	}
+	return result
+}
+
+// filterMatch tells if the value is accepted by the named request filter,
+// which is always the case when the filter was not sent
+func filterMatch(filters map[string][]string, name string, value string) bool {
+	values, found := filters[name]
+	return !found || containsString(values, value)
+}
+
+// containsString tells if value is one of the given values
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// tagSpecifications returns the tags requested into TagSpecification.N for
+// the given resource type
+func tagSpecifications(c *gin.Context, resourceType string) map[string]string {
+	tags := make(map[string]string)
+	for _, spec := range paramStructList(c, "TagSpecification") {
+		if spec["ResourceType"] != resourceType {
+			continue
+		}
+		for _, tag := range indexedStructs(spec, "Tag") {
+			if tag["Key"] != "" {
+				tags[tag["Key"]] = tag["Value"]
+			}
+		}
+	}
+	return tags
+}
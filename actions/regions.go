@@ -0,0 +1,136 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// optInNotRequired is the opt-in status of every region and zone
+const optInNotRequired = "opt-in-not-required"
+
+// listRegions returns the names of the regions. They are the ones of the
+// regions file when there is one, or the CloudAPI datacenters otherwise.
+func listRegions(region string) ([]string, error) {
+	regions, err := tritonutils.LoadRegionsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if regions != nil {
+		for name := range regions {
+			names = append(names, name)
+		}
+	} else {
+		client, err := tritonutils.GetTritonComputeClient(region, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create triton compute client: %w", err)
+		}
+
+		datacenters, err := client.Datacenters().List(context.Background(),
+			&tritoncompute.ListDataCentersInput{})
+		if err != nil {
+			log.Printf("[ERROR] list datacenters error: %v\n", err)
+			return nil, fmt.Errorf("Unable to list triton datacenters: %w", err)
+		}
+		for _, dc := range datacenters {
+			names = append(names, dc.Name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// DescribeRegions lists the Triton datacenters as EC2 regions. All of them
+// are served by this shim endpoint.
+func DescribeRegions(c *gin.Context) {
+	names, err := listRegions(regionName(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	wanted := paramList(c, "RegionName")
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeRegionsOutput{}
+
+	for _, name := range names {
+		if len(wanted) > 0 && !containsString(wanted, name) {
+			continue
+		}
+		if !filterMatch(ec2Filters, "region-name", name) ||
+			!filterMatch(ec2Filters, "endpoint", c.Request.Host) ||
+			!filterMatch(ec2Filters, "opt-in-status", optInNotRequired) {
+			continue
+		}
+		ec2Output.Regions = append(ec2Output.Regions, &ec2.Region{
+			RegionName:  aws.String(name),
+			Endpoint:    aws.String(c.Request.Host),
+			OptInStatus: aws.String(optInNotRequired),
+		})
+	}
+
+	writeResponse(c, "DescribeRegions", ec2Output)
+}
+
+// DescribeAvailabilityZones lists the availability zones of the region the
+// request was signed for (see availability_zones.go)
+func DescribeAvailabilityZones(c *gin.Context) {
+	region := regionName(c)
+	zones, err := listAvailabilityZones(region)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	names, ids := paramList(c, "ZoneName"), paramList(c, "ZoneId")
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeAvailabilityZonesOutput{}
+
+	for _, zone := range zones {
+		if len(names) > 0 && !containsString(names, zone.Name) {
+			continue
+		}
+		if len(ids) > 0 && !containsString(ids, zone.ID) {
+			continue
+		}
+		if !filterMatch(ec2Filters, "zone-name", zone.Name) ||
+			!filterMatch(ec2Filters, "zone-id", zone.ID) ||
+			!filterMatch(ec2Filters, "region-name", region) ||
+			!filterMatch(ec2Filters, "state", ec2.AvailabilityZoneStateAvailable) ||
+			!filterMatch(ec2Filters, "zone-type", "availability-zone") {
+			continue
+		}
+		ec2Output.AvailabilityZones = append(ec2Output.AvailabilityZones, &ec2.AvailabilityZone{
+			ZoneName:           aws.String(zone.Name),
+			ZoneId:             aws.String(zone.ID),
+			ZoneType:           aws.String("availability-zone"),
+			State:              aws.String(ec2.AvailabilityZoneStateAvailable),
+			OptInStatus:        aws.String(optInNotRequired),
+			RegionName:         aws.String(region),
+			GroupName:          aws.String(region),
+			NetworkBorderGroup: aws.String(region),
+		})
+	}
+
+	writeResponse(c, "DescribeAvailabilityZones", ec2Output)
+}
@@ -0,0 +1,51 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSDescribeRegions(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		result, err := ec2Svc.DescribeRegions(nil)
+		if err != nil {
+			t.Errorf("describe regions error %v", err)
+			return
+		}
+
+		if len(result.Regions) == 0 {
+			t.Errorf("describe regions did not return any results")
+		}
+	})
+}
+
+func TestAccAWSDescribeAvailabilityZones(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		result, err := ec2Svc.DescribeAvailabilityZones(nil)
+		if err != nil {
+			t.Errorf("describe availability zones error %v", err)
+			return
+		}
+
+		if len(result.AvailabilityZones) == 0 {
+			t.Errorf("describe availability zones did not return any results")
+		}
+
+		for _, zone := range result.AvailabilityZones {
+			if *zone.ZoneId == "" || *zone.State != ec2.AvailabilityZoneStateAvailable {
+				t.Errorf("unexpected availability zone %v", zone)
+			}
+		}
+	})
+}
@@ -0,0 +1,376 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	"github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Replacing the root volume of an instance with one of its snapshots maps to
+// booting the machine from the snapshot, which rolls the whole machine back
+// to it. CloudAPI only starts stopped machines from snapshots, so running
+// instances are stopped first, like EC2 reboots them.
+
+// replaceRootVolumeTasksCollection is the store collection for the
+// CreateReplaceRootVolumeTask tasks, which have no Triton equivalent
+const replaceRootVolumeTasksCollection = "replace-root-volume-tasks"
+
+// replaceRootVolumeResourceType is the TagSpecification resource type of
+// the tasks
+const replaceRootVolumeResourceType = "replace-root-volume-task"
+
+// Replace root volume task states
+const (
+	replaceRootVolumePending    = "pending"
+	replaceRootVolumeInProgress = "in-progress"
+	replaceRootVolumeSucceeded  = "succeeded"
+	replaceRootVolumeFailed     = "failed"
+)
+
+// instanceStateTimeout is how long a task waits for its instance to reach
+// the next state, and instanceStateInterval how often it checks it
+const (
+	instanceStateTimeout  = 10 * time.Minute
+	instanceStateInterval = 5 * time.Second
+)
+
+// replaceRootVolumeTask is the shim record of a CreateReplaceRootVolumeTask
+// request
+type replaceRootVolumeTask struct {
+	ID            string            `json:"id"`
+	Owner         string            `json:"owner"`
+	Region        string            `json:"region"`
+	InstanceID    string            `json:"instance_id"`
+	SnapshotID    string            `json:"snapshot_id"`
+	State         string            `json:"state"`
+	StatusMessage string            `json:"status_message,omitempty"`
+	StartTime     time.Time         `json:"start_time"`
+	CompleteTime  time.Time         `json:"complete_time,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// key returns the store key of the task
+func (t *replaceRootVolumeTask) key() string {
+	return ownedKey(t.Region, t.Owner, t.ID)
+}
+
+// The version of the AWS SDK we use does not know about replace root volume
+// tasks yet, so their outputs are defined here.
+
+// ec2ReplaceRootVolumeTask is an EC2 ReplaceRootVolumeTask
+type ec2ReplaceRootVolumeTask struct {
+	_ struct{} `type:"structure"`
+
+	CompleteTime            *string    `locationName:"completeTime" type:"string"`
+	InstanceId              *string    `locationName:"instanceId" type:"string"`
+	ReplaceRootVolumeTaskId *string    `locationName:"replaceRootVolumeTaskId" type:"string"`
+	SnapshotId              *string    `locationName:"snapshotId" type:"string"`
+	StartTime               *string    `locationName:"startTime" type:"string"`
+	Tags                    []*ec2.Tag `locationName:"tagSet" locationNameList:"item" type:"list"`
+	TaskState               *string    `locationName:"taskState" type:"string"`
+}
+
+// createReplaceRootVolumeTaskOutput is the CreateReplaceRootVolumeTask
+// output
+type createReplaceRootVolumeTaskOutput struct {
+	_ struct{} `type:"structure"`
+
+	ReplaceRootVolumeTask *ec2ReplaceRootVolumeTask `locationName:"replaceRootVolumeTask" type:"structure"`
+}
+
+// describeReplaceRootVolumeTasksOutput is the
+// DescribeReplaceRootVolumeTasks output
+type describeReplaceRootVolumeTasksOutput struct {
+	_ struct{} `type:"structure"`
+
+	ReplaceRootVolumeTasks []*ec2ReplaceRootVolumeTask `locationName:"replaceRootVolumeTaskSet" locationNameList:"item" type:"list"`
+}
+
+func (t *replaceRootVolumeTask) toEC2() *ec2ReplaceRootVolumeTask {
+	task := &ec2ReplaceRootVolumeTask{
+		ReplaceRootVolumeTaskId: aws.String(t.ID),
+		InstanceId:              aws.String(t.InstanceID),
+		SnapshotId:              aws.String(t.SnapshotID),
+		TaskState:               aws.String(t.State),
+		StartTime:               aws.String(t.StartTime.UTC().Format(time.RFC3339)),
+		Tags:                    ec2Tags(t.Tags),
+	}
+	if !t.CompleteTime.IsZero() {
+		task.CompleteTime = aws.String(t.CompleteTime.UTC().Format(time.RFC3339))
+	}
+	return task
+}
+
+// replaceRootVolumeFiltersMatch tells if the task satisfies the request
+// filters
+func replaceRootVolumeFiltersMatch(filters map[string][]string, task *replaceRootVolumeTask) bool {
+	return filterMatch(filters, "instance-id", task.InstanceID) &&
+		tagFiltersMatch(filters, task.Tags)
+}
+
+// waitForInstanceState waits until the instance reaches the given state
+func waitForInstanceState(client *tritoncompute.ComputeClient, id string, state string) error {
+	deadline := time.Now().Add(instanceStateTimeout)
+	for {
+		vm, err := client.Instances().Get(context.Background(), &tritoncompute.GetInstanceInput{
+			ID: id,
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to get triton compute instance: %w", err)
+		}
+		if vm.State == state {
+			return nil
+		}
+		if vm.State == "failed" || vm.State == "deleted" {
+			return fmt.Errorf("Instance %s is %s", id, vm.State)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timeout waiting for instance %s to be %s", id, state)
+		}
+		time.Sleep(instanceStateInterval)
+	}
+}
+
+// restoreInstanceSnapshot stops the instance when needed, then boots it
+// from the snapshot
+func restoreInstanceSnapshot(client *tritoncompute.ComputeClient, task *replaceRootVolumeTask) error {
+	_, name, _ := parseSnapshotID(task.SnapshotID)
+
+	vm, err := client.Instances().Get(context.Background(), &tritoncompute.GetInstanceInput{
+		ID: task.InstanceID,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to get triton compute instance: %w", err)
+	}
+	if vm.State != "stopped" {
+		err := client.Instances().Stop(context.Background(), &tritoncompute.StopInstanceInput{
+			InstanceID: task.InstanceID,
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to stop triton compute instance: %w", err)
+		}
+		if err := waitForInstanceState(client, task.InstanceID, "stopped"); err != nil {
+			return err
+		}
+	}
+
+	err = client.Snapshots().StartMachine(context.Background(), &tritoncompute.StartMachineFromSnapshotInput{
+		MachineID: task.InstanceID,
+		Name:      name,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to start triton compute instance from snapshot: %w", err)
+	}
+	return waitForInstanceState(client, task.InstanceID, "running")
+}
+
+// runReplaceRootVolumeTask restores the instance and updates the task record
+// with the results. It is expected to run on its own goroutine, since the
+// instance has to be stopped and booted again.
+func runReplaceRootVolumeTask(db *store.Store, client *tritoncompute.ComputeClient, task *replaceRootVolumeTask) {
+	task.State = replaceRootVolumeInProgress
+	if err := db.Put(replaceRootVolumeTasksCollection, task.key(), task); err != nil {
+		log.Printf("[ERROR] save replace root volume task %s error: %v\n", task.ID, err)
+	}
+
+	if err := restoreInstanceSnapshot(client, task); err != nil {
+		log.Printf("[ERROR] replace root volume of vm %s error: %v\n", task.InstanceID, err)
+		task.State = replaceRootVolumeFailed
+		task.StatusMessage = err.Error()
+	} else {
+		task.State = replaceRootVolumeSucceeded
+	}
+	task.CompleteTime = time.Now().UTC()
+
+	if err := db.Put(replaceRootVolumeTasksCollection, task.key(), task); err != nil {
+		log.Printf("[ERROR] save replace root volume task %s error: %v\n", task.ID, err)
+	}
+}
+
+// CreateReplaceRootVolumeTask rolls an instance back to one of its
+// snapshots. Restoring instances to their launch state, without a snapshot,
+// is not supported.
+func CreateReplaceRootVolumeTask(c *gin.Context) {
+	instanceID := param(c, "InstanceId")
+	if instanceID == "" {
+		abortWithMissingParameter(c, "InstanceId")
+		return
+	}
+	snapshotID := param(c, "SnapshotId")
+	if snapshotID == "" {
+		abortWithMissingParameter(c, "SnapshotId")
+		return
+	}
+	machineID, name, ok := parseSnapshotID(snapshotID)
+	if !ok {
+		abortWithNotFound(c, "InvalidSnapshot.NotFound", snapshotID)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	vm := getInstance(c, client, instanceID)
+	if vm == nil {
+		return
+	}
+	if machineID != vm.ID {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidParameterCombination",
+			fmt.Sprintf("The snapshot %s was not taken from the instance %s", snapshotID, instanceID),
+			requestID(c)))
+		return
+	}
+
+	snapshot, err := client.Snapshots().Get(context.Background(), &tritoncompute.GetSnapshotInput{
+		MachineID: vm.ID,
+		Name:      name,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithNotFound(c, "InvalidSnapshot.NotFound", snapshotID)
+			return
+		}
+		log.Printf("[ERROR] get snapshot error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to get triton snapshot: %w", err))
+		return
+	}
+	if snapshotState(snapshot.State) != ec2.SnapshotStateCompleted {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("IncorrectState",
+			fmt.Sprintf("The snapshot %s is not completed", snapshotID), requestID(c)))
+		return
+	}
+
+	for _, key := range db.Keys(replaceRootVolumeTasksCollection) {
+		var other replaceRootVolumeTask
+		if err := db.Get(replaceRootVolumeTasksCollection, key, &other); err != nil {
+			continue
+		}
+		if other.InstanceID == vm.ID &&
+			(other.State == replaceRootVolumePending || other.State == replaceRootVolumeInProgress) {
+			abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("IncorrectState",
+				fmt.Sprintf("The instance %s already has a replace root volume task in progress",
+					instanceID), requestID(c)))
+			return
+		}
+	}
+
+	task := &replaceRootVolumeTask{
+		ID:         newResourceID("replacevol"),
+		Owner:      account.ID,
+		Region:     regionName(c),
+		InstanceID: vm.ID,
+		SnapshotID: snapshotID,
+		State:      replaceRootVolumePending,
+		StartTime:  time.Now().UTC(),
+		Tags:       tagSpecifications(c, replaceRootVolumeResourceType),
+	}
+
+	if err := db.Put(replaceRootVolumeTasksCollection, task.key(), task); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save replace root volume task: %w", err))
+		return
+	}
+
+	log.Printf("[DEBUG] restoring vm %s from snapshot %s\n", vm.ID, name)
+
+	ec2Output := createReplaceRootVolumeTaskOutput{
+		ReplaceRootVolumeTask: task.toEC2(),
+	}
+
+	go runReplaceRootVolumeTask(db, client, task)
+
+	writeResponse(c, "CreateReplaceRootVolumeTask", ec2Output)
+}
+
+// DescribeReplaceRootVolumeTasks lists the replace root volume tasks
+// recorded by the shim for the current account
+func DescribeReplaceRootVolumeTasks(c *gin.Context) {
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	taskIDs := paramList(c, "ReplaceRootVolumeTaskId")
+	listAll := len(taskIDs) == 0
+	if listAll {
+		taskIDs = db.Keys(replaceRootVolumeTasksCollection)
+	}
+
+	ec2Filters := filters(c)
+	ec2Output := describeReplaceRootVolumeTasksOutput{}
+
+	for _, taskID := range taskIDs {
+		key := taskID
+		if !listAll {
+			key = ownedKey(regionName(c), account.ID, taskID)
+		}
+		var task replaceRootVolumeTask
+		err := db.Get(replaceRootVolumeTasksCollection, key, &task)
+		if err == nil && (task.Region != regionName(c) || task.Owner != account.ID) {
+			if listAll {
+				continue
+			}
+			err = store.ErrNotFound
+		}
+		if err == store.ErrNotFound {
+			abortWithNotFound(c, "InvalidReplaceRootVolumeTaskId.NotFound", taskID)
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to load replace root volume task: %w", err))
+			return
+		}
+		if replaceRootVolumeFiltersMatch(ec2Filters, &task) {
+			ec2Output.ReplaceRootVolumeTasks = append(ec2Output.ReplaceRootVolumeTasks, task.toEC2())
+		}
+	}
+
+	writeResponse(c, "DescribeReplaceRootVolumeTasks", ec2Output)
+}
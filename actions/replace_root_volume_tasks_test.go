@@ -0,0 +1,131 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+// The version of the AWS SDK we use does not know about replace root volume
+// tasks, so they are sent as raw operations.
+
+type replaceRootVolumeTask struct {
+	_ struct{} `type:"structure"`
+
+	InstanceId              *string `locationName:"instanceId" type:"string"`
+	ReplaceRootVolumeTaskId *string `locationName:"replaceRootVolumeTaskId" type:"string"`
+	SnapshotId              *string `locationName:"snapshotId" type:"string"`
+	TaskState               *string `locationName:"taskState" type:"string"`
+}
+
+type createReplaceRootVolumeTaskInput struct {
+	_ struct{} `type:"structure"`
+
+	InstanceId *string `type:"string"`
+	SnapshotId *string `type:"string"`
+}
+
+type createReplaceRootVolumeTaskOutput struct {
+	_ struct{} `type:"structure"`
+
+	ReplaceRootVolumeTask *replaceRootVolumeTask `locationName:"replaceRootVolumeTask" type:"structure"`
+}
+
+type describeReplaceRootVolumeTasksInput struct {
+	_ struct{} `type:"structure"`
+
+	ReplaceRootVolumeTaskIds []*string `locationName:"ReplaceRootVolumeTaskId" type:"list" flattened:"true"`
+}
+
+type describeReplaceRootVolumeTasksOutput struct {
+	_ struct{} `type:"structure"`
+
+	ReplaceRootVolumeTasks []*replaceRootVolumeTask `locationName:"replaceRootVolumeTaskSet" locationNameList:"item" type:"list"`
+}
+
+func sendEC2Operation(ec2Svc *ec2.EC2, name string, input interface{}, output interface{}) error {
+	op := &request.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	return ec2Svc.NewRequest(op, input, output).Send()
+}
+
+func TestAccAWSReplaceRootVolumeTasks(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		snapshots, err := ec2Svc.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+			OwnerIds: []*string{aws.String("self")},
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("status"),
+				Values: []*string{aws.String(ec2.SnapshotStateCompleted)},
+			}},
+		})
+		if err != nil {
+			t.Errorf("describe snapshots error %v", err)
+			return
+		}
+		if len(snapshots.Snapshots) == 0 {
+			t.Skip("no snapshot to restore")
+		}
+		snapshot := snapshots.Snapshots[0]
+
+		instances, err := ec2Svc.DescribeInstances(nil)
+		if err != nil {
+			t.Errorf("describe instances error %v", err)
+			return
+		}
+		var instanceID *string
+		for _, res := range instances.Reservations {
+			for _, inst := range res.Instances {
+				for _, mapping := range inst.BlockDeviceMappings {
+					if *mapping.Ebs.VolumeId == *snapshot.VolumeId {
+						instanceID = inst.InstanceId
+					}
+				}
+			}
+		}
+		if instanceID == nil {
+			t.Errorf("no instance for the snapshot volume %s", *snapshot.VolumeId)
+			return
+		}
+
+		created := &createReplaceRootVolumeTaskOutput{}
+		err = sendEC2Operation(ec2Svc, "CreateReplaceRootVolumeTask", &createReplaceRootVolumeTaskInput{
+			InstanceId: instanceID,
+			SnapshotId: snapshot.SnapshotId,
+		}, created)
+		if err != nil {
+			t.Errorf("create replace root volume task error %v", err)
+			return
+		}
+		if created.ReplaceRootVolumeTask == nil ||
+			*created.ReplaceRootVolumeTask.SnapshotId != *snapshot.SnapshotId {
+			t.Errorf("unexpected replace root volume task %v", created.ReplaceRootVolumeTask)
+			return
+		}
+
+		described := &describeReplaceRootVolumeTasksOutput{}
+		err = sendEC2Operation(ec2Svc, "DescribeReplaceRootVolumeTasks", &describeReplaceRootVolumeTasksInput{
+			ReplaceRootVolumeTaskIds: []*string{created.ReplaceRootVolumeTask.ReplaceRootVolumeTaskId},
+		}, described)
+		if err != nil {
+			t.Errorf("describe replace root volume tasks error %v", err)
+		} else if len(described.ReplaceRootVolumeTasks) != 1 ||
+			*described.ReplaceRootVolumeTasks[0].InstanceId != *instanceID {
+			t.Errorf("describe replace root volume tasks did not return the new task")
+		}
+	})
+}
@@ -0,0 +1,140 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/private/protocol/xml/xmlutil"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/joyent/triton-shim/errors"
+)
+
+// RequestIDKey is the gin.Context key holding the ID of the current request
+const RequestIDKey = "RequestID"
+
+const ec2Namespace = "http://ec2.amazonaws.com/doc/2016-11-15/"
+
+const route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+// jsonContentType is the content type of the JSON APIs, like EC2 Instance
+// Connect
+const jsonContentType = "application/x-amz-json-1.1"
+
+// returnOutput is the output of the EC2 actions which only tell if they
+// succeeded, like ModifyInstanceAttribute
+type returnOutput struct {
+	_ struct{} `type:"structure"`
+
+	Return *bool `locationName:"return" type:"boolean"`
+}
+
+func requestID(c *gin.Context) string {
+	return c.GetString(RequestIDKey)
+}
+
+// writeResponse sends the given AWS output struct as the XML response of the
+// provided EC2 action
+func writeResponse(c *gin.Context, action string, output interface{}) {
+	writeXMLResponse(c, action, ec2Namespace, output)
+}
+
+// writeXMLResponse sends the given AWS output struct as the XML response of
+// the provided action of the API with the given XML namespace
+func writeXMLResponse(c *gin.Context, action string, namespace string, output interface{}) {
+	// Generate the XML response.
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(fmt.Sprintf(`<%sResponse xmlns="%s">`, action, namespace) + "\n")
+
+	// Build the XML from the AWS struct.
+	err := xmlutil.BuildXML(output, xml.NewEncoder(&buf))
+	if err != nil {
+		log.Printf("[ERROR] xmlutil.BuildXML error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to translate %s response: %w", action, err))
+		return
+	}
+
+	buf.WriteString(fmt.Sprintf(`</%sResponse>`, action) + "\n")
+
+	// Send the XML response.
+	c.Header("content-type", "text/xml;charset=UTF-8")
+	c.Data(http.StatusOK, "", buf.Bytes())
+}
+
+// writeJSONResponse sends the given output struct as the JSON response of an
+// action of a JSON API
+func writeJSONResponse(c *gin.Context, output interface{}) {
+	body, err := json.Marshal(output)
+	if err != nil {
+		log.Printf("[ERROR] json.Marshal error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to translate JSON response: %w", err))
+		return
+	}
+
+	c.Header("x-amzn-RequestId", requestID(c))
+	c.Data(http.StatusOK, jsonContentType, body)
+}
+
+// abortWithXMLError sends the given error as the XML response and stops
+// processing the request
+func abortWithXMLError(c *gin.Context, status int, xmlErr *errors.XMLErrorResponse) {
+	c.XML(status, xmlErr)
+	c.Abort()
+}
+
+// abortWithRestXMLError sends the given error as the XML response of a REST
+// API, like Route 53, and stops processing the request
+func abortWithRestXMLError(c *gin.Context, status int, code string, message string) {
+	c.Header("x-amzn-RequestId", requestID(c))
+	c.XML(status, errors.RestXMLError(code, message, requestID(c)))
+	c.Abort()
+}
+
+// abortWithJSONError sends the given error as the JSON response of a JSON
+// API and stops processing the request
+func abortWithJSONError(c *gin.Context, status int, code string, message string) {
+	body, _ := json.Marshal(errors.JSONError(code, message))
+	c.Header("x-amzn-RequestId", requestID(c))
+	c.Data(status, jsonContentType, body)
+	c.Abort()
+}
+
+// abortWithMissingParameter is used when a required parameter is missing
+func abortWithMissingParameter(c *gin.Context, name string) {
+	abortWithXMLError(c, http.StatusBadRequest,
+		errors.MissingParameterError(name, requestID(c)))
+}
+
+// abortWithInvalidParameter is used when a parameter has an invalid value
+func abortWithInvalidParameter(c *gin.Context, name string, value string) {
+	abortWithXMLError(c, http.StatusBadRequest,
+		errors.InvalidParameterValueError(name, value, requestID(c)))
+}
+
+// abortWithNotFound is used when the requested resource does not exist
+func abortWithNotFound(c *gin.Context, code string, id string) {
+	abortWithXMLError(c, http.StatusBadRequest,
+		errors.NotFoundError(code, id, requestID(c)))
+}
+
+// abortWithDependencyViolation is used when the resource cannot be deleted
+// because other resources depend on it
+func abortWithDependencyViolation(c *gin.Context, id string) {
+	abortWithXMLError(c, http.StatusBadRequest,
+		errors.DependencyViolationError(id, requestID(c)))
+}
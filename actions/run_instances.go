@@ -0,0 +1,229 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritonaccount "github.com/joyent/triton-go/v2/account"
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	shimerrors "github.com/joyent/triton-shim/errors"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// countParam returns the value of the MinCount/MaxCount parameters
+func countParam(c *gin.Context, name string) (int, bool) {
+	value := param(c, name)
+	if value == "" {
+		abortWithMissingParameter(c, name)
+		return 0, false
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		abortWithInvalidParameter(c, name, value)
+		return 0, false
+	}
+	return count, true
+}
+
+// instanceKey retrieves the account key an instance is launched with. When it
+// fails the request is aborted with the proper error.
+func instanceKey(c *gin.Context, name string) (*tritonaccount.Key, bool) {
+	client, err := tritonutils.GetTritonAccountClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton account client: %w", err))
+		return nil, false
+	}
+
+	keys, err := listKeys(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	key := findKey(keys, name)
+	if key == nil {
+		abortWithKeyPairNotFound(c, name)
+		return nil, false
+	}
+	return key, true
+}
+
+// isolatesKeys tells if instances of the image only authorize the keys of
+// their root_authorized_keys metadata. SmartOS zones authorize every account
+// key through smartlogin instead.
+func isolatesKeys(image *tritoncompute.Image) bool {
+	return image.OS != "smartos"
+}
+
+// RunInstances creates Triton instances. The instance type can be either a
+// package name, UUID or any of the instance type aliases. Instances use the
+// network of the SubnetId, if given, or the account default networks.
+// Instances given security groups are tagged as their members and get their
+// firewall enabled (see security_groups.go). Instances given a KeyName only
+// authorize that key (see key_pairs.go).
+func RunInstances(c *gin.Context) {
+	imageID := param(c, "ImageId")
+	if imageID == "" {
+		abortWithMissingParameter(c, "ImageId")
+		return
+	}
+
+	instanceType := param(c, "InstanceType")
+	if instanceType == "" {
+		abortWithMissingParameter(c, "InstanceType")
+		return
+	}
+
+	minCount, ok := countParam(c, "MinCount")
+	if !ok {
+		return
+	}
+	maxCount, ok := countParam(c, "MaxCount")
+	if !ok {
+		return
+	}
+	if maxCount < minCount {
+		abortWithInvalidParameter(c, "MaxCount", param(c, "MaxCount"))
+		return
+	}
+
+	metadata := make(map[string]interface{})
+	if userData := param(c, "UserData"); userData != "" {
+		decoded, err := base64.StdEncoding.DecodeString(userData)
+		if err != nil {
+			abortWithInvalidParameter(c, "UserData", userData)
+			return
+		}
+		metadata["user-data"] = string(decoded)
+	}
+
+	tags := make(map[string]interface{})
+	for key, value := range tagSpecifications(c, ec2.ResourceTypeInstance) {
+		tags[key] = value
+	}
+
+	pkg, err := resolveInstanceType(regionName(c), requestPrincipal(c), instanceType)
+	if err != nil {
+		if errors.Is(err, ErrUnknownInstanceType) {
+			abortWithInvalidParameter(c, "InstanceType", instanceType)
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	image, err := client.Images().Get(context.Background(), &tritoncompute.GetImageInput{
+		ImageID: imageID,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithNotFound(c, "InvalidAMIID.NotFound", imageID)
+			return
+		}
+		log.Printf("[ERROR] get image error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to get triton compute image: %w", err))
+		return
+	}
+
+	if alias := instanceTypeAlias(pkg, instanceType); alias != "" {
+		metadata[instanceTypeMetadataKey] = alias
+	}
+
+	if keyName := param(c, "KeyName"); keyName != "" {
+		if !isolatesKeys(image) {
+			abortWithXMLError(c, http.StatusBadRequest, shimerrors.ResponseError("InvalidParameterCombination",
+				fmt.Sprintf("The image %s authorizes every account key, KeyName cannot be used with it",
+					imageID), requestID(c)))
+			return
+		}
+		key, ok := instanceKey(c, keyName)
+		if !ok {
+			return
+		}
+		metadata[authorizedKeysMetadataKey] = key.Key
+		metadata[keyNameMetadataKey] = key.Name
+	}
+
+	var networks []string
+	if id := param(c, "SubnetId"); id != "" {
+		if networks, ok = subnetNetworks(c, id); !ok {
+			return
+		}
+	}
+
+	securityGroups, ok := instanceSecurityGroups(c)
+	if !ok {
+		return
+	}
+	for _, id := range securityGroups {
+		tags[securityGroupTag(id)] = true
+	}
+
+	createInput := &tritoncompute.CreateInstanceInput{
+		Package:         pkg.UUID,
+		Image:           imageID,
+		Networks:        networks,
+		Metadata:        metadata,
+		Tags:            tags,
+		FirewallEnabled: len(securityGroups) > 0,
+	}
+	if name, found := tags["Name"]; found && maxCount == 1 {
+		createInput.Name = name.(string)
+	}
+
+	res := &ec2.Reservation{
+		ReservationId: aws.String(newResourceID("r")),
+	}
+
+	for i := 0; i < maxCount; i++ {
+		vm, err := client.Instances().Create(context.Background(), createInput)
+		if err != nil {
+			log.Printf("[ERROR] create vm error: %v\n", err)
+			// EC2 launches as many instances as possible above MinCount
+			if len(res.Instances) >= minCount {
+				break
+			}
+			for _, inst := range res.Instances {
+				client.Instances().Delete(context.Background(), &tritoncompute.DeleteInstanceInput{
+					ID: *inst.InstanceId,
+				})
+			}
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to create triton compute instance: %w", err))
+			return
+		}
+		res.Instances = append(res.Instances, instanceToEC2(vm))
+	}
+
+	log.Printf("[DEBUG] created %d vms using package %s (%s)\n",
+		len(res.Instances), pkg.Name, pkg.UUID)
+
+	writeResponse(c, "RunInstances", res)
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	"github.com/joyent/triton-shim/test"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+func TestAccAWSRunInstances(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		images, err := ec2Svc.DescribeImages(nil)
+		if err != nil || len(images.Images) == 0 {
+			t.Errorf("describe images error %v", err)
+			return
+		}
+
+		instanceTypes, err := ec2Svc.DescribeInstanceTypes(nil)
+		if err != nil || len(instanceTypes.InstanceTypes) == 0 {
+			t.Errorf("describe instance types error %v", err)
+			return
+		}
+
+		_, err = ec2Svc.RunInstances(&ec2.RunInstancesInput{
+			ImageId:      images.Images[0].ImageId,
+			InstanceType: aws.String("no-such-instance-type"),
+			MinCount:     aws.Int64(1),
+			MaxCount:     aws.Int64(1),
+		})
+		if err == nil {
+			t.Errorf("run instances should fail for unknown instance types")
+		}
+
+		_, err = ec2Svc.RunInstances(&ec2.RunInstancesInput{
+			ImageId:      images.Images[0].ImageId,
+			InstanceType: instanceTypes.InstanceTypes[0].InstanceType,
+			KeyName:      aws.String("triton-shim-no-such-key"),
+			MinCount:     aws.Int64(1),
+			MaxCount:     aws.Int64(1),
+		})
+		if err == nil {
+			t.Errorf("run instances should fail for unknown key pairs")
+		}
+
+		result, err := ec2Svc.RunInstances(&ec2.RunInstancesInput{
+			ImageId:      images.Images[0].ImageId,
+			InstanceType: instanceTypes.InstanceTypes[0].InstanceType,
+			MinCount:     aws.Int64(1),
+			MaxCount:     aws.Int64(1),
+		})
+		if err != nil {
+			t.Errorf("run instances error %v", err)
+			return
+		}
+
+		client, err := tritonutils.GetTritonComputeClient(*ec2Svc.Config.Region, nil)
+		if err != nil {
+			t.Errorf("unable to create triton compute client %v", err)
+			return
+		}
+		for _, inst := range result.Instances {
+			defer client.Instances().Delete(context.Background(),
+				&tritoncompute.DeleteInstanceInput{ID: *inst.InstanceId})
+		}
+
+		if len(result.Instances) != 1 {
+			t.Errorf("run instances should create one instance, got %d",
+				len(result.Instances))
+			return
+		}
+
+		// Aliases are reported back as given
+		if *result.Instances[0].InstanceType != *instanceTypes.InstanceTypes[0].InstanceType {
+			t.Errorf("unexpected instance type %s, expected %s",
+				*result.Instances[0].InstanceType, *instanceTypes.InstanceTypes[0].InstanceType)
+		}
+	})
+}
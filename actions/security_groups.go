@@ -0,0 +1,899 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonnetwork "github.com/joyent/triton-go/v2/network"
+	"github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Security groups are implemented with Triton Cloud Firewall. Instances are
+// members of a group when they have a machine tag named after the group ID
+// in the shim namespace, like "triton-shim.sg.sg-0123456789abcdef0", and
+// every permission is translated into firewall rules for that tag, like:
+//
+//    FROM any TO tag "triton-shim.sg.sg-0123456789abcdef0" ALLOW tcp PORT 22
+//
+// Triton does not know about the groups themselves, so the shim keeps them,
+// together with the IDs of the rules created for each permission. Like the
+// firewall rules, and like EC2 groups, groups belong to a single region.
+// Triton firewalls allow all the outbound traffic by default: egress
+// permissions are translated into rules too, but revoking them does not
+// block any traffic.
+
+// securityGroupsCollection is the store collection for security groups
+const securityGroupsCollection = "security-groups"
+
+// securityGroupTagPrefix is the prefix of the machine tags of the security
+// group members, which keeps them apart from the user tags
+const securityGroupTagPrefix = "triton-shim.sg."
+
+// securityGroupTag returns the machine tag of the members of a group
+func securityGroupTag(groupID string) string {
+	return securityGroupTagPrefix + groupID
+}
+
+// tagSecurityGroup returns the group ID of a security group machine tag
+func tagSecurityGroup(tag string) (string, bool) {
+	if !strings.HasPrefix(tag, securityGroupTagPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(tag, securityGroupTagPrefix), true
+}
+
+// Permission protocols, as normalized by normalizeProtocol
+const (
+	protocolAll  = "-1"
+	protocolTCP  = "tcp"
+	protocolUDP  = "udp"
+	protocolICMP = "icmp"
+)
+
+// securityGroupPermission is a single source (or destination, for egress)
+// of a security group permission, with the firewall rules created for it
+type securityGroupPermission struct {
+	Egress      bool     `json:"egress"`
+	IPProtocol  string   `json:"ip_protocol"`
+	FromPort    int64    `json:"from_port"`
+	ToPort      int64    `json:"to_port"`
+	CidrIP      string   `json:"cidr_ip,omitempty"`
+	GroupID     string   `json:"group_id,omitempty"`
+	Description string   `json:"description,omitempty"`
+	RuleIDs     []string `json:"rule_ids,omitempty"`
+}
+
+// sameAs tells if both permissions allow the same traffic
+func (p *securityGroupPermission) sameAs(other *securityGroupPermission) bool {
+	return p.Egress == other.Egress &&
+		p.IPProtocol == other.IPProtocol &&
+		p.FromPort == other.FromPort &&
+		p.ToPort == other.ToPort &&
+		p.CidrIP == other.CidrIP &&
+		p.GroupID == other.GroupID
+}
+
+// securityGroupRecord is the shim record of a security group
+type securityGroupRecord struct {
+	ID          string                     `json:"id"`
+	Owner       string                     `json:"owner"`
+	Region      string                     `json:"region"`
+	Name        string                     `json:"name"`
+	Description string                     `json:"description"`
+	VpcID       string                     `json:"vpc_id,omitempty"`
+	Permissions []*securityGroupPermission `json:"permissions"`
+}
+
+// key returns the store key of the record
+func (g *securityGroupRecord) key() string {
+	return ownedKey(g.Region, g.Owner, g.ID)
+}
+
+// toEC2 converts the record into an EC2 security group. Permissions sharing
+// their protocol and ports are grouped together, like EC2 does.
+func (g *securityGroupRecord) toEC2(tags map[string]string) *ec2.SecurityGroup {
+	group := &ec2.SecurityGroup{
+		GroupId:     aws.String(g.ID),
+		GroupName:   aws.String(g.Name),
+		Description: aws.String(g.Description),
+		OwnerId:     aws.String(g.Owner),
+		Tags:        ec2Tags(tags),
+	}
+	if g.VpcID != "" {
+		group.VpcId = aws.String(g.VpcID)
+	}
+
+	for _, p := range g.Permissions {
+		list := &group.IpPermissions
+		if p.Egress {
+			list = &group.IpPermissionsEgress
+		}
+
+		var perm *ec2.IpPermission
+		for _, existing := range *list {
+			if *existing.IpProtocol == p.IPProtocol &&
+				aws.Int64Value(existing.FromPort) == p.FromPort &&
+				aws.Int64Value(existing.ToPort) == p.ToPort {
+				perm = existing
+				break
+			}
+		}
+		if perm == nil {
+			perm = &ec2.IpPermission{IpProtocol: aws.String(p.IPProtocol)}
+			if p.IPProtocol != protocolAll {
+				perm.FromPort = aws.Int64(p.FromPort)
+				perm.ToPort = aws.Int64(p.ToPort)
+			}
+			*list = append(*list, perm)
+		}
+
+		var description *string
+		if p.Description != "" {
+			description = aws.String(p.Description)
+		}
+		if p.CidrIP != "" {
+			perm.IpRanges = append(perm.IpRanges, &ec2.IpRange{
+				CidrIp:      aws.String(p.CidrIP),
+				Description: description,
+			})
+		}
+		if p.GroupID != "" {
+			perm.UserIdGroupPairs = append(perm.UserIdGroupPairs, &ec2.UserIdGroupPair{
+				GroupId:     aws.String(p.GroupID),
+				UserId:      aws.String(g.Owner),
+				Description: description,
+			})
+		}
+	}
+
+	return group
+}
+
+// normalizeProtocol returns the protocol names used by the shim for the
+// EC2 protocol names or numbers, or an empty string when not supported
+func normalizeProtocol(protocol string) string {
+	switch strings.ToLower(protocol) {
+	case "-1", "all":
+		return protocolAll
+	case "tcp", "6":
+		return protocolTCP
+	case "udp", "17":
+		return protocolUDP
+	case "icmp", "1":
+		return protocolICMP
+	}
+	return ""
+}
+
+// firewallPorts returns the ports part of a firewall rule for TCP or UDP
+func firewallPorts(from int64, to int64) string {
+	switch {
+	case from <= 0 && (to <= 0 || to >= 65535):
+		return "ALL PORTS"
+	case from == to:
+		return fmt.Sprintf("PORT %d", from)
+	default:
+		return fmt.Sprintf("PORTS %d - %d", from, to)
+	}
+}
+
+// firewallICMPType returns the type part of a firewall rule for ICMP. EC2
+// uses the ports as the ICMP type and code, -1 meaning all of them.
+func firewallICMPType(icmpType int64, icmpCode int64) string {
+	switch {
+	case icmpType < 0:
+		return "TYPE all"
+	case icmpCode < 0:
+		return fmt.Sprintf("TYPE %d", icmpType)
+	default:
+		return fmt.Sprintf("TYPE %d CODE %d", icmpType, icmpCode)
+	}
+}
+
+// firewallTarget returns the firewall rule target for a permission source
+func firewallTarget(p *securityGroupPermission) string {
+	if p.GroupID != "" {
+		return fmt.Sprintf("tag %q", securityGroupTag(p.GroupID))
+	}
+	_, ipNet, err := net.ParseCIDR(p.CidrIP)
+	if err != nil {
+		return fmt.Sprintf("subnet %s", p.CidrIP)
+	}
+	ones, bits := ipNet.Mask.Size()
+	switch {
+	case ones == 0:
+		return "any"
+	case ones == bits:
+		return fmt.Sprintf("ip %s", ipNet.IP)
+	default:
+		return fmt.Sprintf("subnet %s", ipNet)
+	}
+}
+
+// firewallRules translates a permission of the given group into firewall
+// rules, one for every protocol
+func firewallRules(groupID string, p *securityGroupPermission) []string {
+	var actions []string
+	switch p.IPProtocol {
+	case protocolAll:
+		actions = []string{
+			"tcp ALL PORTS",
+			"udp ALL PORTS",
+			"icmp TYPE all",
+		}
+	case protocolICMP:
+		actions = []string{"icmp " + firewallICMPType(p.FromPort, p.ToPort)}
+	default:
+		actions = []string{p.IPProtocol + " " + firewallPorts(p.FromPort, p.ToPort)}
+	}
+
+	from, to := firewallTarget(p), fmt.Sprintf("tag %q", securityGroupTag(groupID))
+	if p.Egress {
+		from, to = to, from
+	}
+
+	rules := make([]string, 0, len(actions))
+	for _, action := range actions {
+		rules = append(rules, fmt.Sprintf("FROM %s TO %s ALLOW %s", from, to, action))
+	}
+	return rules
+}
+
+// permissionsParam parses the IpPermissions.N parameters, or the legacy
+// IpProtocol, FromPort, ToPort and CidrIp parameters, into single source
+// permissions. It aborts the request and returns false for invalid values.
+func permissionsParam(c *gin.Context, egress bool) ([]*securityGroupPermission, bool) {
+	members := paramStructList(c, "IpPermissions")
+	if len(members) == 0 && param(c, "IpProtocol") != "" {
+		members = append(members, map[string]string{
+			"IpProtocol":        param(c, "IpProtocol"),
+			"FromPort":          param(c, "FromPort"),
+			"ToPort":            param(c, "ToPort"),
+			"IpRanges.1.CidrIp": param(c, "CidrIp"),
+		})
+	}
+	if len(members) == 0 {
+		abortWithMissingParameter(c, "IpPermissions")
+		return nil, false
+	}
+
+	var result []*securityGroupPermission
+	for _, member := range members {
+		protocol := normalizeProtocol(member["IpProtocol"])
+		if protocol == "" {
+			abortWithInvalidParameter(c, "IpProtocol", member["IpProtocol"])
+			return nil, false
+		}
+
+		var ports [2]int64
+		for i, name := range []string{"FromPort", "ToPort"} {
+			value := member[name]
+			if value == "" || protocol == protocolAll {
+				ports[i] = -1
+				continue
+			}
+			port, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || port < -1 || port > 65535 {
+				abortWithInvalidParameter(c, name, value)
+				return nil, false
+			}
+			ports[i] = port
+		}
+
+		base := securityGroupPermission{
+			Egress:     egress,
+			IPProtocol: protocol,
+			FromPort:   ports[0],
+			ToPort:     ports[1],
+		}
+
+		sources := 0
+		for _, ipRange := range indexedStructs(member, "IpRanges") {
+			_, ipNet, err := net.ParseCIDR(ipRange["CidrIp"])
+			if err != nil || ipNet.IP.To4() == nil {
+				abortWithInvalidParameter(c, "CidrIp", ipRange["CidrIp"])
+				return nil, false
+			}
+			p := base
+			p.CidrIP = ipNet.String()
+			p.Description = ipRange["Description"]
+			result = append(result, &p)
+			sources++
+		}
+		for _, pair := range indexedStructs(member, "Groups") {
+			if pair["GroupId"] == "" {
+				abortWithMissingParameter(c, "GroupId")
+				return nil, false
+			}
+			p := base
+			p.GroupID = pair["GroupId"]
+			p.Description = pair["Description"]
+			result = append(result, &p)
+			sources++
+		}
+		if sources == 0 {
+			abortWithMissingParameter(c, "IpRanges")
+			return nil, false
+		}
+	}
+
+	return result, true
+}
+
+// loadSecurityGroups returns all the security groups of the given owner into
+// the given region
+func loadSecurityGroups(db *store.Store, region string, owner string) ([]*securityGroupRecord, error) {
+	var groups []*securityGroupRecord
+	for _, key := range db.Keys(securityGroupsCollection) {
+		group := &securityGroupRecord{}
+		if err := db.Get(securityGroupsCollection, key, group); err != nil {
+			return nil, fmt.Errorf("Unable to load security group: %w", err)
+		}
+		if group.Region == region && group.Owner == owner {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// findSecurityGroup returns the group of the owner into the region with the
+// given ID or, when the ID is empty, with the given name
+func findSecurityGroup(db *store.Store, region string, owner string, id string, name string) (*securityGroupRecord, error) {
+	groups, err := loadSecurityGroups(db, region, owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if (id != "" && group.ID == id) || (id == "" && group.Name == name) {
+			return group, nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+// securityGroupParam loads the group given by the GroupId or GroupName
+// parameters. It aborts the request and returns nil on failure.
+func securityGroupParam(c *gin.Context, db *store.Store, owner string) *securityGroupRecord {
+	id, name := param(c, "GroupId"), param(c, "GroupName")
+	if id == "" && name == "" {
+		abortWithMissingParameter(c, "GroupId")
+		return nil
+	}
+
+	group, err := findSecurityGroup(db, regionName(c), owner, id, name)
+	if err == store.ErrNotFound {
+		if id == "" {
+			id = name
+		}
+		abortWithNotFound(c, "InvalidGroup.NotFound", id)
+		return nil
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil
+	}
+	return group
+}
+
+// defaultVpcID returns the ID of the VPC holding the account default
+// network, or an empty string when there is none
+func defaultVpcID(client *tritonnetwork.NetworkClient, region string, principal *tritonutils.Principal) (string, error) {
+	defaultNetwork, err := getDefaultNetwork(region, principal)
+	if err != nil {
+		return "", err
+	}
+	networks, err := listFabricNetworks(client)
+	if err != nil {
+		return "", err
+	}
+	for _, fabric := range networks {
+		if fabric.Network.Id == defaultNetwork {
+			return vpcID(fabric.VLANID), nil
+		}
+	}
+	return "", nil
+}
+
+// securityGroupFiltersMatch tells if the group satisfies the request filters
+func securityGroupFiltersMatch(filters map[string][]string, group *securityGroupRecord, tags map[string]string) bool {
+	return filterMatch(filters, "group-id", group.ID) &&
+		filterMatch(filters, "group-name", group.Name) &&
+		filterMatch(filters, "description", group.Description) &&
+		filterMatch(filters, "owner-id", group.Owner) &&
+		filterMatch(filters, "vpc-id", group.VpcID) &&
+		tagFiltersMatch(filters, tags)
+}
+
+// CreateSecurityGroup creates a security group into the shim. Like EC2, new
+// groups allow all the outbound traffic, which needs no firewall rule.
+func CreateSecurityGroup(c *gin.Context) {
+	name := param(c, "GroupName")
+	if name == "" {
+		abortWithMissingParameter(c, "GroupName")
+		return
+	}
+	description := param(c, "GroupDescription")
+	if description == "" {
+		abortWithMissingParameter(c, "GroupDescription")
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	vpc := param(c, "VpcId")
+	if vpc == "" {
+		if vpc, err = defaultVpcID(client, regionName(c), requestPrincipal(c)); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	} else if _, ok := parseVpcID(vpc); !ok {
+		abortWithNotFound(c, "InvalidVpcID.NotFound", vpc)
+		return
+	}
+
+	groups, err := loadSecurityGroups(db, regionName(c), account.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	for _, group := range groups {
+		if group.Name == name && group.VpcID == vpc {
+			abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidGroup.Duplicate",
+				fmt.Sprintf("The security group '%s' already exists", name), requestID(c)))
+			return
+		}
+	}
+
+	group := &securityGroupRecord{
+		ID:          newResourceID("sg"),
+		Owner:       account.ID,
+		Region:      regionName(c),
+		Name:        name,
+		Description: description,
+		VpcID:       vpc,
+		Permissions: []*securityGroupPermission{{
+			Egress:     true,
+			IPProtocol: protocolAll,
+			FromPort:   -1,
+			ToPort:     -1,
+			CidrIP:     "0.0.0.0/0",
+		}},
+	}
+	if err := db.Put(securityGroupsCollection, group.key(), group); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save security group: %w", err))
+		return
+	}
+
+	tags := tagSpecifications(c, ec2.ResourceTypeSecurityGroup)
+	if err := saveTags(db, group.Region, account.ID, group.ID, tags); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save security group tags: %w", err))
+		return
+	}
+
+	ec2Output := ec2.CreateSecurityGroupOutput{
+		GroupId: aws.String(group.ID),
+		Tags:    ec2Tags(tags),
+	}
+
+	writeResponse(c, "CreateSecurityGroup", ec2Output)
+}
+
+// DescribeSecurityGroups lists the security groups of the account
+func DescribeSecurityGroups(c *gin.Context) {
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	groups, err := loadSecurityGroups(db, regionName(c), account.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ids, names := paramList(c, "GroupId"), paramList(c, "GroupName")
+	for _, wanted := range [][]string{ids, names} {
+		for _, value := range wanted {
+			found := false
+			for _, group := range groups {
+				if group.ID == value || group.Name == value {
+					found = true
+					break
+				}
+			}
+			if !found {
+				abortWithNotFound(c, "InvalidGroup.NotFound", value)
+				return
+			}
+		}
+	}
+
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeSecurityGroupsOutput{}
+
+	for _, group := range groups {
+		if len(ids) > 0 && !containsString(ids, group.ID) {
+			continue
+		}
+		if len(names) > 0 && !containsString(names, group.Name) {
+			continue
+		}
+		tags, err := loadTags(db, group.Region, account.ID, group.ID)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to load security group tags: %w", err))
+			return
+		}
+		if securityGroupFiltersMatch(ec2Filters, group, tags) {
+			ec2Output.SecurityGroups = append(ec2Output.SecurityGroups, group.toEC2(tags))
+		}
+	}
+
+	writeResponse(c, "DescribeSecurityGroups", ec2Output)
+}
+
+// DeleteSecurityGroup deletes a security group and its firewall rules. The
+// group must not have any member instance.
+func DeleteSecurityGroup(c *gin.Context) {
+	compute, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	group := securityGroupParam(c, db, account.ID)
+	if group == nil {
+		return
+	}
+
+	members, err := compute.Instances().Count(context.Background(), &tritoncompute.ListInstancesInput{
+		Tags: map[string]interface{}{securityGroupTag(group.ID): true},
+	})
+	if err != nil {
+		log.Printf("[ERROR] count vms error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to list triton compute instances: %w", err))
+		return
+	}
+	if members > 0 {
+		abortWithDependencyViolation(c, group.ID)
+		return
+	}
+
+	for _, p := range group.Permissions {
+		if err := deleteFirewallRules(client, p); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := db.Delete(securityGroupsCollection, group.key()); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to delete security group: %w", err))
+		return
+	}
+	if err := saveTags(db, group.Region, account.ID, group.ID, nil); err != nil {
+		log.Printf("[ERROR] delete security group %s tags error: %v\n", group.ID, err)
+	}
+
+	writeResponse(c, "DeleteSecurityGroup", returnOutput{Return: aws.Bool(true)})
+}
+
+// createFirewallRules creates the firewall rules of a permission
+func createFirewallRules(client *tritonnetwork.NetworkClient, groupID string, p *securityGroupPermission) error {
+	for _, rule := range firewallRules(groupID, p) {
+		created, err := client.Firewall().CreateRule(context.Background(), &tritonnetwork.CreateRuleInput{
+			Enabled:     true,
+			Rule:        rule,
+			Description: fmt.Sprintf("Security group %s", groupID),
+		})
+		if err != nil {
+			log.Printf("[ERROR] create firewall rule %q error: %v\n", rule, err)
+			return fmt.Errorf("Unable to create triton firewall rule: %w", err)
+		}
+		p.RuleIDs = append(p.RuleIDs, created.ID)
+	}
+	return nil
+}
+
+// deleteFirewallRules deletes the firewall rules of a permission
+func deleteFirewallRules(client *tritonnetwork.NetworkClient, p *securityGroupPermission) error {
+	for len(p.RuleIDs) > 0 {
+		err := client.Firewall().DeleteRule(context.Background(), &tritonnetwork.DeleteRuleInput{
+			ID: p.RuleIDs[0],
+		})
+		if err != nil {
+			log.Printf("[ERROR] delete firewall rule %s error: %v\n", p.RuleIDs[0], err)
+			return fmt.Errorf("Unable to delete triton firewall rule: %w", err)
+		}
+		p.RuleIDs = p.RuleIDs[1:]
+	}
+	return nil
+}
+
+// authorizeSecurityGroup adds the requested permissions to a group
+func authorizeSecurityGroup(c *gin.Context, action string, egress bool) {
+	permissions, ok := permissionsParam(c, egress)
+	if !ok {
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	group := securityGroupParam(c, db, account.ID)
+	if group == nil {
+		return
+	}
+
+	for _, p := range permissions {
+		if p.GroupID != "" {
+			if _, err := findSecurityGroup(db, regionName(c), account.ID, p.GroupID, ""); err != nil {
+				abortWithNotFound(c, "InvalidGroup.NotFound", p.GroupID)
+				return
+			}
+		}
+		for _, existing := range group.Permissions {
+			if existing.sameAs(p) {
+				abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidPermission.Duplicate",
+					fmt.Sprintf("The specified rule already exists for %s", group.ID), requestID(c)))
+				return
+			}
+		}
+	}
+
+	for _, p := range permissions {
+		err := createFirewallRules(client, group.ID, p)
+		if err == nil {
+			group.Permissions = append(group.Permissions, p)
+		}
+		// Keep track of the rules created so far, even on failure
+		if saveErr := db.Put(securityGroupsCollection, group.key(), group); saveErr != nil && err == nil {
+			err = fmt.Errorf("Unable to save security group: %w", saveErr)
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeResponse(c, action, returnOutput{Return: aws.Bool(true)})
+}
+
+// revokeSecurityGroup removes the requested permissions from a group
+func revokeSecurityGroup(c *gin.Context, action string, egress bool) {
+	permissions, ok := permissionsParam(c, egress)
+	if !ok {
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	group := securityGroupParam(c, db, account.ID)
+	if group == nil {
+		return
+	}
+
+	var revoked []int
+	for _, p := range permissions {
+		found := -1
+		for i, existing := range group.Permissions {
+			if existing.sameAs(p) {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidPermission.NotFound",
+				fmt.Sprintf("The specified rule does not exist in security group %s", group.ID), requestID(c)))
+			return
+		}
+		revoked = append(revoked, found)
+	}
+
+	for _, i := range revoked {
+		err := deleteFirewallRules(client, group.Permissions[i])
+		if err != nil {
+			// Keep track of the rules deleted so far
+			db.Put(securityGroupsCollection, group.key(), group)
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	var kept []*securityGroupPermission
+	for i, p := range group.Permissions {
+		removed := false
+		for _, r := range revoked {
+			removed = removed || r == i
+		}
+		if !removed {
+			kept = append(kept, p)
+		}
+	}
+	group.Permissions = kept
+
+	if err := db.Put(securityGroupsCollection, group.key(), group); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save security group: %w", err))
+		return
+	}
+
+	writeResponse(c, action, returnOutput{Return: aws.Bool(true)})
+}
+
+// AuthorizeSecurityGroupIngress adds inbound permissions to a group
+func AuthorizeSecurityGroupIngress(c *gin.Context) {
+	authorizeSecurityGroup(c, "AuthorizeSecurityGroupIngress", false)
+}
+
+// AuthorizeSecurityGroupEgress adds outbound permissions to a group
+func AuthorizeSecurityGroupEgress(c *gin.Context) {
+	authorizeSecurityGroup(c, "AuthorizeSecurityGroupEgress", true)
+}
+
+// RevokeSecurityGroupIngress removes inbound permissions from a group
+func RevokeSecurityGroupIngress(c *gin.Context) {
+	revokeSecurityGroup(c, "RevokeSecurityGroupIngress", false)
+}
+
+// RevokeSecurityGroupEgress removes outbound permissions from a group
+func RevokeSecurityGroupEgress(c *gin.Context) {
+	revokeSecurityGroup(c, "RevokeSecurityGroupEgress", true)
+}
+
+// instanceSecurityGroups returns the IDs of the security groups given to
+// RunInstances with the SecurityGroupId.N or SecurityGroup.N (names)
+// parameters. It aborts the request and returns false on failure.
+func instanceSecurityGroups(c *gin.Context) ([]string, bool) {
+	ids, names := paramList(c, "SecurityGroupId"), paramList(c, "SecurityGroup")
+	if len(ids) == 0 && len(names) == 0 {
+		return nil, true
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return nil, false
+	}
+
+	var result []string
+	add := func(id string, name string) bool {
+		group, err := findSecurityGroup(db, regionName(c), account.ID, id, name)
+		if err == store.ErrNotFound {
+			abortWithNotFound(c, "InvalidGroup.NotFound", id+name)
+			return false
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+		if !containsString(result, group.ID) {
+			result = append(result, group.ID)
+		}
+		return true
+	}
+
+	for _, id := range ids {
+		if !add(id, "") {
+			return nil, false
+		}
+	}
+	for _, name := range names {
+		if !add("", name) {
+			return nil, false
+		}
+	}
+	return result, true
+}
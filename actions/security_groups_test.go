@@ -0,0 +1,88 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	tritonnetwork "github.com/joyent/triton-go/v2/network"
+	"github.com/joyent/triton-shim/test"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+func TestAccAWSSecurityGroups(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		created, err := ec2Svc.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+			GroupName:   aws.String("triton-shim-test"),
+			Description: aws.String("triton-shim test group"),
+		})
+		if err != nil {
+			t.Errorf("create security group error %v", err)
+			return
+		}
+		groupID := created.GroupId
+		defer ec2Svc.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{GroupId: groupID})
+
+		ssh := []*ec2.IpPermission{{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int64(22),
+			ToPort:     aws.Int64(22),
+			IpRanges:   []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+		}}
+
+		_, err = ec2Svc.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       groupID,
+			IpPermissions: ssh,
+		})
+		if err != nil {
+			t.Errorf("authorize security group ingress error %v", err)
+			return
+		}
+
+		client, err := tritonutils.GetTritonNetworkClient(*ec2Svc.Config.Region, nil)
+		if err != nil {
+			t.Errorf("unable to create triton network client %v", err)
+			return
+		}
+		rules, err := client.Firewall().ListRules(context.Background(), &tritonnetwork.ListRulesInput{})
+		if err != nil {
+			t.Errorf("list firewall rules error %v", err)
+		}
+		expected := `FROM any TO tag "` + *groupID + `" ALLOW tcp PORT 22`
+		found := false
+		for _, rule := range rules {
+			found = found || rule.Rule == expected
+		}
+		if !found {
+			t.Errorf("firewall rule %q not found", expected)
+		}
+
+		described, err := ec2Svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+			GroupIds: []*string{groupID},
+		})
+		if err != nil {
+			t.Errorf("describe security groups error %v", err)
+		} else if len(described.SecurityGroups) != 1 ||
+			len(described.SecurityGroups[0].IpPermissions) != 1 {
+			t.Errorf("describe security groups did not return the ingress permission")
+		}
+
+		_, err = ec2Svc.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       groupID,
+			IpPermissions: ssh,
+		})
+		if err != nil {
+			t.Errorf("revoke security group ingress error %v", err)
+		}
+	})
+}
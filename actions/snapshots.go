@@ -0,0 +1,488 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	"github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Snapshots are Triton machine snapshots, which include the whole instance
+// disk. Every instance has a root volume, identified by the instance UUID
+// like "vol-0e5a8fc6d6a54ab3a5d6d4b2d2b5e1f0", which is the volume of all
+// its snapshots. Snapshot IDs encode the machine UUID followed by the hex
+// encoded snapshot name, so snapshots can be found from their ID alone.
+
+// snapshotsCollection is the store collection for the snapshot attributes
+// which have no Triton equivalent
+const snapshotsCollection = "snapshots"
+
+// rootDeviceName is the device name of the instances root volume
+const rootDeviceName = "/dev/sda1"
+
+// snapshotIDRe matches the snapshot IDs built by snapshotID
+var snapshotIDRe = regexp.MustCompile(`^snap-([0-9a-f]{8})([0-9a-f]{4})([0-9a-f]{4})([0-9a-f]{4})([0-9a-f]{12})((?:[0-9a-f]{2})+)$`)
+
+// snapshotRecord is the shim record of a snapshot
+type snapshotRecord struct {
+	ID          string `json:"id"`
+	Owner       string `json:"owner"`
+	Region      string `json:"region"`
+	Description string `json:"description,omitempty"`
+}
+
+// machineSnapshot is a Triton snapshot together with its machine
+type machineSnapshot struct {
+	Machine  *tritoncompute.Instance
+	Snapshot *tritoncompute.Snapshot
+}
+
+// snapshotID returns the snapshot ID for the given machine snapshot
+func snapshotID(machineID string, name string) string {
+	return "snap-" + strings.Replace(machineID, "-", "", -1) + hex.EncodeToString([]byte(name))
+}
+
+// parseSnapshotID returns the machine UUID and the name of the given
+// snapshot
+func parseSnapshotID(id string) (string, string, bool) {
+	m := snapshotIDRe.FindStringSubmatch(id)
+	if m == nil {
+		return "", "", false
+	}
+	name, err := hex.DecodeString(m[6])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Join(m[1:6], "-"), string(name), true
+}
+
+// rootVolumeID returns the ID of the root volume of an instance
+func rootVolumeID(machineID string) string {
+	return volumeID(machineID)
+}
+
+// snapshotState converts a Triton snapshot state to the EC2 one
+func snapshotState(state string) string {
+	switch state {
+	case "created", "success":
+		return ec2.SnapshotStateCompleted
+	case "failed", "deleted":
+		return ec2.SnapshotStateError
+	default:
+		return ec2.SnapshotStatePending
+	}
+}
+
+// snapshotProgress is the EC2 progress of a snapshot in the given state
+func snapshotProgress(state string) string {
+	if state == ec2.SnapshotStateCompleted {
+		return "100%"
+	}
+	return "0%"
+}
+
+// snapshotToEC2 converts a machine snapshot to an EC2 snapshot
+func snapshotToEC2(snap *machineSnapshot, record *snapshotRecord, tags map[string]string) *ec2.Snapshot {
+	state := snapshotState(snap.Snapshot.State)
+	return &ec2.Snapshot{
+		SnapshotId:  aws.String(snapshotID(snap.Machine.ID, snap.Snapshot.Name)),
+		VolumeId:    aws.String(rootVolumeID(snap.Machine.ID)),
+		VolumeSize:  aws.Int64(int64((snap.Machine.Disk + 1023) / 1024)),
+		State:       aws.String(state),
+		Progress:    aws.String(snapshotProgress(state)),
+		StartTime:   aws.Time(snap.Snapshot.Created),
+		Description: aws.String(record.Description),
+		OwnerId:     aws.String(record.Owner),
+		Encrypted:   aws.Bool(false),
+		Tags:        ec2Tags(tags),
+	}
+}
+
+// snapshotFiltersMatch tells if the snapshot satisfies the request filters
+func snapshotFiltersMatch(filters map[string][]string, snapshot *ec2.Snapshot, tags map[string]string) bool {
+	return filterMatch(filters, "snapshot-id", *snapshot.SnapshotId) &&
+		filterMatch(filters, "volume-id", *snapshot.VolumeId) &&
+		filterMatch(filters, "status", *snapshot.State) &&
+		filterMatch(filters, "progress", *snapshot.Progress) &&
+		filterMatch(filters, "description", *snapshot.Description) &&
+		filterMatch(filters, "owner-id", *snapshot.OwnerId) &&
+		filterMatch(filters, "encrypted", "false") &&
+		tagFiltersMatch(filters, tags)
+}
+
+// loadSnapshotRecord returns the shim record of a snapshot, which is empty
+// for snapshots created outside the shim
+func loadSnapshotRecord(db *store.Store, region string, owner string, id string) (*snapshotRecord, error) {
+	record := &snapshotRecord{ID: id, Owner: owner, Region: region}
+	err := db.Get(snapshotsCollection, ownedKey(region, owner, id), record)
+	if err != nil && err != store.ErrNotFound {
+		return nil, fmt.Errorf("Unable to load snapshot: %w", err)
+	}
+	return record, nil
+}
+
+// listMachineSnapshots returns the snapshots of the given machines. Machines
+// gone since they were listed are skipped.
+func listMachineSnapshots(client *tritoncompute.ComputeClient, vms []*tritoncompute.Instance) ([]*machineSnapshot, error) {
+	var result []*machineSnapshot
+	for _, vm := range vms {
+		snapshots, err := client.Snapshots().List(context.Background(), &tritoncompute.ListSnapshotsInput{
+			MachineID: vm.ID,
+		})
+		if err != nil {
+			if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) ||
+				tritonerrors.IsSpecificStatusCode(err, http.StatusGone) {
+				continue
+			}
+			log.Printf("[ERROR] list vm %s snapshots error: %v\n", vm.ID, err)
+			return nil, fmt.Errorf("Unable to list triton snapshots: %w", err)
+		}
+		for _, snapshot := range snapshots {
+			result = append(result, &machineSnapshot{Machine: vm, Snapshot: snapshot})
+		}
+	}
+	return result, nil
+}
+
+// createMachineSnapshot snapshots an instance, recording the description and
+// tags of the new snapshot
+func createMachineSnapshot(client *tritoncompute.ComputeClient, db *store.Store, region string, owner string,
+	vm *tritoncompute.Instance, description string, tags map[string]string) (*ec2.Snapshot, error) {
+
+	name := strings.TrimPrefix(newResourceID("snap"), "snap-")
+	snapshot, err := client.Snapshots().Create(context.Background(), &tritoncompute.CreateSnapshotInput{
+		MachineID: vm.ID,
+		Name:      name,
+	})
+	if err != nil {
+		log.Printf("[ERROR] create vm %s snapshot error: %v\n", vm.ID, err)
+		return nil, fmt.Errorf("Unable to create triton snapshot: %w", err)
+	}
+	if snapshot.Created.IsZero() {
+		snapshot.Created = time.Now().UTC()
+	}
+
+	record := &snapshotRecord{
+		ID:          snapshotID(vm.ID, snapshot.Name),
+		Owner:       owner,
+		Region:      region,
+		Description: description,
+	}
+	if err := db.Put(snapshotsCollection, ownedKey(region, owner, record.ID), record); err != nil {
+		return nil, fmt.Errorf("Unable to save snapshot: %w", err)
+	}
+	if err := saveTags(db, region, owner, record.ID, tags); err != nil {
+		return nil, fmt.Errorf("Unable to save snapshot tags: %w", err)
+	}
+
+	log.Printf("[DEBUG] created snapshot %s of vm %s\n", snapshot.Name, vm.ID)
+
+	return snapshotToEC2(&machineSnapshot{Machine: vm, Snapshot: snapshot}, record, tags), nil
+}
+
+// DescribeSnapshots lists the snapshots of the account instances
+func DescribeSnapshots(c *gin.Context) {
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	// Snapshots only belong to the account
+	for _, owner := range paramList(c, "Owner") {
+		if owner != "self" && owner != account.ID {
+			writeResponse(c, "DescribeSnapshots", ec2.DescribeSnapshotsOutput{})
+			return
+		}
+	}
+
+	vms, err := listInstances(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Only list the snapshots of the machines of the requested snapshots
+	wanted := paramList(c, "SnapshotId")
+	if len(wanted) > 0 {
+		machines := make(map[string]bool)
+		for _, id := range wanted {
+			machineID, _, ok := parseSnapshotID(id)
+			if !ok {
+				abortWithNotFound(c, "InvalidSnapshot.NotFound", id)
+				return
+			}
+			machines[machineID] = true
+		}
+		var selected []*tritoncompute.Instance
+		for _, vm := range vms {
+			if machines[vm.ID] {
+				selected = append(selected, vm)
+			}
+		}
+		vms = selected
+	}
+
+	snapshots, err := listMachineSnapshots(client, vms)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, id := range wanted {
+		found := false
+		for _, snap := range snapshots {
+			found = found || snapshotID(snap.Machine.ID, snap.Snapshot.Name) == id
+		}
+		if !found {
+			abortWithNotFound(c, "InvalidSnapshot.NotFound", id)
+			return
+		}
+	}
+
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeSnapshotsOutput{}
+
+	for _, snap := range snapshots {
+		id := snapshotID(snap.Machine.ID, snap.Snapshot.Name)
+		if len(wanted) > 0 && !containsString(wanted, id) {
+			continue
+		}
+		record, err := loadSnapshotRecord(db, regionName(c), account.ID, id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		tags, err := loadTags(db, regionName(c), account.ID, id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to load snapshot tags: %w", err))
+			return
+		}
+		snapshot := snapshotToEC2(snap, record, tags)
+		if snapshotFiltersMatch(ec2Filters, snapshot, tags) {
+			ec2Output.Snapshots = append(ec2Output.Snapshots, snapshot)
+		}
+	}
+
+	writeResponse(c, "DescribeSnapshots", ec2Output)
+}
+
+// CreateSnapshot snapshots the instance owning the given root volume. NFS
+// volumes cannot be snapshotted.
+func CreateSnapshot(c *gin.Context) {
+	id := param(c, "VolumeId")
+	if id == "" {
+		abortWithMissingParameter(c, "VolumeId")
+		return
+	}
+	machineID, ok := parseVolumeID(id)
+	if !ok {
+		abortWithNotFound(c, "InvalidVolume.NotFound", id)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	vm, err := client.Instances().Get(context.Background(), &tritoncompute.GetInstanceInput{
+		ID: machineID,
+	})
+	if err != nil {
+		if !tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			log.Printf("[ERROR] get vm error: %v\n", err)
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to get triton compute instance: %w", err))
+			return
+		}
+		if volume, err := findVolume(client, id); err == nil && volume != nil {
+			abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("UnsupportedOperation",
+				fmt.Sprintf("Snapshots of the NFS volume %s are not supported", id), requestID(c)))
+			return
+		}
+		abortWithNotFound(c, "InvalidVolume.NotFound", id)
+		return
+	}
+
+	snapshot, err := createMachineSnapshot(client, db, regionName(c), account.ID, vm,
+		param(c, "Description"), tagSpecifications(c, ec2.ResourceTypeSnapshot))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	writeResponse(c, "CreateSnapshot", snapshot)
+}
+
+// CreateSnapshots snapshots an instance. Instances only have their root
+// volume, which cannot be excluded.
+func CreateSnapshots(c *gin.Context) {
+	instanceID := param(c, "InstanceSpecification.InstanceId")
+	if instanceID == "" {
+		abortWithMissingParameter(c, "InstanceSpecification.InstanceId")
+		return
+	}
+	if exclude := param(c, "InstanceSpecification.ExcludeBootVolume"); exclude == "true" {
+		abortWithInvalidParameter(c, "InstanceSpecification.ExcludeBootVolume", exclude)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	vm := getInstance(c, client, instanceID)
+	if vm == nil {
+		return
+	}
+
+	snapshot, err := createMachineSnapshot(client, db, regionName(c), account.ID, vm,
+		param(c, "Description"), tagSpecifications(c, ec2.ResourceTypeSnapshot))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	writeResponse(c, "CreateSnapshots", ec2.CreateSnapshotsOutput{
+		Snapshots: []*ec2.SnapshotInfo{{
+			SnapshotId:  snapshot.SnapshotId,
+			VolumeId:    snapshot.VolumeId,
+			VolumeSize:  snapshot.VolumeSize,
+			State:       snapshot.State,
+			Progress:    snapshot.Progress,
+			StartTime:   snapshot.StartTime,
+			Description: snapshot.Description,
+			OwnerId:     snapshot.OwnerId,
+			Encrypted:   snapshot.Encrypted,
+			Tags:        snapshot.Tags,
+		}},
+	})
+}
+
+// DeleteSnapshot deletes a machine snapshot
+func DeleteSnapshot(c *gin.Context) {
+	id := param(c, "SnapshotId")
+	if id == "" {
+		abortWithMissingParameter(c, "SnapshotId")
+		return
+	}
+	machineID, name, ok := parseSnapshotID(id)
+	if !ok {
+		abortWithNotFound(c, "InvalidSnapshot.NotFound", id)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	err = client.Snapshots().Delete(context.Background(), &tritoncompute.DeleteSnapshotInput{
+		MachineID: machineID,
+		Name:      name,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) ||
+			tritonerrors.IsSpecificStatusCode(err, http.StatusGone) {
+			abortWithNotFound(c, "InvalidSnapshot.NotFound", id)
+			return
+		}
+		log.Printf("[ERROR] delete snapshot error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to delete triton snapshot: %w", err))
+		return
+	}
+
+	if err := db.Delete(snapshotsCollection, ownedKey(regionName(c), account.ID, id)); err != nil {
+		log.Printf("[ERROR] delete snapshot %s record error: %v\n", id, err)
+	}
+	if err := saveTags(db, regionName(c), account.ID, id, nil); err != nil {
+		log.Printf("[ERROR] delete snapshot %s tags error: %v\n", id, err)
+	}
+
+	writeResponse(c, "DeleteSnapshot", returnOutput{Return: aws.Bool(true)})
+}
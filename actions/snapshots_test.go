@@ -0,0 +1,80 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSSnapshots(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		instances, err := ec2Svc.DescribeInstances(&ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("instance-state-name"),
+				Values: []*string{aws.String(ec2.InstanceStateNameRunning)},
+			}},
+		})
+		if err != nil {
+			t.Errorf("describe instances error %v", err)
+			return
+		}
+		if len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0 {
+			t.Skip("no running instance to snapshot")
+		}
+
+		instance := instances.Reservations[0].Instances[0]
+		if len(instance.BlockDeviceMappings) != 1 {
+			t.Errorf("unexpected instance block devices %v", instance.BlockDeviceMappings)
+			return
+		}
+		volumeID := instance.BlockDeviceMappings[0].Ebs.VolumeId
+
+		created, err := ec2Svc.CreateSnapshot(&ec2.CreateSnapshotInput{
+			VolumeId:    volumeID,
+			Description: aws.String("triton-shim-test"),
+		})
+		if err != nil {
+			t.Errorf("create snapshot error %v", err)
+			return
+		}
+		if *created.VolumeId != *volumeID {
+			t.Errorf("unexpected snapshot volume %s", *created.VolumeId)
+		}
+
+		described, err := ec2Svc.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+			OwnerIds: []*string{aws.String("self")},
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("description"),
+				Values: []*string{aws.String("triton-shim-test")},
+			}},
+		})
+		if err != nil {
+			t.Errorf("describe snapshots error %v", err)
+		} else if len(described.Snapshots) != 1 || *described.Snapshots[0].SnapshotId != *created.SnapshotId {
+			t.Errorf("describe snapshots did not return the new snapshot")
+		}
+
+		err = ec2Svc.WaitUntilSnapshotCompleted(&ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{created.SnapshotId},
+		})
+		if err != nil {
+			t.Errorf("wait for snapshot error %v", err)
+		}
+
+		_, err = ec2Svc.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: created.SnapshotId})
+		if err != nil {
+			t.Errorf("delete snapshot error %v", err)
+		}
+	})
+}
@@ -0,0 +1,307 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	tritonidentity "github.com/joyent/triton-go/v2/identity"
+	"github.com/joyent/triton-shim/utils"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// The STS actions issue temporary credentials, so CI jobs and the like do not
+// need long-lived Triton access keys. Temporary credentials act as the
+// principal they were issued to, with the key of the principal itself (see
+// tritonutils.CheckPrincipal). AssumeRole ones are restricted to one of the
+// Triton RBAC roles the principal is a member of, by sending the role as the
+// as-role parameter of every CloudAPI request. RBAC only restricts
+// sub-users, so like STS, account owners (root) cannot assume roles.
+
+const stsNamespace = "https://sts.amazonaws.com/doc/2011-06-15/"
+
+// Duration limits of the temporary credentials, in seconds
+const (
+	minSessionDuration          = 900
+	defaultSessionTokenDuration = 43200
+	maxSessionTokenDuration     = 129600
+	defaultAssumeRoleDuration   = 3600
+	maxAssumeRoleDuration       = 43200
+)
+
+// STS error codes which the SDK has no constant for
+const (
+	errCodeValidationError = "ValidationError"
+	errCodeAccessDenied    = "AccessDenied"
+)
+
+// Length limits of the role session names
+const (
+	roleSessionNameMinLength = 2
+	roleSessionNameMaxLength = 64
+)
+
+// assumeRoleUnauthorizedMessage is the message of the AccessDenied errors of
+// AssumeRole, given the principal and role ARNs
+const assumeRoleUnauthorizedMessage = "User %s is not authorized to perform: sts:AssumeRole on resource: %s"
+
+// roleArnRe matches the role ARNs: arn:aws:iam::<account>:role/<path/><name>
+var roleArnRe = regexp.MustCompile(`^arn:aws:iam::([^:]+):role/(?:[^:]*/)?([^/:]+)$`)
+
+// roleSessionNameRe matches the characters allowed into role session names
+var roleSessionNameRe = regexp.MustCompile(`^[\w+=,.@-]+$`)
+
+// stsResponseMetadata ends the STS responses
+type stsResponseMetadata struct {
+	_ struct{} `type:"structure"`
+
+	RequestId *string `type:"string"`
+}
+
+// getSessionTokenResponse wraps the GetSessionToken result like STS does
+type getSessionTokenResponse struct {
+	_ struct{} `type:"structure"`
+
+	Result           *sts.GetSessionTokenOutput `locationName:"GetSessionTokenResult" type:"structure"`
+	ResponseMetadata *stsResponseMetadata       `type:"structure"`
+}
+
+// assumeRoleResponse wraps the AssumeRole result like STS does
+type assumeRoleResponse struct {
+	_ struct{} `type:"structure"`
+
+	Result           *sts.AssumeRoleOutput `locationName:"AssumeRoleResult" type:"structure"`
+	ResponseMetadata *stsResponseMetadata  `type:"structure"`
+}
+
+// stsMetadata returns the metadata ending the STS responses
+func stsMetadata(c *gin.Context) *stsResponseMetadata {
+	return &stsResponseMetadata{RequestId: aws.String(requestID(c))}
+}
+
+// writeSTSResponse sends the given output struct as the XML response of the
+// provided STS action
+func writeSTSResponse(c *gin.Context, action string, output interface{}) {
+	c.Header("x-amzn-RequestId", requestID(c))
+	writeXMLResponse(c, action, stsNamespace, output)
+}
+
+// sessionDuration returns the DurationSeconds parameter, within the given
+// maximum duration. When it fails the request is aborted with the proper
+// error.
+func sessionDuration(c *gin.Context, defaultDuration int, maxDuration int) (time.Duration, bool) {
+	value := param(c, "DurationSeconds")
+	if value == "" {
+		return time.Duration(defaultDuration) * time.Second, true
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < minSessionDuration || seconds > maxDuration {
+		abortWithRestXMLError(c, http.StatusBadRequest, errCodeValidationError,
+			fmt.Sprintf("1 validation error detected: Value '%s' at 'durationSeconds' failed to satisfy "+
+				"constraint: Member must have value between %d and %d", value, minSessionDuration, maxDuration))
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// requestPrincipalArn returns the ARN of the principal, used in the errors
+// telling it cannot perform an action
+func requestPrincipalArn(principal *tritonutils.Principal) string {
+	if principal.User != "" {
+		return fmt.Sprintf("arn:aws:iam::%s:user/%s", principal.AccountID, principal.User)
+	}
+	return fmt.Sprintf("arn:aws:iam::%s:root", principal.AccountID)
+}
+
+// stsCredentials converts temporary credentials to STS credentials
+func stsCredentials(session *utils.SessionCredentials) *sts.Credentials {
+	return &sts.Credentials{
+		AccessKeyId:     aws.String(session.AccessKeyID),
+		SecretAccessKey: aws.String(session.SecretAccessKey),
+		SessionToken:    aws.String(session.SessionToken),
+		Expiration:      aws.Time(session.Expiration),
+	}
+}
+
+// GetSessionToken issues temporary credentials acting as the principal of
+// the Triton access key signing the request. Like STS, temporary
+// credentials cannot get other temporary credentials.
+func GetSessionToken(c *gin.Context) {
+	principal := requestPrincipal(c)
+	if principal == nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to find the request principal"))
+		return
+	}
+	if principal.SessionToken != "" {
+		abortWithRestXMLError(c, http.StatusForbidden, errCodeAccessDenied,
+			"Cannot call GetSessionToken with session credentials")
+		return
+	}
+
+	duration, ok := sessionDuration(c, defaultSessionTokenDuration, maxSessionTokenDuration)
+	if !ok {
+		return
+	}
+
+	session, err := utils.IssueSessionCredentials(regionName(c), principal, "", duration)
+	if errors.Is(err, utils.ErrNoAccount) {
+		abortWithRestXMLError(c, http.StatusForbidden, errCodeAccessDenied,
+			"Temporary credentials can only be issued to Triton accounts")
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to issue session credentials: %w", err))
+		return
+	}
+
+	log.Printf("[DEBUG] issued session credentials %s until %s\n",
+		session.AccessKeyID, session.Expiration.Format(time.RFC3339))
+
+	writeSTSResponse(c, "GetSessionToken", getSessionTokenResponse{
+		Result: &sts.GetSessionTokenOutput{
+			Credentials: stsCredentials(session),
+		},
+		ResponseMetadata: stsMetadata(c),
+	})
+}
+
+// getRole retrieves the Triton RBAC role of the principal account. Sub-users
+// must be members of the role. When it fails the request is aborted with
+// the proper error, and nil is returned.
+func getRole(c *gin.Context, principal *tritonutils.Principal, name string, arn string) *tritonidentity.Role {
+	client, err := tritonutils.GetTritonIdentityClient(regionName(c), principal)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton identity client: %w", err))
+		return nil
+	}
+
+	unauthorized := fmt.Sprintf(assumeRoleUnauthorizedMessage, requestPrincipalArn(principal), arn)
+	role, err := client.Roles().Get(context.Background(), &tritonidentity.GetRoleInput{
+		RoleID: name,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithRestXMLError(c, http.StatusForbidden, errCodeAccessDenied, unauthorized)
+			return nil
+		}
+		log.Printf("[ERROR] get role error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to get triton role: %w", err))
+		return nil
+	}
+
+	if principal.User != "" && !containsString(role.Members, principal.User) {
+		abortWithRestXMLError(c, http.StatusForbidden, errCodeAccessDenied, unauthorized)
+		return nil
+	}
+	return role
+}
+
+// AssumeRole issues temporary credentials acting as one of the Triton RBAC
+// roles of the principal account, given by its ARN:
+// arn:aws:iam::<account UUID or login>:role/<role name>. Roles of other
+// accounts cannot be assumed.
+func AssumeRole(c *gin.Context) {
+	principal := requestPrincipal(c)
+	if principal == nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to find the request principal"))
+		return
+	}
+
+	roleArn := param(c, "RoleArn")
+	if roleArn == "" {
+		abortWithRestXMLError(c, http.StatusBadRequest, errCodeValidationError,
+			"1 validation error detected: Value null at 'roleArn' failed to satisfy constraint: "+
+				"Member must not be null")
+		return
+	}
+
+	sessionName := param(c, "RoleSessionName")
+	if len(sessionName) < roleSessionNameMinLength || len(sessionName) > roleSessionNameMaxLength ||
+		!roleSessionNameRe.MatchString(sessionName) {
+		abortWithRestXMLError(c, http.StatusBadRequest, errCodeValidationError,
+			fmt.Sprintf("1 validation error detected: Value '%s' at 'roleSessionName' failed to satisfy "+
+				"constraint: Member must have length between %d and %d, and satisfy regular expression "+
+				"pattern: [\\w+=,.@-]*", sessionName, roleSessionNameMinLength, roleSessionNameMaxLength))
+		return
+	}
+
+	duration, ok := sessionDuration(c, defaultAssumeRoleDuration, maxAssumeRoleDuration)
+	if !ok {
+		return
+	}
+
+	match := roleArnRe.FindStringSubmatch(roleArn)
+	if match == nil {
+		abortWithRestXMLError(c, http.StatusBadRequest, errCodeValidationError,
+			fmt.Sprintf("%s is invalid", roleArn))
+		return
+	}
+	account, roleName := match[1], match[2]
+	if principal.User == "" {
+		abortWithRestXMLError(c, http.StatusForbidden, errCodeAccessDenied,
+			"Roles may not be assumed by root accounts.")
+		return
+	}
+	if account == "" || (account != principal.AccountID && account != principal.Account) {
+		abortWithRestXMLError(c, http.StatusForbidden, errCodeAccessDenied,
+			fmt.Sprintf(assumeRoleUnauthorizedMessage, requestPrincipalArn(principal), roleArn))
+		return
+	}
+
+	role := getRole(c, principal, roleName, roleArn)
+	if role == nil {
+		return
+	}
+
+	session, err := utils.IssueSessionCredentials(regionName(c), principal, role.Name, duration)
+	if errors.Is(err, utils.ErrNoAccount) {
+		abortWithRestXMLError(c, http.StatusForbidden, errCodeAccessDenied,
+			"Temporary credentials can only be issued to Triton accounts")
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to issue session credentials: %w", err))
+		return
+	}
+
+	log.Printf("[DEBUG] issued role %s session credentials %s until %s\n",
+		role.Name, session.AccessKeyID, session.Expiration.Format(time.RFC3339))
+
+	writeSTSResponse(c, "AssumeRole", assumeRoleResponse{
+		Result: &sts.AssumeRoleOutput{
+			AssumedRoleUser: &sts.AssumedRoleUser{
+				Arn: aws.String(fmt.Sprintf("arn:aws:sts::%s:assumed-role/%s/%s",
+					principal.AccountID, role.Name, sessionName)),
+				AssumedRoleId: aws.String(strings.Join([]string{role.ID, sessionName}, ":")),
+			},
+			Credentials: stsCredentials(session),
+		},
+		ResponseMetadata: stsMetadata(c),
+	})
+}
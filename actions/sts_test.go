@@ -0,0 +1,65 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSGetSessionToken(t *testing.T) {
+	test.GetSTSSvc(t, func(stsSvc *sts.STS) {
+		// The unit testing key belongs to no account, so it cannot get
+		// temporary credentials usable outside of mock-region
+		_, err := stsSvc.GetSessionToken(&sts.GetSessionTokenInput{
+			DurationSeconds: aws.Int64(900),
+		})
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "AccessDenied" {
+			t.Errorf("get session token without account should be denied, got %v", err)
+		}
+
+		// Session tokens are rejected for long-lived access keys
+		tokenSvc := sts.New(session.Must(session.NewSession(&stsSvc.Client.Config)), &aws.Config{
+			Credentials: credentials.NewStaticCredentials("AKID", "SECRET", "invalid"),
+		})
+		_, err = tokenSvc.GetSessionToken(&sts.GetSessionTokenInput{})
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "InvalidClientTokenId" {
+			t.Errorf("invalid session tokens should be rejected, got %v", err)
+		}
+	})
+}
+
+func TestAccAWSAssumeRole(t *testing.T) {
+	test.GetSTSSvc(t, func(stsSvc *sts.STS) {
+		_, err := stsSvc.AssumeRole(&sts.AssumeRoleInput{
+			RoleArn:         aws.String("arn:aws:iam::123456789012:role/other-account"),
+			RoleSessionName: aws.String("test"),
+		})
+		// The unit testing key acts as the account owner, which cannot
+		// assume roles, of its account or any other
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "AccessDenied" {
+			t.Errorf("assume role of other accounts should be denied, got %v", err)
+		}
+
+		_, err = stsSvc.AssumeRole(&sts.AssumeRoleInput{
+			RoleArn:         aws.String("arn:aws:iam::123456789012:role/other-account"),
+			RoleSessionName: aws.String("not a session name"),
+		})
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "ValidationError" {
+			t.Errorf("invalid role session names should be rejected, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,611 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	tritonnetwork "github.com/joyent/triton-go/v2/network"
+	"github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Subnets are the fabric networks of the VLAN of their VPC. Subnet IDs
+// encode the network UUID, like "subnet-0e5a8fc6d6a54ab3a5d6d4b2d2b5e1f0".
+// Fabric networks span the whole datacenter, so subnets are placed into the
+// availability zone given to CreateSubnet, or the first zone of the region.
+
+// subnetsCollection is the store collection for the subnet attributes which
+// have no Triton equivalent
+const subnetsCollection = "subnets"
+
+// Subnet sizes allowed by EC2
+const (
+	minSubnetPrefix = 16
+	maxSubnetPrefix = 28
+)
+
+// subnetIDRe matches the subnet IDs built by subnetID
+var subnetIDRe = regexp.MustCompile(`^subnet-([0-9a-f]{8})([0-9a-f]{4})([0-9a-f]{4})([0-9a-f]{4})([0-9a-f]{12})$`)
+
+// subnetRecord is the shim record of a subnet
+type subnetRecord struct {
+	ID                  string `json:"id"`
+	Owner               string `json:"owner"`
+	Region              string `json:"region"`
+	AvailabilityZone    string `json:"availability_zone,omitempty"`
+	MapPublicIPOnLaunch bool   `json:"map_public_ip_on_launch"`
+}
+
+// fabricNetwork is a fabric network together with the VLAN it belongs to
+type fabricNetwork struct {
+	VLANID  int
+	Network *tritonnetwork.Network
+}
+
+// subnetID returns the subnet ID for the given network UUID
+func subnetID(networkID string) string {
+	return "subnet-" + strings.Replace(networkID, "-", "", -1)
+}
+
+// parseSubnetID returns the network UUID of the given subnet
+func parseSubnetID(id string) (string, bool) {
+	m := subnetIDRe.FindStringSubmatch(id)
+	if m == nil {
+		return "", false
+	}
+	return strings.Join(m[1:], "-"), true
+}
+
+// listFabricNetworks returns the networks of all the account fabric VLANs
+func listFabricNetworks(client *tritonnetwork.NetworkClient) ([]*fabricNetwork, error) {
+	vlans, err := client.Fabrics().ListVLANs(context.Background(), &tritonnetwork.ListVLANsInput{})
+	if err != nil {
+		log.Printf("[ERROR] list fabric vlans error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton fabric vlans: %w", err)
+	}
+
+	var result []*fabricNetwork
+	for _, vlan := range vlans {
+		networks, err := client.Fabrics().List(context.Background(), &tritonnetwork.ListFabricsInput{
+			FabricVLANID: vlan.ID,
+		})
+		if err != nil {
+			log.Printf("[ERROR] list fabric networks error: %v\n", err)
+			return nil, fmt.Errorf("Unable to list triton fabric networks: %w", err)
+		}
+		for _, network := range networks {
+			result = append(result, &fabricNetwork{VLANID: vlan.ID, Network: network})
+		}
+	}
+	return result, nil
+}
+
+// findFabricNetwork returns the fabric network of the given subnet, or nil
+// when it does not exist
+func findFabricNetwork(client *tritonnetwork.NetworkClient, id string) (*fabricNetwork, error) {
+	networkID, ok := parseSubnetID(id)
+	if !ok {
+		return nil, nil
+	}
+
+	networks, err := listFabricNetworks(client)
+	if err != nil {
+		return nil, err
+	}
+	for _, fabric := range networks {
+		if fabric.Network.Id == networkID {
+			return fabric, nil
+		}
+	}
+	return nil, nil
+}
+
+// loadSubnetRecord returns the shim record of a subnet, which is empty for
+// subnets created outside the shim
+func loadSubnetRecord(db *store.Store, region string, owner string, id string) (*subnetRecord, error) {
+	record := &subnetRecord{ID: id, Owner: owner, Region: region}
+	err := db.Get(subnetsCollection, ownedKey(region, owner, id), record)
+	if err != nil && err != store.ErrNotFound {
+		return nil, fmt.Errorf("Unable to load subnet: %w", err)
+	}
+	return record, nil
+}
+
+// zoneByName returns the availability zone with the given name, if any
+func zoneByName(zones []*availabilityZone, name string) *availabilityZone {
+	for _, zone := range zones {
+		if zone.Name == name {
+			return zone
+		}
+	}
+	return nil
+}
+
+// zoneOrDefault returns the availability zone with the given name or, when
+// there is no such zone, the first one. Resources are never left without a
+// zone, even when the region has none.
+func zoneOrDefault(zones []*availabilityZone, name string) *availabilityZone {
+	if zone := zoneByName(zones, name); zone != nil {
+		return zone
+	}
+	if len(zones) > 0 {
+		return zones[0]
+	}
+	return &availabilityZone{}
+}
+
+// fabricNetworkToSubnet converts a fabric network to an EC2 subnet
+func fabricNetworkToSubnet(fabric *fabricNetwork, record *subnetRecord, tags map[string]string,
+	zones []*availabilityZone, defaultNetwork string) *ec2.Subnet {
+
+	network := fabric.Network
+	zone := zoneOrDefault(zones, record.AvailabilityZone)
+
+	return &ec2.Subnet{
+		SubnetId:                aws.String(subnetID(network.Id)),
+		VpcId:                   aws.String(vpcID(fabric.VLANID)),
+		CidrBlock:               aws.String(network.Subnet),
+		AvailableIpAddressCount: aws.Int64(ipRangeSize(network.ProvisioningStartIP, network.ProvisioningEndIP)),
+		AvailabilityZone:        aws.String(zone.Name),
+		AvailabilityZoneId:      aws.String(zone.ID),
+		DefaultForAz:            aws.Bool(network.Id == defaultNetwork),
+		MapPublicIpOnLaunch:     aws.Bool(record.MapPublicIPOnLaunch),
+		OwnerId:                 aws.String(record.Owner),
+		State:                   aws.String(ec2.SubnetStateAvailable),
+		Tags:                    ec2Tags(tags),
+	}
+}
+
+// subnetFiltersMatch tells if the subnet satisfies the request filters
+func subnetFiltersMatch(filters map[string][]string, subnet *ec2.Subnet) bool {
+	tags := make(map[string]string)
+	for _, tag := range subnet.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+
+	return filterMatch(filters, "subnet-id", *subnet.SubnetId) &&
+		filterMatch(filters, "vpc-id", *subnet.VpcId) &&
+		filterMatch(filters, "cidr-block", *subnet.CidrBlock) &&
+		filterMatch(filters, "availability-zone", *subnet.AvailabilityZone) &&
+		filterMatch(filters, "availability-zone-id", *subnet.AvailabilityZoneId) &&
+		filterMatch(filters, "default-for-az", strconv.FormatBool(*subnet.DefaultForAz)) &&
+		filterMatch(filters, "owner-id", *subnet.OwnerId) &&
+		filterMatch(filters, "state", *subnet.State) &&
+		tagFiltersMatch(filters, tags)
+}
+
+// DescribeSubnets lists the account fabric networks as EC2 subnets
+func DescribeSubnets(c *gin.Context) {
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	defaultNetwork, err := getDefaultNetwork(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	zones, err := listAvailabilityZones(regionName(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	networks, err := listFabricNetworks(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	wanted := paramList(c, "SubnetId")
+	for _, id := range wanted {
+		found := false
+		for _, fabric := range networks {
+			if subnetID(fabric.Network.Id) == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			abortWithNotFound(c, "InvalidSubnetID.NotFound", id)
+			return
+		}
+	}
+
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeSubnetsOutput{}
+
+	for _, fabric := range networks {
+		id := subnetID(fabric.Network.Id)
+		if len(wanted) > 0 && !containsString(wanted, id) {
+			continue
+		}
+		record, err := loadSubnetRecord(db, regionName(c), account.ID, id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		tags, err := loadTags(db, regionName(c), account.ID, id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to load subnet tags: %w", err))
+			return
+		}
+		subnet := fabricNetworkToSubnet(fabric, record, tags, zones, defaultNetwork)
+		if subnetFiltersMatch(ec2Filters, subnet) {
+			ec2Output.Subnets = append(ec2Output.Subnets, subnet)
+		}
+	}
+
+	writeResponse(c, "DescribeSubnets", ec2Output)
+}
+
+// CreateSubnet creates a fabric network into the VLAN of the given VPC. Like
+// EC2 does, the first four addresses and the last one are not provisioned:
+// the first one is the network gateway.
+func CreateSubnet(c *gin.Context) {
+	id := param(c, "VpcId")
+	if id == "" {
+		abortWithMissingParameter(c, "VpcId")
+		return
+	}
+	vlanID, ok := parseVpcID(id)
+	if !ok {
+		abortWithNotFound(c, "InvalidVpcID.NotFound", id)
+		return
+	}
+
+	cidrBlock := param(c, "CidrBlock")
+	if cidrBlock == "" {
+		abortWithMissingParameter(c, "CidrBlock")
+		return
+	}
+	_, ipNet, err := net.ParseCIDR(cidrBlock)
+	if err != nil || ipNet.IP.To4() == nil {
+		abortWithInvalidParameter(c, "CidrBlock", cidrBlock)
+		return
+	}
+	prefix := maskPrefix(ipNet)
+	if prefix < minSubnetPrefix || prefix > maxSubnetPrefix {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidSubnet.Range",
+			fmt.Sprintf("The CIDR '%s' is invalid.", cidrBlock), requestID(c)))
+		return
+	}
+
+	zones, err := listAvailabilityZones(regionName(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	zoneName := param(c, "AvailabilityZone")
+	if zoneName != "" && zoneByName(zones, zoneName) == nil {
+		abortWithInvalidParameter(c, "AvailabilityZone", zoneName)
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	_, err = client.Fabrics().GetVLAN(context.Background(), &tritonnetwork.GetVLANInput{
+		ID: vlanID,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithNotFound(c, "InvalidVpcID.NotFound", id)
+			return
+		}
+		log.Printf("[ERROR] get fabric vlan error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to get triton fabric vlan: %w", err))
+		return
+	}
+
+	// Subnets must be inside the CIDR block given to CreateVpc, if any
+	var vpc vpcRecord
+	err = db.Get(vpcsCollection, ownedKey(regionName(c), account.ID, id), &vpc)
+	if err == nil && vpc.CidrBlock != "" {
+		_, vpcNet, _ := net.ParseCIDR(vpc.CidrBlock)
+		if vpcNet == nil || !vpcNet.Contains(ipNet.IP) || prefix < maskPrefix(vpcNet) {
+			abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("InvalidSubnet.Range",
+				fmt.Sprintf("The CIDR '%s' is invalid.", cidrBlock), requestID(c)))
+			return
+		}
+	}
+
+	tags := tagSpecifications(c, ec2.ResourceTypeSubnet)
+	name := tags["Name"]
+	if name == "" {
+		name = fmt.Sprintf("%s-%s", id, strings.Replace(ipNet.String(), "/", "-", -1))
+	}
+
+	first := ipToUint32(ipNet.IP)
+	last := first | ^ipToUint32(net.IP(ipNet.Mask))
+	createInput := &tritonnetwork.CreateFabricInput{
+		FabricVLANID:     vlanID,
+		Name:             name,
+		Subnet:           ipNet.String(),
+		Gateway:          uint32ToIP(first + 1).String(),
+		ProvisionStartIP: uint32ToIP(first + 4).String(),
+		ProvisionEndIP:   uint32ToIP(last - 1).String(),
+		InternetNAT:      true,
+	}
+
+	// Fabric networks have no resolvers by default, use the ones of the
+	// default network
+	if defaultNetwork, err := getDefaultNetwork(regionName(c), requestPrincipal(c)); err == nil && defaultNetwork != "" {
+		network, err := client.Get(context.Background(), &tritonnetwork.GetInput{ID: defaultNetwork})
+		if err == nil {
+			createInput.Resolvers = network.Resolvers
+		}
+	}
+
+	network, err := client.Fabrics().Create(context.Background(), createInput)
+	if err != nil {
+		log.Printf("[ERROR] create fabric network error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton fabric network: %w", err))
+		return
+	}
+
+	record := &subnetRecord{
+		ID:               subnetID(network.Id),
+		Owner:            account.ID,
+		Region:           regionName(c),
+		AvailabilityZone: zoneName,
+	}
+	if err := db.Put(subnetsCollection, ownedKey(record.Region, account.ID, record.ID), record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save subnet: %w", err))
+		return
+	}
+	if err := saveTags(db, record.Region, account.ID, record.ID, tags); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save subnet tags: %w", err))
+		return
+	}
+
+	log.Printf("[DEBUG] created fabric network %s for subnet %s\n", network.Id, record.ID)
+
+	fabric := &fabricNetwork{VLANID: vlanID, Network: network}
+	ec2Output := ec2.CreateSubnetOutput{
+		Subnet: fabricNetworkToSubnet(fabric, record, tags, zones, ""),
+	}
+
+	writeResponse(c, "CreateSubnet", ec2Output)
+}
+
+// DeleteSubnet deletes a fabric network, which must not be used by any
+// instance
+func DeleteSubnet(c *gin.Context) {
+	id := param(c, "SubnetId")
+	if id == "" {
+		abortWithMissingParameter(c, "SubnetId")
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	fabric, err := findFabricNetwork(client, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if fabric == nil {
+		abortWithNotFound(c, "InvalidSubnetID.NotFound", id)
+		return
+	}
+
+	err = client.Fabrics().Delete(context.Background(), &tritonnetwork.DeleteFabricInput{
+		FabricVLANID: fabric.VLANID,
+		NetworkID:    fabric.Network.Id,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusConflict) {
+			abortWithDependencyViolation(c, id)
+			return
+		}
+		log.Printf("[ERROR] delete fabric network error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to delete triton fabric network: %w", err))
+		return
+	}
+
+	if err := db.Delete(subnetsCollection, ownedKey(regionName(c), account.ID, id)); err != nil {
+		log.Printf("[ERROR] delete subnet %s record error: %v\n", id, err)
+	}
+	if err := saveTags(db, regionName(c), account.ID, id, nil); err != nil {
+		log.Printf("[ERROR] delete subnet %s tags error: %v\n", id, err)
+	}
+
+	writeResponse(c, "DeleteSubnet", returnOutput{Return: aws.Bool(true)})
+}
+
+// ModifySubnetAttribute updates the subnet attributes kept by the shim. Only
+// MapPublicIpOnLaunch is supported.
+func ModifySubnetAttribute(c *gin.Context) {
+	id := param(c, "SubnetId")
+	if id == "" {
+		abortWithMissingParameter(c, "SubnetId")
+		return
+	}
+
+	value := param(c, "MapPublicIpOnLaunch.Value")
+	if value == "" {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("UnsupportedOperation",
+			"Only the MapPublicIpOnLaunch attribute can be modified", requestID(c)))
+		return
+	}
+	mapPublicIP, err := strconv.ParseBool(value)
+	if err != nil {
+		abortWithInvalidParameter(c, "MapPublicIpOnLaunch.Value", value)
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	fabric, err := findFabricNetwork(client, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if fabric == nil {
+		abortWithNotFound(c, "InvalidSubnetID.NotFound", id)
+		return
+	}
+
+	record, err := loadSubnetRecord(db, regionName(c), account.ID, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	record.MapPublicIPOnLaunch = mapPublicIP
+	if err := db.Put(subnetsCollection, ownedKey(record.Region, account.ID, id), record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save subnet: %w", err))
+		return
+	}
+
+	writeResponse(c, "ModifySubnetAttribute", returnOutput{Return: aws.Bool(true)})
+}
+
+// subnetNetworks returns the networks of the instances launched into the
+// given subnet. When the subnet maps public IPs on launch, the public network
+// comes first, being the primary one, so instances are reachable through
+// their public IP. It aborts the request and returns false on failure.
+func subnetNetworks(c *gin.Context, id string) ([]string, bool) {
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return nil, false
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return nil, false
+	}
+
+	fabric, err := findFabricNetwork(client, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if fabric == nil {
+		abortWithNotFound(c, "InvalidSubnetID.NotFound", id)
+		return nil, false
+	}
+
+	record, err := loadSubnetRecord(db, regionName(c), account.ID, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if !record.MapPublicIPOnLaunch {
+		return []string{fabric.Network.Id}, true
+	}
+
+	public, err := publicNetwork(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return []string{public.Id, fabric.Network.Id}, true
+}
@@ -0,0 +1,81 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSSubnets(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		vpc, err := ec2Svc.CreateVpc(&ec2.CreateVpcInput{
+			CidrBlock: aws.String("10.201.0.0/16"),
+		})
+		if err != nil {
+			t.Errorf("create vpc error %v", err)
+			return
+		}
+		defer ec2Svc.DeleteVpc(&ec2.DeleteVpcInput{VpcId: vpc.Vpc.VpcId})
+
+		_, err = ec2Svc.CreateSubnet(&ec2.CreateSubnetInput{
+			VpcId:     vpc.Vpc.VpcId,
+			CidrBlock: aws.String("10.202.0.0/24"),
+		})
+		if err == nil {
+			t.Errorf("create subnet should fail outside of the vpc cidr block")
+		}
+
+		created, err := ec2Svc.CreateSubnet(&ec2.CreateSubnetInput{
+			VpcId:     vpc.Vpc.VpcId,
+			CidrBlock: aws.String("10.201.1.0/24"),
+		})
+		if err != nil {
+			t.Errorf("create subnet error %v", err)
+			return
+		}
+
+		subnetID := created.Subnet.SubnetId
+		if *created.Subnet.AvailableIpAddressCount != 251 {
+			t.Errorf("unexpected subnet available ips %d",
+				*created.Subnet.AvailableIpAddressCount)
+		}
+
+		_, err = ec2Svc.ModifySubnetAttribute(&ec2.ModifySubnetAttributeInput{
+			SubnetId:            subnetID,
+			MapPublicIpOnLaunch: &ec2.AttributeBooleanValue{Value: aws.Bool(true)},
+		})
+		if err != nil {
+			t.Errorf("modify subnet attribute error %v", err)
+		}
+
+		described, err := ec2Svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("vpc-id"),
+				Values: []*string{vpc.Vpc.VpcId},
+			}},
+		})
+		if err != nil {
+			t.Errorf("describe subnets error %v", err)
+		} else if len(described.Subnets) != 1 {
+			t.Errorf("expected one subnet into the vpc, got %d", len(described.Subnets))
+		} else if !*described.Subnets[0].MapPublicIpOnLaunch {
+			t.Errorf("subnet should map public ips on launch")
+		}
+
+		_, err = ec2Svc.DeleteSubnet(&ec2.DeleteSubnetInput{SubnetId: subnetID})
+		if err != nil {
+			t.Errorf("delete subnet error %v", err)
+		}
+	})
+}
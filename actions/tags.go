@@ -0,0 +1,88 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/store"
+)
+
+// tagsCollection is the store collection for the tags of the resources
+// which cannot be tagged into Triton, like VPCs (fabric VLANs). Instance
+// tags are kept as Triton machine tags instead.
+const tagsCollection = "tags"
+
+// loadTags returns the tags of the given resource, if any
+func loadTags(db *store.Store, region string, owner string, resourceID string) (map[string]string, error) {
+	tags := make(map[string]string)
+	err := db.Get(tagsCollection, ownedKey(region, owner, resourceID), &tags)
+	if err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// saveTags replaces the tags of the given resource
+func saveTags(db *store.Store, region string, owner string, resourceID string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return db.Delete(tagsCollection, ownedKey(region, owner, resourceID))
+	}
+	return db.Put(tagsCollection, ownedKey(region, owner, resourceID), tags)
+}
+
+// ec2Tags converts a tags map into an EC2 tag set, sorted by key
+func ec2Tags(tags map[string]string) []*ec2.Tag {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]*ec2.Tag, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, &ec2.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(tags[key]),
+		})
+	}
+	return result
+}
+
+// tagFiltersMatch tells if the tags satisfy the "tag:<key>" and "tag-key"
+// request filters
+func tagFiltersMatch(filters map[string][]string, tags map[string]string) bool {
+	for name, values := range filters {
+		if name == "tag-key" {
+			matched := false
+			for _, key := range values {
+				if _, found := tags[key]; found {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		if !strings.HasPrefix(name, "tag:") {
+			continue
+		}
+		value, found := tags[strings.TrimPrefix(name, "tag:")]
+		if !found || !containsString(values, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,754 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritonclient "github.com/joyent/triton-go/v2/client"
+	tritoncompute "github.com/joyent/triton-go/v2/compute"
+	"github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Volumes are Triton NFS shared volumes. Volume IDs encode the volume UUID,
+// like "vol-0e5a8fc6d6a54ab3a5d6d4b2d2b5e1f0". NFS volumes are not block
+// devices: instances mount them through the network, using the mount
+// configuration kept into their "volumes" metadata, which has the format
+// CloudAPI uses for the volumes of new machines. Attaching a volume adds it
+// there, with the attachment device as the mount point, and the same volume
+// can be attached to several instances.
+
+// volumesCollection is the store collection for the volume attributes which
+// have no Triton equivalent
+const volumesCollection = "volumes"
+
+// volumeType is the EC2 volume type of Triton volumes. It is a shim type, so
+// users don't expect the behavior of an EBS volume type.
+const volumeType = "triton-nfs"
+
+// tritonVolumeType is the Triton type of NFS shared volumes
+const tritonVolumeType = "tritonnfs"
+
+// volumesMetadataKey is the instance metadata key with the volumes to mount
+const volumesMetadataKey = "volumes"
+
+// volumeIDRe matches the volume IDs built by volumeID
+var volumeIDRe = regexp.MustCompile(`^vol-([0-9a-f]{8})([0-9a-f]{4})([0-9a-f]{4})([0-9a-f]{4})([0-9a-f]{12})$`)
+
+// volumeRecord is the shim record of a volume
+type volumeRecord struct {
+	ID               string `json:"id"`
+	Owner            string `json:"owner"`
+	Region           string `json:"region"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+}
+
+// volumeAttachment is a volume mounted by an instance
+type volumeAttachment struct {
+	InstanceID string
+	Mountpoint string
+}
+
+// volumeSize is one of the volume sizes supported by Triton, in MiB
+type volumeSize struct {
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// volumeID returns the volume ID for the given Triton volume UUID
+func volumeID(uuid string) string {
+	return "vol-" + strings.Replace(uuid, "-", "", -1)
+}
+
+// parseVolumeID returns the Triton volume UUID of the given volume
+func parseVolumeID(id string) (string, bool) {
+	m := volumeIDRe.FindStringSubmatch(id)
+	if m == nil {
+		return "", false
+	}
+	return strings.Join(m[1:], "-"), true
+}
+
+// listVolumeSizes returns the sizes supported for NFS volumes, sorted.
+// triton-go does not provide the CloudAPI ListVolumeSizes endpoint.
+func listVolumeSizes(client *tritoncompute.ComputeClient) ([]int64, error) {
+	reqInputs := tritonclient.RequestInput{
+		Method: http.MethodGet,
+		Path:   path.Join("/", client.Client.AccountName, "volumesizes"),
+	}
+	respReader, err := client.Client.ExecuteRequest(context.Background(), reqInputs)
+	if respReader != nil {
+		defer respReader.Close()
+	}
+	if err != nil {
+		log.Printf("[ERROR] list volume sizes error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton volume sizes: %w", err)
+	}
+
+	var result []*volumeSize
+	if err := json.NewDecoder(respReader).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Unable to decode triton volume sizes: %w", err)
+	}
+
+	var sizes []int64
+	for _, size := range result {
+		if size.Type == tritonVolumeType {
+			sizes = append(sizes, size.Size)
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	return sizes, nil
+}
+
+// volumeSizeFor returns the smallest supported size, in MiB, able to hold
+// the given GiB, or zero when all of them are smaller
+func volumeSizeFor(sizes []int64, gib int64) int64 {
+	for _, size := range sizes {
+		if size >= gib*1024 {
+			return size
+		}
+	}
+	return 0
+}
+
+// listVolumes returns the account NFS volumes, except the deleted ones
+func listVolumes(client *tritoncompute.ComputeClient) ([]*tritoncompute.Volume, error) {
+	volumes, err := client.Volumes().List(context.Background(), &tritoncompute.ListVolumesInput{
+		Type: tritonVolumeType,
+	})
+	if err != nil {
+		log.Printf("[ERROR] list volumes error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton volumes: %w", err)
+	}
+
+	var result []*tritoncompute.Volume
+	for _, volume := range volumes {
+		if volume.State != "deleted" {
+			result = append(result, volume)
+		}
+	}
+	return result, nil
+}
+
+// findVolume returns the volume with the given EC2 ID, or nil when it does
+// not exist
+func findVolume(client *tritoncompute.ComputeClient, id string) (*tritoncompute.Volume, error) {
+	uuid, ok := parseVolumeID(id)
+	if !ok {
+		return nil, nil
+	}
+
+	volumes, err := listVolumes(client)
+	if err != nil {
+		return nil, err
+	}
+	for _, volume := range volumes {
+		if volume.ID == uuid {
+			return volume, nil
+		}
+	}
+	return nil, nil
+}
+
+// instanceMounts returns the volumes mount configuration of an instance
+func instanceMounts(vm *tritoncompute.Instance) []tritoncompute.InstanceVolume {
+	var mounts []tritoncompute.InstanceVolume
+	if value, ok := vm.Metadata[volumesMetadataKey].(string); ok {
+		if err := json.Unmarshal([]byte(value), &mounts); err != nil {
+			log.Printf("[ERROR] vm %s has invalid volumes metadata: %v\n", vm.ID, err)
+			return nil
+		}
+	}
+	return mounts
+}
+
+// saveInstanceMounts replaces the volumes mount configuration of an instance
+func saveInstanceMounts(client *tritoncompute.ComputeClient, vm *tritoncompute.Instance,
+	mounts []tritoncompute.InstanceVolume) error {
+
+	if len(mounts) == 0 {
+		return client.Instances().DeleteMetadata(context.Background(), &tritoncompute.DeleteMetadataInput{
+			ID:  vm.ID,
+			Key: volumesMetadataKey,
+		})
+	}
+
+	value, err := json.Marshal(mounts)
+	if err != nil {
+		return err
+	}
+	_, err = client.Instances().UpdateMetadata(context.Background(), &tritoncompute.UpdateMetadataInput{
+		ID:       vm.ID,
+		Metadata: map[string]interface{}{volumesMetadataKey: string(value)},
+	})
+	return err
+}
+
+// volumeAttachments returns the attachments of every volume, by volume
+// name. Machines created with a volume are attachments too, even if they
+// have no mount configuration from the shim.
+func volumeAttachments(vms []*tritoncompute.Instance, volumes []*tritoncompute.Volume) map[string][]*volumeAttachment {
+	attachments := make(map[string][]*volumeAttachment)
+	for _, vm := range vms {
+		for _, mount := range instanceMounts(vm) {
+			attachments[mount.Name] = append(attachments[mount.Name], &volumeAttachment{
+				InstanceID: vm.ID,
+				Mountpoint: mount.Mountpoint,
+			})
+		}
+	}
+
+	for _, volume := range volumes {
+		for _, ref := range volume.Refs {
+			found := false
+			for _, attachment := range attachments[volume.Name] {
+				found = found || attachment.InstanceID == ref
+			}
+			if !found {
+				attachments[volume.Name] = append(attachments[volume.Name],
+					&volumeAttachment{InstanceID: ref})
+			}
+		}
+	}
+	return attachments
+}
+
+// volumeState converts a Triton volume state to the EC2 one
+func volumeState(volume *tritoncompute.Volume, attached bool) string {
+	switch volume.State {
+	case "creating":
+		return ec2.VolumeStateCreating
+	case "ready":
+		if attached {
+			return ec2.VolumeStateInUse
+		}
+		return ec2.VolumeStateAvailable
+	case "deleting":
+		return ec2.VolumeStateDeleting
+	case "deleted":
+		return ec2.VolumeStateDeleted
+	default:
+		return ec2.VolumeStateError
+	}
+}
+
+// volumeToEC2 converts a Triton volume to an EC2 volume
+func volumeToEC2(volume *tritoncompute.Volume, record *volumeRecord, attachments []*volumeAttachment,
+	tags map[string]string, zones []*availabilityZone) *ec2.Volume {
+
+	zone := zoneOrDefault(zones, record.AvailabilityZone)
+
+	id := volumeID(volume.ID)
+	ec2Volume := &ec2.Volume{
+		VolumeId:           aws.String(id),
+		VolumeType:         aws.String(volumeType),
+		Size:               aws.Int64((volume.Size + 1023) / 1024),
+		State:              aws.String(volumeState(volume, len(attachments) > 0)),
+		AvailabilityZone:   aws.String(zone.Name),
+		Encrypted:          aws.Bool(false),
+		MultiAttachEnabled: aws.Bool(true),
+		Attachments:        []*ec2.VolumeAttachment{},
+		Tags:               ec2Tags(tags),
+	}
+	for _, attachment := range attachments {
+		ec2Volume.Attachments = append(ec2Volume.Attachments, &ec2.VolumeAttachment{
+			VolumeId:            aws.String(id),
+			InstanceId:          aws.String(attachment.InstanceID),
+			Device:              aws.String(attachment.Mountpoint),
+			State:               aws.String(ec2.VolumeAttachmentStateAttached),
+			DeleteOnTermination: aws.Bool(false),
+		})
+	}
+	return ec2Volume
+}
+
+// volumeFiltersMatch tells if the volume satisfies the request filters
+func volumeFiltersMatch(filters map[string][]string, volume *ec2.Volume, tags map[string]string) bool {
+	if !filterMatch(filters, "volume-id", *volume.VolumeId) ||
+		!filterMatch(filters, "volume-type", *volume.VolumeType) ||
+		!filterMatch(filters, "size", strconv.FormatInt(*volume.Size, 10)) ||
+		!filterMatch(filters, "status", *volume.State) ||
+		!filterMatch(filters, "availability-zone", *volume.AvailabilityZone) ||
+		!filterMatch(filters, "encrypted", "false") ||
+		!filterMatch(filters, "multi-attach-enabled", "true") ||
+		!tagFiltersMatch(filters, tags) {
+		return false
+	}
+
+	for _, name := range []string{"attachment.instance-id", "attachment.device", "attachment.status"} {
+		if _, found := filters[name]; !found {
+			continue
+		}
+		matched := false
+		for _, attachment := range volume.Attachments {
+			matched = matched ||
+				(filterMatch(filters, "attachment.instance-id", *attachment.InstanceId) &&
+					filterMatch(filters, "attachment.device", *attachment.Device) &&
+					filterMatch(filters, "attachment.status", *attachment.State))
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// loadVolumeRecord returns the shim record of a volume, which is empty for
+// volumes created outside the shim
+func loadVolumeRecord(db *store.Store, region string, owner string, id string) (*volumeRecord, error) {
+	record := &volumeRecord{ID: id, Owner: owner, Region: region}
+	err := db.Get(volumesCollection, ownedKey(region, owner, id), record)
+	if err != nil && err != store.ErrNotFound {
+		return nil, fmt.Errorf("Unable to load volume: %w", err)
+	}
+	return record, nil
+}
+
+// listInstances returns all the account instances
+func listInstances(client *tritoncompute.ComputeClient) ([]*tritoncompute.Instance, error) {
+	vms, err := client.Instances().List(context.Background(), &tritoncompute.ListInstancesInput{})
+	if err != nil {
+		log.Printf("[ERROR] list vms error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton compute instances: %w", err)
+	}
+	return vms, nil
+}
+
+// DescribeVolumes lists the account NFS volumes as EC2 volumes
+func DescribeVolumes(c *gin.Context) {
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	zones, err := listAvailabilityZones(regionName(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	volumes, err := listVolumes(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	wanted := paramList(c, "VolumeId")
+	for _, id := range wanted {
+		found := false
+		for _, volume := range volumes {
+			found = found || volumeID(volume.ID) == id
+		}
+		if !found {
+			abortWithNotFound(c, "InvalidVolume.NotFound", id)
+			return
+		}
+	}
+
+	vms, err := listInstances(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	attachments := volumeAttachments(vms, volumes)
+
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeVolumesOutput{}
+
+	for _, volume := range volumes {
+		id := volumeID(volume.ID)
+		if len(wanted) > 0 && !containsString(wanted, id) {
+			continue
+		}
+		record, err := loadVolumeRecord(db, regionName(c), account.ID, id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		tags, err := loadTags(db, regionName(c), account.ID, id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError,
+				fmt.Errorf("Unable to load volume tags: %w", err))
+			return
+		}
+		ec2Volume := volumeToEC2(volume, record, attachments[volume.Name], tags, zones)
+		if volumeFiltersMatch(ec2Filters, ec2Volume, tags) {
+			ec2Output.Volumes = append(ec2Output.Volumes, ec2Volume)
+		}
+	}
+
+	writeResponse(c, "DescribeVolumes", ec2Output)
+}
+
+// CreateVolume creates an NFS volume of the smallest supported size able to
+// hold the requested one. Volumes cannot be created from snapshots.
+func CreateVolume(c *gin.Context) {
+	if snapshotID := param(c, "SnapshotId"); snapshotID != "" {
+		abortWithInvalidParameter(c, "SnapshotId", snapshotID)
+		return
+	}
+
+	sizeParam := param(c, "Size")
+	if sizeParam == "" {
+		abortWithMissingParameter(c, "Size")
+		return
+	}
+	gib, err := strconv.ParseInt(sizeParam, 10, 64)
+	if err != nil || gib < 1 {
+		abortWithInvalidParameter(c, "Size", sizeParam)
+		return
+	}
+
+	zoneName := param(c, "AvailabilityZone")
+	if zoneName == "" {
+		abortWithMissingParameter(c, "AvailabilityZone")
+		return
+	}
+	zones, err := listAvailabilityZones(regionName(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if zoneByName(zones, zoneName) == nil {
+		abortWithInvalidParameter(c, "AvailabilityZone", zoneName)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	sizes, err := listVolumeSizes(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	size := volumeSizeFor(sizes, gib)
+	if size == 0 {
+		abortWithInvalidParameter(c, "Size", sizeParam)
+		return
+	}
+
+	tags := tagSpecifications(c, ec2.ResourceTypeVolume)
+	volume, err := client.Volumes().Create(context.Background(), &tritoncompute.CreateVolumeInput{
+		Name: tags["Name"],
+		Size: size,
+		Type: tritonVolumeType,
+	})
+	if err != nil {
+		log.Printf("[ERROR] create volume error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton volume: %w", err))
+		return
+	}
+
+	record := &volumeRecord{
+		ID:               volumeID(volume.ID),
+		Owner:            account.ID,
+		Region:           regionName(c),
+		AvailabilityZone: zoneName,
+	}
+	if err := db.Put(volumesCollection, ownedKey(record.Region, account.ID, record.ID), record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save volume: %w", err))
+		return
+	}
+	if err := saveTags(db, record.Region, account.ID, record.ID, tags); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save volume tags: %w", err))
+		return
+	}
+
+	log.Printf("[DEBUG] created volume %s of %d MiB\n", volume.ID, size)
+
+	writeResponse(c, "CreateVolume", volumeToEC2(volume, record, nil, tags, zones))
+}
+
+// DeleteVolume deletes an NFS volume, which must not be attached to any
+// instance
+func DeleteVolume(c *gin.Context) {
+	id := param(c, "VolumeId")
+	if id == "" {
+		abortWithMissingParameter(c, "VolumeId")
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	volume, err := findVolume(client, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if volume == nil {
+		abortWithNotFound(c, "InvalidVolume.NotFound", id)
+		return
+	}
+
+	vms, err := listInstances(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if len(volumeAttachments(vms, []*tritoncompute.Volume{volume})[volume.Name]) > 0 {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("VolumeInUse",
+			fmt.Sprintf("Volume %s is currently attached", id), requestID(c)))
+		return
+	}
+
+	err = client.Volumes().Delete(context.Background(), &tritoncompute.DeleteVolumeInput{
+		ID: volume.ID,
+	})
+	if err != nil {
+		log.Printf("[ERROR] delete volume error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to delete triton volume: %w", err))
+		return
+	}
+
+	if err := db.Delete(volumesCollection, ownedKey(regionName(c), account.ID, id)); err != nil {
+		log.Printf("[ERROR] delete volume %s record error: %v\n", id, err)
+	}
+	if err := saveTags(db, regionName(c), account.ID, id, nil); err != nil {
+		log.Printf("[ERROR] delete volume %s tags error: %v\n", id, err)
+	}
+
+	writeResponse(c, "DeleteVolume", returnOutput{Return: aws.Bool(true)})
+}
+
+// AttachVolume adds a volume to the mount configuration of an instance. The
+// device is the path where the instance mounts the volume, like /data.
+func AttachVolume(c *gin.Context) {
+	id := param(c, "VolumeId")
+	if id == "" {
+		abortWithMissingParameter(c, "VolumeId")
+		return
+	}
+	instanceID := param(c, "InstanceId")
+	if instanceID == "" {
+		abortWithMissingParameter(c, "InstanceId")
+		return
+	}
+	device := param(c, "Device")
+	if device == "" {
+		abortWithMissingParameter(c, "Device")
+		return
+	}
+	if !strings.HasPrefix(device, "/") {
+		abortWithInvalidParameter(c, "Device", device)
+		return
+	}
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	volume, err := findVolume(client, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if volume == nil {
+		abortWithNotFound(c, "InvalidVolume.NotFound", id)
+		return
+	}
+	if volume.State != "ready" {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("IncorrectState",
+			fmt.Sprintf("Volume %s is not ready", id), requestID(c)))
+		return
+	}
+
+	vm := getInstance(c, client, instanceID)
+	if vm == nil {
+		return
+	}
+
+	mounts := instanceMounts(vm)
+	for _, mount := range mounts {
+		if mount.Name == volume.Name {
+			abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("VolumeInUse",
+				fmt.Sprintf("%s is already attached to an instance", id), requestID(c)))
+			return
+		}
+		if mount.Mountpoint == device {
+			abortWithInvalidParameter(c, "Device", device)
+			return
+		}
+	}
+
+	mounts = append(mounts, tritoncompute.InstanceVolume{
+		Name:       volume.Name,
+		Type:       tritonVolumeType,
+		Mode:       "rw",
+		Mountpoint: device,
+	})
+	if err := saveInstanceMounts(client, vm, mounts); err != nil {
+		log.Printf("[ERROR] update vm %s volumes error: %v\n", vm.ID, err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to update triton instance volumes: %w", err))
+		return
+	}
+
+	writeResponse(c, "AttachVolume", ec2.VolumeAttachment{
+		VolumeId:            aws.String(id),
+		InstanceId:          aws.String(vm.ID),
+		Device:              aws.String(device),
+		State:               aws.String(ec2.VolumeAttachmentStateAttached),
+		DeleteOnTermination: aws.Bool(false),
+	})
+}
+
+// DetachVolume removes a volume from the mount configuration of an instance.
+// Volumes attached to several instances require the InstanceId.
+func DetachVolume(c *gin.Context) {
+	id := param(c, "VolumeId")
+	if id == "" {
+		abortWithMissingParameter(c, "VolumeId")
+		return
+	}
+	instanceID := param(c, "InstanceId")
+	device := param(c, "Device")
+
+	client, err := tritonutils.GetTritonComputeClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton compute client: %w", err))
+		return
+	}
+
+	volume, err := findVolume(client, id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if volume == nil {
+		abortWithNotFound(c, "InvalidVolume.NotFound", id)
+		return
+	}
+
+	vms, err := listInstances(client)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var attached []*tritoncompute.Instance
+	for _, vm := range vms {
+		if instanceID != "" && vm.ID != instanceID {
+			continue
+		}
+		for _, mount := range instanceMounts(vm) {
+			if mount.Name == volume.Name && (device == "" || mount.Mountpoint == device) {
+				attached = append(attached, vm)
+				break
+			}
+		}
+	}
+	if len(attached) == 0 {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError("IncorrectState",
+			fmt.Sprintf("Volume '%s' is in the 'available' state", id), requestID(c)))
+		return
+	}
+	if len(attached) > 1 {
+		abortWithMissingParameter(c, "InstanceId")
+		return
+	}
+
+	vm := attached[0]
+	var mounts []tritoncompute.InstanceVolume
+	var mountpoint string
+	for _, mount := range instanceMounts(vm) {
+		if mount.Name == volume.Name {
+			mountpoint = mount.Mountpoint
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := saveInstanceMounts(client, vm, mounts); err != nil {
+		log.Printf("[ERROR] update vm %s volumes error: %v\n", vm.ID, err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to update triton instance volumes: %w", err))
+		return
+	}
+
+	writeResponse(c, "DetachVolume", ec2.VolumeAttachment{
+		VolumeId:            aws.String(id),
+		InstanceId:          aws.String(vm.ID),
+		Device:              aws.String(mountpoint),
+		State:               aws.String(ec2.VolumeAttachmentStateDetached),
+		DeleteOnTermination: aws.Bool(false),
+	})
+}
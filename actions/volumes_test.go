@@ -0,0 +1,76 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSVolumes(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		zones, err := ec2Svc.DescribeAvailabilityZones(nil)
+		if err != nil || len(zones.AvailabilityZones) == 0 {
+			t.Errorf("describe availability zones error %v", err)
+			return
+		}
+
+		created, err := ec2Svc.CreateVolume(&ec2.CreateVolumeInput{
+			AvailabilityZone: zones.AvailabilityZones[0].ZoneName,
+			Size:             aws.Int64(5),
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeVolume),
+				Tags: []*ec2.Tag{{
+					Key:   aws.String("Name"),
+					Value: aws.String("triton-shim-test"),
+				}},
+			}},
+		})
+		if err != nil {
+			t.Errorf("create volume error %v", err)
+			return
+		}
+
+		volumeID := created.VolumeId
+		if *created.Size < 5 {
+			t.Errorf("unexpected volume size %d", *created.Size)
+		}
+		if *created.VolumeType != "triton-nfs" {
+			t.Errorf("unexpected volume type %s", *created.VolumeType)
+		}
+
+		described, err := ec2Svc.DescribeVolumes(&ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("tag:Name"),
+				Values: []*string{aws.String("triton-shim-test")},
+			}},
+		})
+		if err != nil {
+			t.Errorf("describe volumes by tag error %v", err)
+		} else if len(described.Volumes) != 1 || *described.Volumes[0].VolumeId != *volumeID {
+			t.Errorf("describe volumes by tag did not return the new volume")
+		}
+
+		err = ec2Svc.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{volumeID},
+		})
+		if err != nil {
+			t.Errorf("wait for volume error %v", err)
+		}
+
+		_, err = ec2Svc.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: volumeID})
+		if err != nil {
+			t.Errorf("delete volume error %v", err)
+		}
+	})
+}
@@ -0,0 +1,421 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	tritonerrors "github.com/joyent/triton-go/v2/errors"
+	tritonnetwork "github.com/joyent/triton-go/v2/network"
+	"github.com/joyent/triton-shim/errors"
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// VPCs are Triton fabric VLANs. VPC IDs encode the VLAN ID, like
+// "vpc-00000000000000002" for VLAN 2, so they are only unique per account.
+// The default VPC is the VLAN holding the account default network.
+
+// vpcsCollection is the store collection for the VPC details Triton does not
+// keep, like the CIDR block requested by CreateVpc
+const vpcsCollection = "vpcs"
+
+// Fabric VLAN IDs used by CreateVpc
+const (
+	minVLANID = 2
+	maxVLANID = 4094
+)
+
+// vpcRecord is the shim record of a VPC created by CreateVpc
+type vpcRecord struct {
+	ID        string `json:"id"`
+	Owner     string `json:"owner"`
+	Region    string `json:"region"`
+	CidrBlock string `json:"cidr_block"`
+}
+
+// vpcID returns the VPC ID for the given fabric VLAN
+func vpcID(vlanID int) string {
+	return fmt.Sprintf("vpc-%017x", vlanID)
+}
+
+// parseVpcID returns the fabric VLAN ID of the given VPC
+func parseVpcID(id string) (int, bool) {
+	if !strings.HasPrefix(id, "vpc-") {
+		return 0, false
+	}
+	vlanID, err := strconv.ParseUint(strings.TrimPrefix(id, "vpc-"), 16, 12)
+	if err != nil {
+		return 0, false
+	}
+	return int(vlanID), true
+}
+
+// vlanToVpc converts a fabric VLAN and its networks to an EC2 VPC. The CIDR
+// block is the one given to CreateVpc or, for VLANs not created through the
+// shim, the subnet of its first network.
+func vlanToVpc(vlan *tritonnetwork.FabricVLAN, networks []*tritonnetwork.Network,
+	record *vpcRecord, tags map[string]string, owner string, defaultNetwork string) *ec2.Vpc {
+
+	var cidrs []string
+	if record != nil && record.CidrBlock != "" {
+		cidrs = append(cidrs, record.CidrBlock)
+	}
+	isDefault := false
+	for _, network := range networks {
+		if network.Id == defaultNetwork {
+			isDefault = true
+		}
+		if network.Subnet != "" && !containsString(cidrs, network.Subnet) {
+			cidrs = append(cidrs, network.Subnet)
+		}
+	}
+
+	vpc := &ec2.Vpc{
+		VpcId:           aws.String(vpcID(vlan.ID)),
+		DhcpOptionsId:   aws.String("default"),
+		InstanceTenancy: aws.String(ec2.TenancyDefault),
+		IsDefault:       aws.Bool(isDefault),
+		OwnerId:         aws.String(owner),
+		State:           aws.String(ec2.VpcStateAvailable),
+		Tags:            ec2Tags(tags),
+	}
+	for i, cidr := range cidrs {
+		if i == 0 {
+			vpc.CidrBlock = aws.String(cidr)
+		}
+		vpc.CidrBlockAssociationSet = append(vpc.CidrBlockAssociationSet,
+			&ec2.VpcCidrBlockAssociation{
+				AssociationId: aws.String(fmt.Sprintf("vpc-cidr-assoc-%012x%05x", vlan.ID, i)),
+				CidrBlock:     aws.String(cidr),
+				CidrBlockState: &ec2.VpcCidrBlockState{
+					State: aws.String(ec2.VpcCidrBlockStateCodeAssociated),
+				},
+			})
+	}
+	return vpc
+}
+
+// describeVpc retrieves the networks and the shim records of a fabric VLAN
+// to convert it into an EC2 VPC
+func describeVpc(client *tritonnetwork.NetworkClient, db *store.Store, region string,
+	vlan *tritonnetwork.FabricVLAN, owner string, defaultNetwork string) (*ec2.Vpc, error) {
+
+	networks, err := client.Fabrics().List(context.Background(), &tritonnetwork.ListFabricsInput{
+		FabricVLANID: vlan.ID,
+	})
+	if err != nil {
+		log.Printf("[ERROR] list fabric networks error: %v\n", err)
+		return nil, fmt.Errorf("Unable to list triton fabric networks: %w", err)
+	}
+
+	id := vpcID(vlan.ID)
+	var record *vpcRecord
+	var found vpcRecord
+	err = db.Get(vpcsCollection, ownedKey(region, owner, id), &found)
+	if err == nil {
+		record = &found
+	} else if err != store.ErrNotFound {
+		return nil, fmt.Errorf("Unable to load vpc: %w", err)
+	}
+
+	tags, err := loadTags(db, region, owner, id)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load vpc tags: %w", err)
+	}
+
+	return vlanToVpc(vlan, networks, record, tags, owner, defaultNetwork), nil
+}
+
+// vpcFiltersMatch tells if the VPC satisfies the request filters
+func vpcFiltersMatch(filters map[string][]string, vpc *ec2.Vpc) bool {
+	cidrMatched := false
+	for _, assoc := range vpc.CidrBlockAssociationSet {
+		if filterMatch(filters, "cidr-block-association.cidr-block", *assoc.CidrBlock) {
+			cidrMatched = true
+			break
+		}
+	}
+	if !cidrMatched && len(filters["cidr-block-association.cidr-block"]) > 0 {
+		return false
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range vpc.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+
+	return filterMatch(filters, "vpc-id", *vpc.VpcId) &&
+		filterMatch(filters, "cidr", aws.StringValue(vpc.CidrBlock)) &&
+		filterMatch(filters, "is-default", strconv.FormatBool(*vpc.IsDefault)) &&
+		filterMatch(filters, "owner-id", *vpc.OwnerId) &&
+		filterMatch(filters, "state", *vpc.State) &&
+		tagFiltersMatch(filters, tags)
+}
+
+// DescribeVpcs lists the account fabric VLANs as EC2 VPCs
+func DescribeVpcs(c *gin.Context) {
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	defaultNetwork, err := getDefaultNetwork(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	vlans, err := client.Fabrics().ListVLANs(context.Background(), &tritonnetwork.ListVLANsInput{})
+	if err != nil {
+		log.Printf("[ERROR] list fabric vlans error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to list triton fabric vlans: %w", err))
+		return
+	}
+	sort.Slice(vlans, func(i, j int) bool {
+		return vlans[i].ID < vlans[j].ID
+	})
+
+	wanted := paramList(c, "VpcId")
+	for _, id := range wanted {
+		found := false
+		for _, vlan := range vlans {
+			if vpcID(vlan.ID) == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			abortWithNotFound(c, "InvalidVpcID.NotFound", id)
+			return
+		}
+	}
+
+	ec2Filters := filters(c)
+	ec2Output := ec2.DescribeVpcsOutput{}
+
+	for _, vlan := range vlans {
+		if len(wanted) > 0 && !containsString(wanted, vpcID(vlan.ID)) {
+			continue
+		}
+		vpc, err := describeVpc(client, db, regionName(c), vlan, account.ID, defaultNetwork)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if vpcFiltersMatch(ec2Filters, vpc) {
+			ec2Output.Vpcs = append(ec2Output.Vpcs, vpc)
+		}
+	}
+
+	writeResponse(c, "DescribeVpcs", ec2Output)
+}
+
+// CreateVpc creates a fabric VLAN using the lowest free VLAN ID. Triton has
+// no CIDR block for VLANs, so the requested one is kept by the shim, and
+// subnets are expected to be created inside it.
+func CreateVpc(c *gin.Context) {
+	cidrBlock := param(c, "CidrBlock")
+	if cidrBlock == "" {
+		abortWithMissingParameter(c, "CidrBlock")
+		return
+	}
+	_, ipNet, err := net.ParseCIDR(cidrBlock)
+	if err != nil || ipNet.IP.To4() == nil {
+		abortWithInvalidParameter(c, "CidrBlock", cidrBlock)
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	vlans, err := client.Fabrics().ListVLANs(context.Background(), &tritonnetwork.ListVLANsInput{})
+	if err != nil {
+		log.Printf("[ERROR] list fabric vlans error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to list triton fabric vlans: %w", err))
+		return
+	}
+
+	used := make(map[int]bool)
+	for _, vlan := range vlans {
+		used[vlan.ID] = true
+	}
+	vlanID := minVLANID
+	for vlanID <= maxVLANID && used[vlanID] {
+		vlanID++
+	}
+	if vlanID > maxVLANID {
+		abortWithXMLError(c, http.StatusBadRequest, errors.ResponseError(
+			"VpcLimitExceeded", "The maximum number of VPCs has been reached.", requestID(c)))
+		return
+	}
+
+	id := vpcID(vlanID)
+	tags := tagSpecifications(c, ec2.ResourceTypeVpc)
+	name := tags["Name"]
+	if name == "" {
+		name = id
+	}
+
+	vlan, err := client.Fabrics().CreateVLAN(context.Background(), &tritonnetwork.CreateVLANInput{
+		ID:   vlanID,
+		Name: name,
+	})
+	if err != nil {
+		log.Printf("[ERROR] create fabric vlan error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton fabric vlan: %w", err))
+		return
+	}
+
+	record := &vpcRecord{
+		ID:        id,
+		Owner:     account.ID,
+		Region:    regionName(c),
+		CidrBlock: ipNet.String(),
+	}
+	if err := db.Put(vpcsCollection, ownedKey(record.Region, account.ID, id), record); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save vpc: %w", err))
+		return
+	}
+	if err := saveTags(db, record.Region, account.ID, id, tags); err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to save vpc tags: %w", err))
+		return
+	}
+
+	log.Printf("[DEBUG] created fabric vlan %d for vpc %s\n", vlan.ID, id)
+
+	ec2Output := ec2.CreateVpcOutput{
+		Vpc: vlanToVpc(vlan, nil, record, tags, account.ID, ""),
+	}
+
+	writeResponse(c, "CreateVpc", ec2Output)
+}
+
+// DeleteVpc deletes a fabric VLAN, which must not have any network left
+func DeleteVpc(c *gin.Context) {
+	id := param(c, "VpcId")
+	if id == "" {
+		abortWithMissingParameter(c, "VpcId")
+		return
+	}
+	vlanID, ok := parseVpcID(id)
+	if !ok {
+		abortWithNotFound(c, "InvalidVpcID.NotFound", id)
+		return
+	}
+
+	client, err := tritonutils.GetTritonNetworkClient(regionName(c), requestPrincipal(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to create triton network client: %w", err))
+		return
+	}
+
+	account, err := getAccount(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to open shim store: %w", err))
+		return
+	}
+
+	networks, err := client.Fabrics().List(context.Background(), &tritonnetwork.ListFabricsInput{
+		FabricVLANID: vlanID,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithNotFound(c, "InvalidVpcID.NotFound", id)
+			return
+		}
+		log.Printf("[ERROR] list fabric networks error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to list triton fabric networks: %w", err))
+		return
+	}
+	if len(networks) > 0 {
+		abortWithDependencyViolation(c, id)
+		return
+	}
+
+	err = client.Fabrics().DeleteVLAN(context.Background(), &tritonnetwork.DeleteVLANInput{
+		ID: vlanID,
+	})
+	if err != nil {
+		if tritonerrors.IsSpecificStatusCode(err, http.StatusNotFound) {
+			abortWithNotFound(c, "InvalidVpcID.NotFound", id)
+			return
+		}
+		log.Printf("[ERROR] delete fabric vlan error: %v\n", err)
+		c.AbortWithError(http.StatusInternalServerError,
+			fmt.Errorf("Unable to delete triton fabric vlan: %w", err))
+		return
+	}
+
+	if err := db.Delete(vpcsCollection, ownedKey(regionName(c), account.ID, id)); err != nil {
+		log.Printf("[ERROR] delete vpc %s record error: %v\n", id, err)
+	}
+	if err := saveTags(db, regionName(c), account.ID, id, nil); err != nil {
+		log.Printf("[ERROR] delete vpc %s tags error: %v\n", id, err)
+	}
+
+	writeResponse(c, "DeleteVpc", returnOutput{Return: aws.Bool(true)})
+}
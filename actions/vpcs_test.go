@@ -0,0 +1,247 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package actions_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/joyent/triton-shim/test"
+)
+
+func TestAccAWSVpcs(t *testing.T) {
+	test.GetEC2Svc(t, func(ec2Svc *ec2.EC2) {
+		result, err := ec2Svc.DescribeVpcs(nil)
+		if err != nil {
+			t.Errorf("describe vpcs error %v", err)
+			return
+		}
+
+		defaults := 0
+		for _, vpc := range result.Vpcs {
+			if *vpc.IsDefault {
+				defaults++
+			}
+		}
+		if defaults != 1 {
+			t.Errorf("expected one default vpc, got %d", defaults)
+		}
+
+		created, err := ec2Svc.CreateVpc(&ec2.CreateVpcInput{
+			CidrBlock: aws.String("10.200.0.0/16"),
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeVpc),
+				Tags: []*ec2.Tag{{
+					Key:   aws.String("Name"),
+					Value: aws.String("triton-shim-test"),
+				}},
+			}},
+		})
+		if err != nil {
+			t.Errorf("create vpc error %v", err)
+			return
+		}
+
+		vpcID := created.Vpc.VpcId
+		if *created.Vpc.CidrBlock != "10.200.0.0/16" {
+			t.Errorf("unexpected vpc cidr block %s", *created.Vpc.CidrBlock)
+		}
+
+		described, err := ec2Svc.DescribeVpcs(&ec2.DescribeVpcsInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("tag:Name"),
+				Values: []*string{aws.String("triton-shim-test")},
+			}},
+		})
+		if err != nil {
+			t.Errorf("describe vpcs by tag error %v", err)
+		} else if len(described.Vpcs) != 1 || *described.Vpcs[0].VpcId != *vpcID {
+			t.Errorf("describe vpcs by tag did not return the new vpc")
+		}
+
+		_, err = ec2Svc.DeleteVpc(&ec2.DeleteVpcInput{VpcId: vpcID})
+		if err != nil {
+			t.Errorf("delete vpc error %v", err)
+		}
+
+		_, err = ec2Svc.DescribeVpcs(&ec2.DescribeVpcsInput{
+			VpcIds: []*string{vpcID},
+		})
+		if err == nil {
+			t.Errorf("describe vpcs should fail for deleted vpcs")
+		}
+	})
+}
+
+// fakeFabricsAPI serves the CloudAPI account, access key and fabric VLAN
+// requests of a datacenter without any VLAN, like a new one
+func fakeFabricsAPI(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	vlans := []map[string]interface{}{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/test":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": "930896af-bf8c-48d4-885c-6573a94b1853", "login": "test"})
+		case r.URL.Path == "/test/accesskeys":
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"accesskeyid": "AKIATRITONSHIMTEST", "accesskeysecret": "SECRET"}})
+		case r.URL.Path == "/test/users":
+			json.NewEncoder(w).Encode([]interface{}{})
+		case r.URL.Path == "/test/config":
+			json.NewEncoder(w).Encode(map[string]interface{}{})
+		case r.URL.Path == "/test/fabrics/default/vlans" && r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(vlans)
+		case r.URL.Path == "/test/fabrics/default/vlans" && r.Method == http.MethodPost:
+			var vlan map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&vlan)
+			vlans = append(vlans, vlan)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(vlan)
+		case strings.HasSuffix(r.URL.Path, "/networks"):
+			json.NewEncoder(w).Encode([]interface{}{})
+		case strings.HasPrefix(r.URL.Path, "/test/fabrics/default/vlans/") && r.Method == http.MethodDelete:
+			vlans = vlans[:0]
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected cloudapi request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// TestAccAWSVpcsRegions creates the same VPC, with the same fabric VLAN ID,
+// into two regions, which must not share their CIDR blocks and tags
+func TestAccAWSVpcsRegions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-shim-test")
+	if err != nil {
+		t.Fatalf("temp dir error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key error %v", err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("public key error %v", err)
+	}
+	keyFile := filepath.Join(dir, "id_rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("write key error %v", err)
+	}
+
+	east, west := fakeFabricsAPI(t), fakeFabricsAPI(t)
+	defer east.Close()
+	defer west.Close()
+
+	regionsFile := filepath.Join(dir, "regions.json")
+	regions, _ := json.Marshal(map[string]interface{}{
+		"mock-region":  map[string]interface{}{"url": east.URL},
+		"other-region": map[string]interface{}{"url": west.URL},
+	})
+	if err := ioutil.WriteFile(regionsFile, regions, 0600); err != nil {
+		t.Fatalf("write regions error %v", err)
+	}
+
+	for name, value := range map[string]string{
+		"TRITON_SHIM_REGIONS_FILE": regionsFile,
+		"TRITON_ACCOUNT":           "test",
+		"TRITON_KEY_ID":            ssh.FingerprintLegacyMD5(pub),
+		"TRITON_KEY_MATERIAL":      keyFile,
+	} {
+		if previous, found := os.LookupEnv(name); found {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	// The unit testing access key is only accepted for mock-region, so both
+	// regions use an access key of the shim account
+	test.GetEC2Svc(t, func(testSvc *ec2.EC2) {
+		sess := session.Must(session.NewSession(&testSvc.Client.Config))
+		creds := credentials.NewStaticCredentials("AKIATRITONSHIMTEST", "SECRET", "")
+		ec2Svc := ec2.New(sess, aws.NewConfig().WithCredentials(creds))
+		otherSvc := ec2.New(sess, aws.NewConfig().WithCredentials(creds).WithRegion("other-region"))
+
+		cidrs := map[*ec2.EC2]string{ec2Svc: "10.1.0.0/16", otherSvc: "10.2.0.0/16"}
+		names := map[*ec2.EC2]string{ec2Svc: "mock", otherSvc: "other"}
+
+		var ids []string
+		for _, svc := range []*ec2.EC2{ec2Svc, otherSvc} {
+			created, err := svc.CreateVpc(&ec2.CreateVpcInput{
+				CidrBlock: aws.String(cidrs[svc]),
+				TagSpecifications: []*ec2.TagSpecification{{
+					ResourceType: aws.String(ec2.ResourceTypeVpc),
+					Tags: []*ec2.Tag{{
+						Key:   aws.String("Name"),
+						Value: aws.String(names[svc]),
+					}},
+				}},
+			})
+			if err != nil {
+				t.Errorf("create vpc in %s error %v", *svc.Client.Config.Region, err)
+				return
+			}
+			ids = append(ids, *created.Vpc.VpcId)
+		}
+		if ids[0] != ids[1] {
+			t.Errorf("both regions should use the same vlan, got %v", ids)
+		}
+
+		for _, svc := range []*ec2.EC2{ec2Svc, otherSvc} {
+			described, err := svc.DescribeVpcs(nil)
+			if err != nil {
+				t.Errorf("describe vpcs in %s error %v", *svc.Client.Config.Region, err)
+				continue
+			}
+			if len(described.Vpcs) != 1 || *described.Vpcs[0].CidrBlock != cidrs[svc] ||
+				len(described.Vpcs[0].Tags) != 1 || *described.Vpcs[0].Tags[0].Value != names[svc] {
+				t.Errorf("vpcs of %s should only have their own records, got %v",
+					*svc.Client.Config.Region, described.Vpcs)
+			}
+		}
+
+		if _, err := otherSvc.DeleteVpc(&ec2.DeleteVpcInput{VpcId: aws.String(ids[1])}); err != nil {
+			t.Errorf("delete vpc error %v", err)
+		}
+
+		described, err := ec2Svc.DescribeVpcs(nil)
+		if err != nil {
+			t.Errorf("describe vpcs error %v", err)
+		} else if len(described.Vpcs) != 1 || *described.Vpcs[0].CidrBlock != cidrs[ec2Svc] ||
+			len(described.Vpcs[0].Tags) != 1 {
+			t.Errorf("deleting the vpc of another region should keep the records, got %v", described.Vpcs)
+		}
+	})
+}
@@ -185,6 +185,18 @@ type RequestInput struct {
 // ExecuteRequestURIParams performs an http.NewRequest against using the values provided by RequestInput
 // If the returned error is nil, a non-nill Response.Body which the user is expected to close will be returned.
 func (c *Client) ExecuteRequestURIParams(ctx context.Context, inputs RequestInput) (io.ReadCloser, error) {
+	resp, err := c.ExecuteRequestRaw(ctx, inputs)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ExecuteRequestRaw performs the request like ExecuteRequestURIParams does
+// but returns the whole http.Response, for callers which need the response
+// status code or headers, like streaming downloads.
+// If the returned error is nil, the user is expected to close the Response.Body.
+func (c *Client) ExecuteRequestRaw(ctx context.Context, inputs RequestInput) (*http.Response, error) {
 	defer c.resetHeader()
 
 	method := inputs.Method
@@ -227,6 +239,12 @@ func (c *Client) ExecuteRequestURIParams(ctx context.Context, inputs RequestInpu
 		req.Header.Set("request-id", c.RequestID)
 	}
 
+	if inputs.Headers != nil {
+		for k := range *inputs.Headers {
+			req.Header.Set(k, inputs.Headers.Get(k))
+		}
+	}
+
 	c.overrideHeader(req)
 
 	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
@@ -243,8 +261,9 @@ func (c *Client) ExecuteRequestURIParams(ctx context.Context, inputs RequestInpu
 	// StatusMultipleChoices is StatusCode 300
 	if resp.StatusCode >= http.StatusOK &&
 		resp.StatusCode < http.StatusMultipleChoices {
-		return resp.Body, nil
+		return resp, nil
 	}
 
+	defer resp.Body.Close()
 	return nil, c.DecodeError(resp, req.Method, true)
 }
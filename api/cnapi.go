@@ -0,0 +1,111 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CnapiClient represents a connection to Triton's CNAPI
+type CnapiClient struct {
+	client *Client
+}
+
+// Server is a CNAPI compute node. We don't need to add all the fields
+// provided by CNAPI, only those we plan to use
+type Server struct {
+	UUID                 string                 `json:"uuid"`
+	Hostname             string                 `json:"hostname"`
+	Datacenter           string                 `json:"datacenter"`
+	RackIdentifier       string                 `json:"rack_identifier"`
+	Traits               map[string]interface{} `json:"traits"`
+	Status               string                 `json:"status"`
+	Setup                bool                   `json:"setup"`
+	Reserved             bool                   `json:"reserved"`
+	Headnode             bool                   `json:"headnode"`
+	MemoryAvailableBytes int64                  `json:"memory_available_bytes"`
+	MemoryTotalBytes     int64                  `json:"memory_total_bytes"`
+}
+
+// NewCnapi creates a new client object for the provided ServiceURL
+func NewCnapi(CnapiURL string) (*CnapiClient, error) {
+	client, err := New(CnapiURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CnapiClient{
+		client: client,
+	}, nil
+}
+
+// ListServersInput includes fields allowed for server searches
+type ListServersInput struct {
+	UUIDs    []string `json:"uuids,omitempty"`
+	Hostname string   `json:"hostname,omitempty"`
+	Setup    bool     `json:"setup,omitempty"`
+	Reserved *bool    `json:"reserved,omitempty"`
+	Headnode *bool    `json:"headnode,omitempty"`
+	Limit    int64    `json:"limit,omitempty"`
+	Offset   int64    `json:"offset,omitempty"`
+}
+
+// ListServers retrieves a list of compute nodes from CNAPI using the provided
+// ListServersInput as filters
+func (c *CnapiClient) ListServers(ctx context.Context, input *ListServersInput) ([]*Server, error) {
+	query := &url.Values{}
+	if input.UUIDs != nil {
+		query.Set("uuids", strings.Join(input.UUIDs, ","))
+	}
+	if input.Hostname != "" {
+		query.Set("hostname", input.Hostname)
+	}
+	if input.Setup {
+		query.Set("setup", "true")
+	}
+	if input.Reserved != nil {
+		query.Set("reserved", fmt.Sprintf("%t", *input.Reserved))
+	}
+	if input.Headnode != nil {
+		query.Set("headnode", fmt.Sprintf("%t", *input.Headnode))
+	}
+	if input.Limit != 0 {
+		query.Set("limit", fmt.Sprintf("%d", input.Limit))
+	}
+	if input.Offset != 0 {
+		query.Set("offset", fmt.Sprintf("%d", input.Offset))
+	}
+
+	reqInputs := RequestInput{
+		Method: http.MethodGet,
+		Path:   "/servers",
+		Query:  query,
+	}
+
+	respReader, err := c.client.ExecuteRequestURIParams(ctx, reqInputs)
+	if respReader != nil {
+		defer respReader.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Server
+	decoder := json.NewDecoder(respReader)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to decode list servers response: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,53 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package api_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/triton-shim/api"
+)
+
+func TestListServers(t *testing.T) {
+
+	t.Run("Client setup", func(t *testing.T) {
+		URL := os.Getenv("CNAPI_URL")
+		if URL == "" {
+			URL = "http://10.99.99.22"
+		}
+		apiClient, err := api.NewCnapi(URL)
+		if err != nil {
+			t.Errorf("expected error to not be nil: received %v", err)
+			return
+		}
+
+		t.Logf("API Client: %v", apiClient)
+
+		reqInputs := &api.ListServersInput{
+			Setup: true,
+		}
+
+		servers, err := apiClient.ListServers(context.Background(), reqInputs)
+
+		if err != nil {
+			t.Errorf("expected error to not be nil: received %v", err)
+			return
+		}
+
+		assert.NotEmpty(t, servers)
+		for _, server := range servers {
+			assert.True(t, server.Setup)
+			assert.NotEmpty(t, server.UUID)
+		}
+	})
+}
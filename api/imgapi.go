@@ -122,3 +122,57 @@ func (c *ImgapiClient) ListImages(ctx context.Context, input *ListImagesInput) (
 
 	return result, nil
 }
+
+// ExportImageInput includes the values required to export an image into
+// Manta:
+// - UUID (string) The image to export.
+// - MantaPath (string) Manta path where the image file and manifest will
+//   be stored. When it ends with a slash, it is taken as a directory and
+//   the files will be named after the image name and version.
+// - Account (string) UUID of the account performing the export, which must
+//   have access to both the image and the Manta path.
+type ExportImageInput struct {
+	UUID      string `json:"uuid"`
+	MantaPath string `json:"manta_path"`
+	Account   string `json:"account,omitempty"`
+}
+
+// MantaLocation is where an exported image has been stored into Manta
+type MantaLocation struct {
+	MantaURL     string `json:"manta_url"`
+	ImagePath    string `json:"image_path"`
+	ManifestPath string `json:"manifest_path"`
+}
+
+// ExportImage exports an image file and manifest into Manta. IMGAPI does not
+// reply until the upload has finished, which may take a while for big images.
+func (c *ImgapiClient) ExportImage(ctx context.Context, input *ExportImageInput) (*MantaLocation, error) {
+	query := &url.Values{}
+	query.Set("action", "export")
+	query.Set("manta_path", input.MantaPath)
+	if input.Account != "" {
+		query.Set("account", input.Account)
+	}
+
+	reqInputs := RequestInput{
+		Method: http.MethodPost,
+		Path:   fmt.Sprintf("/images/%s", input.UUID),
+		Query:  query,
+	}
+
+	respReader, err := c.client.ExecuteRequestURIParams(ctx, reqInputs)
+	if respReader != nil {
+		defer respReader.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result *MantaLocation
+	decoder := json.NewDecoder(respReader)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to decode export image response: %w", err)
+	}
+
+	return result, nil
+}
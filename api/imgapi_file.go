@@ -0,0 +1,238 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package api
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrChecksumMismatch The downloaded image file SHA1 does not match the
+	// one from the image manifest
+	ErrChecksumMismatch = errors.New("image file checksum mismatch")
+	// ErrSizeMismatch The downloaded image file size does not match the one
+	// from the image manifest
+	ErrSizeMismatch = errors.New("image file size mismatch")
+	// ErrNoImageFile The image manifest does not include any file
+	ErrNoImageFile = errors.New("image has no file")
+)
+
+// ProgressFunc is called while an image file is transferred with the number
+// of bytes transferred so far, including any previously downloaded part, and
+// the total size of the file
+type ProgressFunc func(transferred int64, total int64)
+
+// GetImageInput identifies the image to retrieve
+type GetImageInput struct {
+	UUID string `json:"uuid"`
+}
+
+// GetImage retrieves the manifest of a single image
+func (c *ImgapiClient) GetImage(ctx context.Context, input *GetImageInput) (*Image, error) {
+	respReader, err := c.GetImageManifest(ctx, input)
+	if respReader != nil {
+		defer respReader.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result *Image
+	decoder := json.NewDecoder(respReader)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to decode get image response: %w", err)
+	}
+
+	return result, nil
+}
+
+// GetImageManifest streams the raw JSON manifest of an image, exactly as
+// IMGAPI provides it. It is useful to keep all the manifest fields, even
+// those not part of the Image type, like image mirroring does.
+// If the returned error is nil, the caller is expected to close the reader.
+func (c *ImgapiClient) GetImageManifest(ctx context.Context, input *GetImageInput) (io.ReadCloser, error) {
+	reqInputs := RequestInput{
+		Method: http.MethodGet,
+		Path:   fmt.Sprintf("/images/%s", input.UUID),
+	}
+
+	return c.client.ExecuteRequestURIParams(ctx, reqInputs)
+}
+
+// GetImageFileInput includes the values used to download an image file:
+// - UUID (string) The image whose file will be downloaded.
+// - Partial (io.Reader) Optional. The file bytes already retrieved by a
+//   previous, interrupted, download. They are read to compute the checksum
+//   and the download resumes right after them.
+// - Progress (ProgressFunc) Optional. Called every time a chunk of the file
+//   has been read.
+type GetImageFileInput struct {
+	UUID     string
+	Partial  io.Reader
+	Progress ProgressFunc
+}
+
+// imageFileReader streams an image file from IMGAPI. Once all the file has
+// been read it verifies its size and SHA1 against the image manifest,
+// returning an error instead of io.EOF when they don't match.
+type imageFileReader struct {
+	body        io.ReadCloser
+	hash        hash.Hash
+	transferred int64
+	file        *ImageFile
+	progress    ProgressFunc
+}
+
+func (r *imageFileReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.hash.Write(p[:n])
+		r.transferred += int64(n)
+		if r.progress != nil {
+			r.progress(r.transferred, r.file.Size)
+		}
+	}
+
+	if err == io.EOF {
+		if r.transferred != r.file.Size {
+			return n, fmt.Errorf("%w: expected %d bytes, got %d",
+				ErrSizeMismatch, r.file.Size, r.transferred)
+		}
+		sum := hex.EncodeToString(r.hash.Sum(nil))
+		if sum != r.file.SHA1 {
+			return n, fmt.Errorf("%w: expected %s, got %s",
+				ErrChecksumMismatch, r.file.SHA1, sum)
+		}
+	}
+
+	return n, err
+}
+
+// incomplete tells if less than the whole file was read, which can be
+// resumed unlike a file with wrong content
+func (r *imageFileReader) incomplete() bool {
+	return r.transferred < r.file.Size
+}
+
+func (r *imageFileReader) Close() error {
+	return r.body.Close()
+}
+
+// GetImageFile streams the file of an image. The expected SHA1 and size are
+// taken from the image manifest and verified once the returned reader has
+// been read until the end. When input.Partial is provided, only the bytes
+// following the partial content are returned.
+// If the returned error is nil, the caller is expected to close the reader.
+func (c *ImgapiClient) GetImageFile(ctx context.Context, input *GetImageFileInput) (io.ReadCloser, error) {
+	img, err := c.GetImage(ctx, &GetImageInput{UUID: input.UUID})
+	if err != nil {
+		return nil, err
+	}
+	if len(img.Files) == 0 {
+		return nil, ErrNoImageFile
+	}
+
+	reader := &imageFileReader{
+		hash:     sha1.New(),
+		file:     img.Files[0],
+		progress: input.Progress,
+	}
+
+	if input.Partial != nil {
+		offset, err := io.Copy(reader.hash, input.Partial)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read partial image file: %w", err)
+		}
+		reader.transferred = offset
+	}
+
+	// Nothing left to download, but we still want the file verified
+	if reader.transferred >= reader.file.Size {
+		reader.body = ioutil.NopCloser(strings.NewReader(""))
+		return reader, nil
+	}
+
+	reqInputs := RequestInput{
+		Method: http.MethodGet,
+		Path:   fmt.Sprintf("/images/%s/file", input.UUID),
+	}
+	if reader.transferred > 0 {
+		reqInputs.Headers = &http.Header{}
+		reqInputs.Headers.Set("Range", fmt.Sprintf("bytes=%d-", reader.transferred))
+	}
+
+	resp, err := c.client.ExecuteRequestRaw(ctx, reqInputs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers not supporting ranges will send the whole file. Skip what we
+	// already have in that case.
+	if reader.transferred > 0 && resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, reader.transferred); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to skip partial image file: %w", err)
+		}
+	}
+
+	reader.body = resp.Body
+	return reader, nil
+}
+
+// DownloadImageFile saves the file of an image into the given local path,
+// verifying its SHA1 and size. When the path already exists, it is taken as
+// a previous interrupted download and the transfer resumes from its end.
+// Files with a wrong checksum, or larger than expected, are truncated so the
+// next download starts over instead of resuming from corrupted content, while
+// files cut short are kept to be resumed.
+func (c *ImgapiClient) DownloadImageFile(ctx context.Context, input *GetImageFileInput, path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open image file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	fileInput := &GetImageFileInput{
+		UUID:     input.UUID,
+		Partial:  file,
+		Progress: input.Progress,
+	}
+
+	reader, err := c.GetImageFile(ctx, fileInput)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Reading the partial content left file offset at its end, so we'll
+	// be appending the remaining bytes
+	if _, err := io.Copy(file, reader); err != nil {
+		corrupted := errors.Is(err, ErrChecksumMismatch) ||
+			(errors.Is(err, ErrSizeMismatch) && !reader.(*imageFileReader).incomplete())
+		if corrupted {
+			if truncErr := file.Truncate(0); truncErr != nil {
+				return fmt.Errorf("unable to truncate image file %s: %v (%w)", path, truncErr, err)
+			}
+		}
+		return fmt.Errorf("unable to download image file %s: %w", input.UUID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package api_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/triton-shim/api"
+)
+
+const testImageUUID = "2b683a82-a066-11e3-97ab-2faa44701c5a"
+
+// imgapiFileServer serves a fake IMGAPI with a single image whose file is
+// content, supporting "bytes=N-" ranges when ranges is true
+func imgapiFileServer(t *testing.T, content []byte, sum string, ranges bool) *httptest.Server {
+	manifest := &api.Image{
+		ID:   testImageUUID,
+		Name: "base-64-lts",
+		Files: []*api.ImageFile{
+			{Compression: "gzip", SHA1: sum, Size: int64(len(content))},
+		},
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/" + testImageUUID:
+			json.NewEncoder(w).Encode(manifest)
+		case "/images/" + testImageUUID + "/file":
+			rangeHdr := r.Header.Get("Range")
+			if ranges && rangeHdr != "" {
+				offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHdr, "bytes="), "-"))
+				if err != nil {
+					t.Errorf("unexpected range header %s", rangeHdr)
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(content)-1, len(content)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[offset:])
+				return
+			}
+			w.Write(content)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"ResourceNotFound","message":"not found"}`))
+		}
+	}))
+}
+
+func sha1Hex(content []byte) string {
+	sum := sha1.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestGetImageFile(t *testing.T) {
+	content := []byte(strings.Repeat("triton image file contents ", 1000))
+
+	t.Run("Full download", func(t *testing.T) {
+		srv := imgapiFileServer(t, content, sha1Hex(content), true)
+		defer srv.Close()
+
+		apiClient, err := api.NewImgapi(srv.URL)
+		if err != nil {
+			t.Errorf("expected error to be nil: received %v", err)
+			return
+		}
+
+		var lastTransferred, lastTotal int64
+		reader, err := apiClient.GetImageFile(context.Background(), &api.GetImageFileInput{
+			UUID: testImageUUID,
+			Progress: func(transferred int64, total int64) {
+				lastTransferred = transferred
+				lastTotal = total
+			},
+		})
+		if err != nil {
+			t.Errorf("expected error to be nil: received %v", err)
+			return
+		}
+		defer reader.Close()
+
+		got, err := ioutil.ReadAll(reader)
+		assert.Empty(t, err)
+		assert.Equal(t, content, got)
+		assert.Equal(t, int64(len(content)), lastTransferred)
+		assert.Equal(t, int64(len(content)), lastTotal)
+	})
+
+	t.Run("Checksum mismatch", func(t *testing.T) {
+		srv := imgapiFileServer(t, content, sha1Hex([]byte("other")), true)
+		defer srv.Close()
+
+		apiClient, _ := api.NewImgapi(srv.URL)
+		reader, err := apiClient.GetImageFile(context.Background(), &api.GetImageFileInput{
+			UUID: testImageUUID,
+		})
+		if err != nil {
+			t.Errorf("expected error to be nil: received %v", err)
+			return
+		}
+		defer reader.Close()
+
+		_, err = ioutil.ReadAll(reader)
+		assert.True(t, errors.Is(err, api.ErrChecksumMismatch))
+	})
+
+	t.Run("Corrupted partial download", func(t *testing.T) {
+		srv := imgapiFileServer(t, content, sha1Hex(content), true)
+		defer srv.Close()
+
+		dir, err := ioutil.TempDir("", "triton-shim-imgapi")
+		if err != nil {
+			t.Errorf("expected error to be nil: received %v", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "image.zfs.gz")
+		if err := ioutil.WriteFile(path, []byte("corrupted"), 0644); err != nil {
+			t.Errorf("expected error to be nil: received %v", err)
+			return
+		}
+
+		apiClient, _ := api.NewImgapi(srv.URL)
+		err = apiClient.DownloadImageFile(context.Background(), &api.GetImageFileInput{
+			UUID: testImageUUID,
+		}, path)
+		assert.True(t, errors.Is(err, api.ErrChecksumMismatch))
+
+		// The corrupted file is dropped, so downloading again starts over
+		err = apiClient.DownloadImageFile(context.Background(), &api.GetImageFileInput{
+			UUID: testImageUUID,
+		}, path)
+		assert.Empty(t, err)
+
+		got, _ := ioutil.ReadFile(path)
+		assert.Equal(t, content, got)
+	})
+
+	t.Run("Interrupted download", func(t *testing.T) {
+		manifest := &api.Image{
+			ID:   testImageUUID,
+			Name: "base-64-lts",
+			Files: []*api.ImageFile{
+				{Compression: "gzip", SHA1: sha1Hex(content), Size: int64(len(content))},
+			},
+		}
+
+		// The first transfer ends early, yet cleanly
+		var ranges []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/images/" + testImageUUID:
+				json.NewEncoder(w).Encode(manifest)
+			case "/images/" + testImageUUID + "/file":
+				rangeHdr := r.Header.Get("Range")
+				ranges = append(ranges, rangeHdr)
+				if rangeHdr == "" {
+					w.Write(content[:1234])
+					return
+				}
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[1234:])
+			}
+		}))
+		defer srv.Close()
+
+		dir, err := ioutil.TempDir("", "triton-shim-imgapi")
+		if err != nil {
+			t.Errorf("expected error to be nil: received %v", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "image.zfs.gz")
+		apiClient, _ := api.NewImgapi(srv.URL)
+		err = apiClient.DownloadImageFile(context.Background(), &api.GetImageFileInput{
+			UUID: testImageUUID,
+		}, path)
+		assert.True(t, errors.Is(err, api.ErrSizeMismatch))
+
+		// The partial file is kept, and the next download resumes from it
+		got, _ := ioutil.ReadFile(path)
+		assert.Equal(t, content[:1234], got)
+
+		err = apiClient.DownloadImageFile(context.Background(), &api.GetImageFileInput{
+			UUID: testImageUUID,
+		}, path)
+		assert.Empty(t, err)
+		assert.Equal(t, []string{"", "bytes=1234-"}, ranges)
+
+		got, _ = ioutil.ReadFile(path)
+		assert.Equal(t, content, got)
+	})
+
+	for _, ranges := range []bool{true, false} {
+		t.Run(fmt.Sprintf("Resumed download (ranges: %v)", ranges), func(t *testing.T) {
+			srv := imgapiFileServer(t, content, sha1Hex(content), ranges)
+			defer srv.Close()
+
+			dir, err := ioutil.TempDir("", "triton-shim-imgapi")
+			if err != nil {
+				t.Errorf("expected error to be nil: received %v", err)
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "image.zfs.gz")
+			if err := ioutil.WriteFile(path, content[:1234], 0644); err != nil {
+				t.Errorf("expected error to be nil: received %v", err)
+				return
+			}
+
+			apiClient, _ := api.NewImgapi(srv.URL)
+			err = apiClient.DownloadImageFile(context.Background(), &api.GetImageFileInput{
+				UUID: testImageUUID,
+			}, path)
+			assert.Empty(t, err)
+
+			got, _ := ioutil.ReadFile(path)
+			assert.Equal(t, content, got)
+
+			// Downloading again must only verify the existing file
+			err = apiClient.DownloadImageFile(context.Background(), &api.GetImageFileInput{
+				UUID: testImageUUID,
+			}, path)
+			assert.Empty(t, err)
+		})
+	}
+}
+
+func TestGetImageManifest(t *testing.T) {
+	srv := imgapiFileServer(t, []byte("file"), sha1Hex([]byte("file")), true)
+	defer srv.Close()
+
+	apiClient, _ := api.NewImgapi(srv.URL)
+	img, err := apiClient.GetImage(context.Background(), &api.GetImageInput{UUID: testImageUUID})
+	if err != nil {
+		t.Errorf("expected error to be nil: received %v", err)
+		return
+	}
+	assert.Equal(t, "base-64-lts", img.Name)
+	assert.Equal(t, int64(4), img.Files[0].Size)
+
+	_, err = apiClient.GetImage(context.Background(), &api.GetImageInput{UUID: "missing"})
+	assert.NotEmpty(t, err)
+}
@@ -0,0 +1,109 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// MahiClient represents a connection to Triton's Mahi, the authentication
+// cache of the accounts and sub-users stored into UFDS
+type MahiClient struct {
+	client *Client
+}
+
+// MahiAccessKey is one of the access keys of an account or sub-user. Older
+// Mahi versions only give the secret of the keys, without their status.
+type MahiAccessKey struct {
+	Secret string `json:"secret"`
+	Status string `json:"status,omitempty"`
+}
+
+// UnmarshalJSON decodes either the access key object or its secret alone
+func (k *MahiAccessKey) UnmarshalJSON(data []byte) error {
+	var secret string
+	if err := json.Unmarshal(data, &secret); err == nil {
+		k.Secret = secret
+		return nil
+	}
+
+	type accessKey MahiAccessKey
+	return json.Unmarshal(data, (*accessKey)(k))
+}
+
+// MahiAccount is the account or sub-user part of the Mahi authentication
+// information. We don't need to add all the fields provided by Mahi, only
+// those we plan to use
+type MahiAccount struct {
+	UUID       string                    `json:"uuid"`
+	Login      string                    `json:"login"`
+	Approved   bool                      `json:"approved_for_provisioning"`
+	AccessKeys map[string]*MahiAccessKey `json:"accesskeys"`
+}
+
+// MahiAuthInfo is the authentication information of the owner of an access
+// key. User is only set for the access keys of sub-users.
+type MahiAuthInfo struct {
+	Account *MahiAccount `json:"account"`
+	User    *MahiAccount `json:"user,omitempty"`
+}
+
+// NewMahi creates a new client object for the provided ServiceURL
+func NewMahi(MahiURL string) (*MahiClient, error) {
+	client, err := New(MahiURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MahiClient{
+		client: client,
+	}, nil
+}
+
+// GetAccessKeyAuthInfo retrieves the authentication information of the
+// account or sub-user owning the given access key
+func (c *MahiClient) GetAccessKeyAuthInfo(ctx context.Context, accessKeyID string) (*MahiAuthInfo, error) {
+	reqInputs := RequestInput{
+		Method: http.MethodGet,
+		Path:   path.Join("/aws-auth", url.PathEscape(accessKeyID)),
+	}
+
+	respReader, err := c.client.ExecuteRequestURIParams(ctx, reqInputs)
+	if respReader != nil {
+		defer respReader.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result *MahiAuthInfo
+	decoder := json.NewDecoder(respReader)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to decode get access key auth info response: %w", err)
+	}
+
+	return result, nil
+}
+
+// AccessKey returns the given access key, which belongs to the sub-user, if
+// any, or to the account. It is nil when neither of them owns it.
+func (a *MahiAuthInfo) AccessKey(accessKeyID string) *MahiAccessKey {
+	if a.User != nil {
+		return a.User.AccessKeys[accessKeyID]
+	}
+	if a.Account != nil {
+		return a.Account.AccessKeys[accessKeyID]
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/triton-shim/api"
+)
+
+func TestGetAccessKeyAuthInfo(t *testing.T) {
+
+	t.Run("Client setup", func(t *testing.T) {
+		URL := os.Getenv("MAHI_URL")
+		if URL == "" {
+			URL = "http://10.99.99.27"
+		}
+		apiClient, err := api.NewMahi(URL)
+		if err != nil {
+			t.Errorf("expected error to not be nil: received %v", err)
+			return
+		}
+
+		t.Logf("API Client: %v", apiClient)
+
+		_, err = apiClient.GetAccessKeyAuthInfo(context.Background(), "NOSUCHACCESSKEY")
+
+		var apiErr *api.Error
+		if !errors.As(err, &apiErr) {
+			t.Errorf("expected an API error: received %v", err)
+			return
+		}
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	})
+	t.Run("Access key status", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{
+				"account": {
+					"uuid": "930896af-bf8c-48d4-885c-6573a94b1853",
+					"login": "admin",
+					"accesskeys": {"OLDKEY": "old-secret"}
+				},
+				"user": {
+					"uuid": "a820621a-5007-4a2a-9636-edde809106de",
+					"login": "operator",
+					"accesskeys": {"NEWKEY": {"secret": "new-secret", "status": "Inactive"}}
+				}
+			}`))
+		}))
+		defer srv.Close()
+
+		apiClient, _ := api.NewMahi(srv.URL)
+		info, err := apiClient.GetAccessKeyAuthInfo(context.Background(), "NEWKEY")
+		if err != nil {
+			t.Errorf("expected error to be nil: received %v", err)
+			return
+		}
+
+		key := info.AccessKey("NEWKEY")
+		if assert.NotNil(t, key) {
+			assert.Equal(t, "new-secret", key.Secret)
+			assert.Equal(t, "Inactive", key.Status)
+		}
+		assert.Nil(t, info.AccessKey("OLDKEY"))
+
+		info.User = nil
+		key = info.AccessKey("OLDKEY")
+		if assert.NotNil(t, key) {
+			assert.Equal(t, "old-secret", key.Secret)
+			assert.Equal(t, "", key.Status)
+		}
+	})
+}
@@ -62,30 +62,46 @@ func (d *PackageDisk) UnmarshalJSON(data []byte) error {
 
 // Package is equivalent to a Triton's PackagesAPI package
 type Package struct {
-	UUID          string        `json:"uuid"`
-	Name          string        `json:"name"`
-	Memory        int64         `json:"max_physical_memory"`
-	Disk          int64         `json:"disk"`
-	Swap          int64         `json:"max_swap"`
-	LWPs          int64         `json:"max_lwps"`
-	VCPUs         int64         `json:"vcpus"`
-	V             int64         `json:"v"`
-	CPUCap        int64         `json:"cpu_cap"`
-	FSS           int64         `json:"fss"`
-	ZFSIOPriority int64         `json:"zfs_io_priority"`
-	Quota         int64         `json:"quota"`
-	Version       string        `json:"version"`
-	Group         string        `json:"group"`
-	Description   string        `json:"description"`
-	Default       bool          `json:"default"`
-	Active        bool          `json:"active"`
-	Brand         string        `json:"brand"`
-	FlexibleDisk  bool          `json:"flexible_disk,omitempty"`
-	Disks         []PackageDisk `json:"disks,omitempty"`
-	BillingTag    string        `json:"billing_tag"`
-	CreatedAt     string        `json:"created_at"`
-	UpdatedAt     string        `json:"updated_at"`
-	Owners        []string      `json:"owners"`
+	UUID          string                 `json:"uuid"`
+	Name          string                 `json:"name"`
+	Memory        int64                  `json:"max_physical_memory"`
+	Disk          int64                  `json:"disk"`
+	Swap          int64                  `json:"max_swap"`
+	LWPs          int64                  `json:"max_lwps"`
+	VCPUs         int64                  `json:"vcpus"`
+	V             int64                  `json:"v"`
+	CPUCap        int64                  `json:"cpu_cap"`
+	FSS           int64                  `json:"fss"`
+	ZFSIOPriority int64                  `json:"zfs_io_priority"`
+	Quota         int64                  `json:"quota"`
+	Version       string                 `json:"version"`
+	Group         string                 `json:"group"`
+	Description   string                 `json:"description"`
+	Default       bool                   `json:"default"`
+	Active        bool                   `json:"active"`
+	Brand         string                 `json:"brand"`
+	FlexibleDisk  bool                   `json:"flexible_disk,omitempty"`
+	Disks         []PackageDisk          `json:"disks,omitempty"`
+	BillingTag    string                 `json:"billing_tag"`
+	Traits        map[string]interface{} `json:"traits,omitempty"`
+	CreatedAt     string                 `json:"created_at"`
+	UpdatedAt     string                 `json:"updated_at"`
+	Owners        []string               `json:"owner_uuids,omitempty"`
+}
+
+// AvailableTo tells if the account, given by UUID, can use the package.
+// Packages without owners are public, while the others are private to the
+// accounts they list.
+func (p *Package) AvailableTo(accountID string) bool {
+	if len(p.Owners) == 0 {
+		return true
+	}
+	for _, owner := range p.Owners {
+		if owner == accountID && accountID != "" {
+			return true
+		}
+	}
+	return false
 }
 
 // ListPackagesInput includes possible values for ListPackages options. While
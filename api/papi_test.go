@@ -10,6 +10,7 @@ package api_test
 
 import (
 	"context"
+	"encoding/json"
 	"os"
 	"testing"
 
@@ -55,3 +56,27 @@ func TestListPackagesByNames(t *testing.T) {
 		}
 	})
 }
+
+func TestPackageAvailableTo(t *testing.T) {
+	const owner = "930896af-bf8c-48d4-885c-6573a94b1853"
+	const other = "5ffbb2e2-8fde-4d37-bf56-1a2ab1c4a5fb"
+
+	t.Run("Public package", func(t *testing.T) {
+		var pkg api.Package
+		err := json.Unmarshal([]byte(`{"name":"sdc_128"}`), &pkg)
+		assert.Empty(t, err)
+
+		assert.True(t, pkg.AvailableTo(owner))
+		assert.True(t, pkg.AvailableTo(""))
+	})
+
+	t.Run("Private package", func(t *testing.T) {
+		var pkg api.Package
+		err := json.Unmarshal([]byte(`{"name":"sdc_128","owner_uuids":["`+owner+`"]}`), &pkg)
+		assert.Empty(t, err)
+
+		assert.True(t, pkg.AvailableTo(owner))
+		assert.False(t, pkg.AvailableTo(other))
+		assert.False(t, pkg.AvailableTo(""))
+	})
+}
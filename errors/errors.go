@@ -30,6 +30,28 @@ type XMLErrorResponse struct {
 	RequestID string `xml:"RequestId"`
 }
 
+type restXMLError struct {
+	XMLName xml.Name `xml:"Error"`
+	Type    string   `xml:"Type"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// RestXMLErrorResponse marshals error responses of the REST XML APIs, like
+// Route 53, to XML
+type RestXMLErrorResponse struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Error     *restXMLError
+	RequestID string `xml:"RequestId"`
+}
+
+// JSONErrorResponse marshals error responses of the JSON APIs, like EC2
+// Instance Connect, to JSON
+type JSONErrorResponse struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
 // ResponseError wraps the given Error Code & Message into XML
 func ResponseError(Code string, Message string, RequestID string) *XMLErrorResponse {
 	return &XMLErrorResponse{
@@ -43,6 +65,28 @@ func ResponseError(Code string, Message string, RequestID string) *XMLErrorRespo
 	}
 }
 
+// RestXMLError wraps the given Error Code & Message into the XML of the REST
+// XML APIs. Errors are always caused by the sender of the request.
+func RestXMLError(Code string, Message string, RequestID string) *RestXMLErrorResponse {
+	return &RestXMLErrorResponse{
+		Error: &restXMLError{
+			Type:    "Sender",
+			Code:    Code,
+			Message: Message,
+		},
+		RequestID: RequestID,
+	}
+}
+
+// JSONError wraps the given Error Code & Message into the JSON of the JSON
+// APIs
+func JSONError(Code string, Message string) *JSONErrorResponse {
+	return &JSONErrorResponse{
+		Type:    Code,
+		Message: Message,
+	}
+}
+
 // MissingActionError wraps XML error when Action argument is not present
 func MissingActionError(RequestID string) *XMLErrorResponse {
 	return ResponseError("MissingAction", "Action parameter must be provided", RequestID)
@@ -52,3 +96,26 @@ func MissingActionError(RequestID string) *XMLErrorResponse {
 func InvalidActionError(Action string, RequestID string) *XMLErrorResponse {
 	return ResponseError("InvalidAction", fmt.Sprintf("Action %s is not supported", Action), RequestID)
 }
+
+// MissingParameterError will be used when a required parameter is not present
+func MissingParameterError(Parameter string, RequestID string) *XMLErrorResponse {
+	return ResponseError("MissingParameter", fmt.Sprintf("The request must contain the parameter %s", Parameter), RequestID)
+}
+
+// InvalidParameterValueError will be used when a parameter has a wrong value
+func InvalidParameterValueError(Parameter string, Value string, RequestID string) *XMLErrorResponse {
+	return ResponseError("InvalidParameterValue", fmt.Sprintf("Value (%s) for parameter %s is invalid", Value, Parameter), RequestID)
+}
+
+// NotFoundError will be used when the resource identified by ID does not
+// exist. Code is the EC2 error code for the resource type, for example
+// "InvalidAMIID.NotFound"
+func NotFoundError(Code string, ID string, RequestID string) *XMLErrorResponse {
+	return ResponseError(Code, fmt.Sprintf("The ID '%s' does not exist", ID), RequestID)
+}
+
+// DependencyViolationError will be used when the resource identified by ID
+// cannot be deleted because other resources depend on it
+func DependencyViolationError(ID string, RequestID string) *XMLErrorResponse {
+	return ResponseError("DependencyViolation", fmt.Sprintf("The resource '%s' has dependencies and cannot be deleted", ID), RequestID)
+}
@@ -9,12 +9,24 @@
 package main
 
 import (
+	"log"
+
+	"github.com/joyent/triton-shim/actions"
 	"github.com/joyent/triton-shim/server"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
 )
 
 func main() {
+	// Malformed configuration files must not wait for the first requests
+	if err := tritonutils.CheckConfigFiles(); err != nil {
+		log.Fatal(err)
+	}
+
 	engine := server.Setup()
 
+	// Expire the EC2 Instance Connect keys pushed before a restart
+	actions.StartInstanceConnectWorker()
+
 	// Start listening.
 	engine.Run(":9090")
 }
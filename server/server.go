@@ -9,6 +9,7 @@
 package server
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 
@@ -23,14 +24,111 @@ import (
 
 func actionHandler(c *gin.Context, action string) {
 	reqID := uuid.New().String()
+	c.Set(actions.RequestIDKey, reqID)
 
 	switch action {
+	case "AllocateAddress":
+		actions.AllocateAddress(c)
+	case "AssociateAddress":
+		actions.AssociateAddress(c)
+	case "AssumeRole":
+		actions.AssumeRole(c)
+	case "AttachNetworkInterface":
+		actions.AttachNetworkInterface(c)
+	case "AttachVolume":
+		actions.AttachVolume(c)
+	case "AuthorizeSecurityGroupEgress":
+		actions.AuthorizeSecurityGroupEgress(c)
+	case "AuthorizeSecurityGroupIngress":
+		actions.AuthorizeSecurityGroupIngress(c)
+	case "CreateKeyPair":
+		actions.CreateKeyPair(c)
+	case "CreateNetworkInterface":
+		actions.CreateNetworkInterface(c)
+	case "CreateReplaceRootVolumeTask":
+		actions.CreateReplaceRootVolumeTask(c)
+	case "CreateSecurityGroup":
+		actions.CreateSecurityGroup(c)
+	case "CreateSnapshot":
+		actions.CreateSnapshot(c)
+	case "CreateSnapshots":
+		actions.CreateSnapshots(c)
+	case "CreateSubnet":
+		actions.CreateSubnet(c)
+	case "CreateVolume":
+		actions.CreateVolume(c)
+	case "CreateVpc":
+		actions.CreateVpc(c)
+	case "DeleteKeyPair":
+		actions.DeleteKeyPair(c)
+	case "DeleteNetworkInterface":
+		actions.DeleteNetworkInterface(c)
+	case "DeleteSecurityGroup":
+		actions.DeleteSecurityGroup(c)
+	case "DeleteSnapshot":
+		actions.DeleteSnapshot(c)
+	case "DeleteSubnet":
+		actions.DeleteSubnet(c)
+	case "DeleteVolume":
+		actions.DeleteVolume(c)
+	case "DeleteVpc":
+		actions.DeleteVpc(c)
+	case "DescribeAddresses":
+		actions.DescribeAddresses(c)
+	case "DescribeAvailabilityZones":
+		actions.DescribeAvailabilityZones(c)
+	case "DescribeExportImageTasks":
+		actions.DescribeExportImageTasks(c)
 	case "DescribeImages":
 		actions.DescribeImages(c)
 	case "DescribeInstances":
 		actions.DescribeInstances(c)
+	case "DescribeInstanceTypeOfferings":
+		actions.DescribeInstanceTypeOfferings(c)
 	case "DescribeInstanceTypes":
 		actions.DescribeInstanceTypes(c)
+	case "DescribeKeyPairs":
+		actions.DescribeKeyPairs(c)
+	case "DescribeNetworkInterfaces":
+		actions.DescribeNetworkInterfaces(c)
+	case "DescribeRegions":
+		actions.DescribeRegions(c)
+	case "DescribeReplaceRootVolumeTasks":
+		actions.DescribeReplaceRootVolumeTasks(c)
+	case "DescribeSecurityGroups":
+		actions.DescribeSecurityGroups(c)
+	case "DescribeSnapshots":
+		actions.DescribeSnapshots(c)
+	case "DescribeSubnets":
+		actions.DescribeSubnets(c)
+	case "DescribeVolumes":
+		actions.DescribeVolumes(c)
+	case "DescribeVpcs":
+		actions.DescribeVpcs(c)
+	case "DetachNetworkInterface":
+		actions.DetachNetworkInterface(c)
+	case "DetachVolume":
+		actions.DetachVolume(c)
+	case "DisassociateAddress":
+		actions.DisassociateAddress(c)
+	case "ExportImage":
+		actions.ExportImage(c)
+	case "GetSessionToken":
+		actions.GetSessionToken(c)
+	case "ImportKeyPair":
+		actions.ImportKeyPair(c)
+	case "ModifyInstanceAttribute":
+		actions.ModifyInstanceAttribute(c)
+	case "ModifySubnetAttribute":
+		actions.ModifySubnetAttribute(c)
+	case "ReleaseAddress":
+		actions.ReleaseAddress(c)
+	case "RevokeSecurityGroupEgress":
+		actions.RevokeSecurityGroupEgress(c)
+	case "RevokeSecurityGroupIngress":
+		actions.RevokeSecurityGroupIngress(c)
+	case "RunInstances":
+		actions.RunInstances(c)
 
 	// Action not specified
 	case "MissingAction":
@@ -46,6 +144,31 @@ func actionHandler(c *gin.Context, action string) {
 	}
 }
 
+// targetHandler handles the actions of the JSON APIs, like EC2 Instance
+// Connect, which get the action from the X-Amz-Target header
+func targetHandler(c *gin.Context, target string) {
+	c.Set(actions.RequestIDKey, uuid.New().String())
+
+	switch target {
+	case "AWSEC2InstanceConnectService.SendSSHPublicKey":
+		actions.SendSSHPublicKey(c)
+
+	default:
+		c.Header("x-amzn-RequestId", c.GetString(actions.RequestIDKey))
+		c.JSON(http.StatusBadRequest, errors.JSONError("UnknownOperationException",
+			fmt.Sprintf("Operation %s is not supported", target)))
+	}
+}
+
+// restHandler wraps the handlers of the REST APIs, like Route 53, which get
+// the action from the request method and path instead of the Action parameter
+func restHandler(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(actions.RequestIDKey, uuid.New().String())
+		handler(c)
+	}
+}
+
 func setupRouter(router *gin.Engine) {
 	router.GET("/ping", func(c *gin.Context) {
 		c.String(http.StatusOK, "pong")
@@ -60,6 +183,13 @@ func setupRouter(router *gin.Engine) {
 	})
 
 	router.POST("/", func(c *gin.Context) {
+		if target := c.GetHeader("X-Amz-Target"); target != "" {
+			log.Printf("[DEBUG] POST target: '%s'\n", target)
+
+			targetHandler(c, target)
+			return
+		}
+
 		action := c.DefaultPostForm("Action", "MissingAction")
 
 		log.Printf("[DEBUG] POST action: '%s'\n", action)
@@ -68,6 +198,12 @@ func setupRouter(router *gin.Engine) {
 
 		c.Next()
 	})
+
+	// Route 53 REST API, backed by Triton CNS
+	route53 := router.Group("/2013-04-01")
+	route53.GET("/hostedzone", restHandler(actions.ListHostedZones))
+	route53.GET("/hostedzone/:Id/rrset", restHandler(actions.ListResourceRecordSets))
+	route53.POST("/hostedzone/:Id/rrset/", restHandler(actions.ChangeResourceRecordSets))
 }
 
 func setupMiddleware(engine *gin.Engine) {
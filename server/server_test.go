@@ -9,25 +9,37 @@
 package server_test
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
 	awsv4signer "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/gin-gonic/gin"
 	"github.com/joyent/triton-shim/errors"
 	"github.com/joyent/triton-shim/server"
+	"github.com/joyent/triton-shim/utils"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestMain(m *testing.M) {
+	// The unit testing access key is only accepted in test mode
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
 func signRequest(req *http.Request) error {
-	creds := awscredentials.NewStaticCredentials("AKID", "SECRET", "SESSION")
+	creds := awscredentials.NewStaticCredentials("AKID", "SECRET", "")
 	signer := awsv4signer.NewSigner(creds)
 
-	_, err := signer.Sign(req, nil, "ec2", "mock-region", time.Unix(0, 0))
+	_, err := signer.Sign(req, nil, "ec2", "mock-region", time.Now())
 	return err
 }
 
@@ -44,6 +56,194 @@ func TestPingRoute(t *testing.T) {
 
 }
 
+func TestTestAccessKey(t *testing.T) {
+	router := server.Setup()
+
+	// The unit testing key is public, so it is unknown outside of test mode
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	signRequest(req)
+	router.ServeHTTP(w, req)
+
+	assert.NotEqual(t, http.StatusOK, w.Code)
+}
+
+func TestPresignedRequest(t *testing.T) {
+	router := server.Setup()
+	creds := awscredentials.NewStaticCredentials("AKID", "SECRET", "")
+	signer := awsv4signer.NewSigner(creds)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	signer.Presign(req, nil, "ec2", "mock-region", 15*time.Minute, time.Now())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "pong", w.Body.String())
+
+	// Tampered requests
+	w = httptest.NewRecorder()
+	req.URL.RawQuery += "&Action=DescribeInstances"
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var xmlBytesOut errors.XMLErrorResponse
+	err := xml.Unmarshal(w.Body.Bytes(), &xmlBytesOut)
+	assert.Empty(t, err)
+	assert.Equal(t, "SignatureDoesNotMatch", xmlBytesOut.Errors.Error.Code)
+
+	// Expired requests
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	signer.Presign(req, nil, "ec2", "mock-region", 15*time.Minute, time.Now().Add(-time.Hour))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	err = xml.Unmarshal(w.Body.Bytes(), &xmlBytesOut)
+	assert.Empty(t, err)
+	assert.Equal(t, "RequestExpired", xmlBytesOut.Errors.Error.Code)
+}
+
+func TestLargeBody(t *testing.T) {
+	router := server.Setup()
+	creds := awscredentials.NewStaticCredentials("AKID", "SECRET", "")
+	signer := awsv4signer.NewSigner(creds)
+
+	// The whole body is signed, and given to the actions
+	body := "Action=DescribeVpnGateways&UserData=" + strings.Repeat("A", 16*1024)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signer.Sign(req, strings.NewReader(body), "ec2", "mock-region", time.Now())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	var xmlBytesOut errors.XMLErrorResponse
+	err := xml.Unmarshal(w.Body.Bytes(), &xmlBytesOut)
+	assert.Empty(t, err)
+	assert.Equal(t, "InvalidAction", xmlBytesOut.Errors.Error.Code)
+
+	// The body must match its signed digest
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Amz-Content-Sha256", strings.Repeat("0", 64))
+	signer.Sign(req, strings.NewReader(body), "ec2", "mock-region", time.Now())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	err = xml.Unmarshal(w.Body.Bytes(), &xmlBytesOut)
+	assert.Empty(t, err)
+	assert.Equal(t, "XAmzContentSHA256Mismatch", xmlBytesOut.Errors.Error.Code)
+}
+
+func TestRequestExpired(t *testing.T) {
+	router := server.Setup()
+	creds := awscredentials.NewStaticCredentials("AKID", "SECRET", "")
+	signer := awsv4signer.NewSigner(creds)
+
+	for _, signTime := range []time.Time{time.Unix(0, 0), time.Now().Add(time.Hour)} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		signer.Sign(req, nil, "ec2", "mock-region", signTime)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		var xmlBytesOut errors.XMLErrorResponse
+		err := xml.Unmarshal(w.Body.Bytes(), &xmlBytesOut)
+		assert.Empty(t, err)
+		assert.Equal(t, "RequestExpired", xmlBytesOut.Errors.Error.Code)
+	}
+}
+
+func TestReplayedRequest(t *testing.T) {
+	os.Setenv("TRITON_SHIM_REPLAY_CACHE", "1")
+	defer os.Unsetenv("TRITON_SHIM_REPLAY_CACHE")
+	router := server.Setup()
+
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Read-only requests can be replayed
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	signRequest(req)
+	assert.Equal(t, http.StatusOK, send(req).Code)
+	assert.Equal(t, http.StatusOK, send(req).Code)
+
+	// Mutating ones cannot
+	req, _ = http.NewRequest("GET", "/?Action=CreateVpnGateway", nil)
+	signRequest(req)
+	assert.Equal(t, http.StatusMethodNotAllowed, send(req).Code)
+
+	w := send(req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	var xmlBytesOut errors.XMLErrorResponse
+	err := xml.Unmarshal(w.Body.Bytes(), &xmlBytesOut)
+	assert.Empty(t, err)
+	assert.Equal(t, "AuthFailure", xmlBytesOut.Errors.Error.Code)
+}
+
+func TestSessionToken(t *testing.T) {
+	router := server.Setup()
+
+	// Long-lived access keys have no session token
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	creds := awscredentials.NewStaticCredentials("AKID", "SECRET", "SESSION")
+	awsv4signer.NewSigner(creds).Sign(req, nil, "ec2", "mock-region", time.Now())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var xmlBytesOut errors.XMLErrorResponse
+	err := xml.Unmarshal(w.Body.Bytes(), &xmlBytesOut)
+	assert.Empty(t, err)
+	assert.Equal(t, "InvalidClientTokenId", xmlBytesOut.Errors.Error.Code)
+
+	// Principals without account, like the unit testing key, cannot get
+	// temporary credentials
+	_, err = utils.IssueSessionCredentials("mock-region", &tritonutils.Principal{}, "", time.Hour)
+	assert.Equal(t, utils.ErrNoAccount, err)
+
+	// Temporary ones sign requests, presigned ones too, with their token
+	session, err := utils.IssueSessionCredentials("mock-region", &tritonutils.Principal{
+		AccountID: "930896af-bf8c-48d4-885c-6573a94b1853",
+		Account:   "test",
+	}, "", time.Hour)
+	assert.Empty(t, err)
+	creds = awscredentials.NewStaticCredentials(session.AccessKeyID, session.SecretAccessKey, session.SessionToken)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	awsv4signer.NewSigner(creds).Presign(req, nil, "ec2", "mock-region", 15*time.Minute, time.Now())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Only in the region they were issued in
+	session, err = utils.IssueSessionCredentials("us-east-1", &tritonutils.Principal{
+		AccountID: "930896af-bf8c-48d4-885c-6573a94b1853",
+		Account:   "test",
+	}, "", time.Hour)
+	assert.Empty(t, err)
+	creds = awscredentials.NewStaticCredentials(session.AccessKeyID, session.SecretAccessKey, session.SessionToken)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	awsv4signer.NewSigner(creds).Sign(req, nil, "ec2", "mock-region", time.Now())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	err = xml.Unmarshal(w.Body.Bytes(), &xmlBytesOut)
+	assert.Empty(t, err)
+	assert.Equal(t, "InvalidClientTokenId", xmlBytesOut.Errors.Error.Code)
+}
+
 func TestDefaultAction(t *testing.T) {
 	router := server.Setup()
 	w := httptest.NewRecorder()
@@ -65,7 +265,7 @@ func TestDefaultAction(t *testing.T) {
 func TestNamedAction(t *testing.T) {
 	router := server.Setup()
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/?Action=DescribeRegions", nil)
+	req, _ := http.NewRequest("GET", "/?Action=DescribeVpnGateways", nil)
 	signRequest(req)
 	router.ServeHTTP(w, req)
 
@@ -78,5 +278,25 @@ func TestNamedAction(t *testing.T) {
 	assert.NotEmpty(t, xmlBytesOut.RequestID)
 	assert.NotEmpty(t, xmlBytesOut.Errors.Error.Message)
 	assert.Equal(t, "InvalidAction", xmlBytesOut.Errors.Error.Code)
-	assert.Regexp(t, regexp.MustCompile("DescribeRegions"), xmlBytesOut.Errors.Error.Message)
+	assert.Regexp(t, regexp.MustCompile("DescribeVpnGateways"), xmlBytesOut.Errors.Error.Message)
+}
+
+func TestUnknownTarget(t *testing.T) {
+	router := server.Setup()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AWSEC2InstanceConnectService.SendSerialConsoleSSHPublicKey")
+	creds := awscredentials.NewStaticCredentials("AKID", "SECRET", "")
+	awsv4signer.NewSigner(creds).Sign(req, strings.NewReader("{}"),
+		"ec2-instance-connect", "mock-region", time.Now())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var jsonBytesOut errors.JSONErrorResponse
+	err := json.Unmarshal(w.Body.Bytes(), &jsonBytesOut)
+	assert.Empty(t, err)
+	assert.NotEmpty(t, w.Header().Get("x-amzn-RequestId"))
+	assert.NotEmpty(t, jsonBytesOut.Message)
+	assert.Equal(t, "UnknownOperationException", jsonBytesOut.Type)
 }
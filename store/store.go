@@ -0,0 +1,180 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrNotFound The requested record does not exist into the store
+	ErrNotFound = errors.New("record not found")
+)
+
+// Store keeps the records the shim needs to track by itself, since they
+// have no equivalent into Triton (EC2 task records, resource tags, ...).
+// Records are grouped into collections and saved as JSON. When the store
+// has a file path, every change is written to disk so records survive
+// shim restarts. Otherwise, records are kept only in memory.
+type Store struct {
+	mu   sync.RWMutex
+	path string
+	data map[string]map[string]json.RawMessage
+}
+
+var (
+	defaultStore    *Store
+	defaultStoreErr error
+	defaultOnce     sync.Once
+)
+
+// New creates a store backed by the provided file path, loading any records
+// previously saved there. An empty path creates an in-memory only store.
+func New(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		data: make(map[string]map[string]json.RawMessage),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unable to read store file %s: %w", path, err)
+	}
+
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &s.data); err != nil {
+			return nil, fmt.Errorf("unable to decode store file %s: %w", path, err)
+		}
+	}
+
+	return s, nil
+}
+
+// Default returns the store shared by the whole shim, saved into the file
+// given by the TRITON_SHIM_STATE_FILE environment variable, if any.
+func Default() (*Store, error) {
+	defaultOnce.Do(func() {
+		defaultStore, defaultStoreErr = New(os.Getenv("TRITON_SHIM_STATE_FILE"))
+	})
+	return defaultStore, defaultStoreErr
+}
+
+// Put saves value, encoded as JSON, as the record identified by key into
+// the given collection, replacing any previous record with the same key.
+func (s *Store) Put(collection string, key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s record %s: %w", collection, key, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data[collection] == nil {
+		s.data[collection] = make(map[string]json.RawMessage)
+	}
+	s.data[collection][key] = encoded
+
+	return s.save()
+}
+
+// Get decodes the record identified by key from the given collection into
+// value. ErrNotFound is returned when there is no such record.
+func (s *Store) Get(collection string, key string, value interface{}) error {
+	s.mu.RLock()
+	encoded, found := s.data[collection][key]
+	s.mu.RUnlock()
+
+	if !found {
+		return ErrNotFound
+	}
+
+	if err := json.Unmarshal(encoded, value); err != nil {
+		return fmt.Errorf("unable to decode %s record %s: %w", collection, key, err)
+	}
+
+	return nil
+}
+
+// Delete removes the record identified by key from the given collection.
+// Removing a record which does not exist is not an error.
+func (s *Store) Delete(collection string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.data[collection][key]; !found {
+		return nil
+	}
+	delete(s.data[collection], key)
+
+	return s.save()
+}
+
+// Keys returns the sorted keys of all the records into the given collection
+func (s *Store) Keys(collection string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.data[collection]))
+	for key := range s.data[collection] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// save writes all the records to the store file. The caller must hold the
+// write lock.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(s.data)
+	if err != nil {
+		return fmt.Errorf("unable to encode store records: %w", err)
+	}
+
+	// Write into a temporary file first, so a failure in the middle of the
+	// write cannot leave the store file truncated.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create store file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write store file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write store file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("unable to save store file %s: %w", s.path, err)
+	}
+
+	return nil
+}
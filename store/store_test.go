@@ -0,0 +1,78 @@
+//
+// Copyright 2020 Joyent, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joyent/triton-shim/store"
+)
+
+type record struct {
+	ID    string
+	State string
+}
+
+func TestStoreRecords(t *testing.T) {
+	s, err := store.New("")
+	if err != nil {
+		t.Errorf("expected error to be nil: received %v", err)
+		return
+	}
+
+	var got record
+	assert.Equal(t, store.ErrNotFound, s.Get("tasks", "task-1", &got))
+
+	assert.Empty(t, s.Put("tasks", "task-2", &record{ID: "task-2", State: "active"}))
+	assert.Empty(t, s.Put("tasks", "task-1", &record{ID: "task-1", State: "active"}))
+	assert.Empty(t, s.Put("tasks", "task-1", &record{ID: "task-1", State: "completed"}))
+
+	assert.Empty(t, s.Get("tasks", "task-1", &got))
+	assert.Equal(t, "completed", got.State)
+	assert.Equal(t, []string{"task-1", "task-2"}, s.Keys("tasks"))
+	assert.Empty(t, s.Keys("other"))
+
+	assert.Empty(t, s.Delete("tasks", "task-2"))
+	assert.Empty(t, s.Delete("tasks", "task-2"))
+	assert.Equal(t, []string{"task-1"}, s.Keys("tasks"))
+}
+
+func TestStoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-shim-store")
+	if err != nil {
+		t.Errorf("expected error to be nil: received %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	s, err := store.New(path)
+	if err != nil {
+		t.Errorf("expected error to be nil: received %v", err)
+		return
+	}
+	assert.Empty(t, s.Put("tasks", "task-1", &record{ID: "task-1", State: "active"}))
+
+	// A new store using the same file must see the saved records
+	reloaded, err := store.New(path)
+	if err != nil {
+		t.Errorf("expected error to be nil: received %v", err)
+		return
+	}
+
+	var got record
+	assert.Empty(t, reloaded.Get("tasks", "task-1", &got))
+	assert.Equal(t, "active", got.State)
+}
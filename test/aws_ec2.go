@@ -14,17 +14,21 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/sts"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joyent/triton-shim/server"
 )
 
-// GetEC2Svc will start a shim server and return an ec2 service that points to
-// the shim server.
-func GetEC2Svc(t *testing.T, runTest func(ec2Svc *ec2.EC2)) {
+// startShim starts a shim server and returns the AWS configuration pointing
+// to it
+func startShim(t *testing.T) aws.Config {
 	// Switch to test mode so you don't get such noisy output
 	gin.SetMode(gin.TestMode)
 	engine := server.Setup()
@@ -43,12 +47,20 @@ func GetEC2Svc(t *testing.T, runTest func(ec2Svc *ec2.EC2)) {
 	}()
 
 	// Load session from shared config
-	awsConfig := aws.Config{
-		Region:      unit.Session.Config.Region,
-		DisableSSL:  aws.Bool(true),
-		Endpoint:    aws.String(fmt.Sprintf("http://%s", listener.Addr().String())),
-		Credentials: unit.Session.Config.Credentials,
+	return aws.Config{
+		Region:     unit.Session.Config.Region,
+		DisableSSL: aws.Bool(true),
+		Endpoint:   aws.String(fmt.Sprintf("http://%s", listener.Addr().String())),
+		// The unit testing access key is a long-lived key, which must not be
+		// given a session token
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
 	}
+}
+
+// GetEC2Svc will start a shim server and return an ec2 service that points to
+// the shim server.
+func GetEC2Svc(t *testing.T, runTest func(ec2Svc *ec2.EC2)) {
+	awsConfig := startShim(t)
 
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
@@ -60,3 +72,51 @@ func GetEC2Svc(t *testing.T, runTest func(ec2Svc *ec2.EC2)) {
 
 	runTest(ec2Svc)
 }
+
+// GetRoute53Svc will start a shim server and return a route53 service that
+// points to the shim server.
+func GetRoute53Svc(t *testing.T, runTest func(route53Svc *route53.Route53)) {
+	awsConfig := startShim(t)
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            awsConfig,
+	}))
+
+	// Create new Route 53 client
+	route53Svc := route53.New(sess)
+
+	runTest(route53Svc)
+}
+
+// GetEC2InstanceConnectSvc will start a shim server and return an EC2
+// Instance Connect service that points to the shim server.
+func GetEC2InstanceConnectSvc(t *testing.T, runTest func(connectSvc *ec2instanceconnect.EC2InstanceConnect)) {
+	awsConfig := startShim(t)
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            awsConfig,
+	}))
+
+	// Create new EC2 Instance Connect client
+	connectSvc := ec2instanceconnect.New(sess)
+
+	runTest(connectSvc)
+}
+
+// GetSTSSvc will start a shim server and return an STS service that points
+// to the shim server.
+func GetSTSSvc(t *testing.T, runTest func(stsSvc *sts.STS)) {
+	awsConfig := startShim(t)
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            awsConfig,
+	}))
+
+	// Create new STS client
+	stsSvc := sts.New(sess)
+
+	runTest(stsSvc)
+}
@@ -22,6 +22,12 @@ func (w bodyLogWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
+// debugMode tells if TRITON_SHIM_DEBUG_HTTP is set, which dumps requests and
+// responses, and details signature mismatches
+func debugMode() bool {
+	return os.Getenv("TRITON_SHIM_DEBUG_HTTP") != ""
+}
+
 func ShimLogger() gin.HandlerFunc {
 	log.Logger = log.Output(
 		zerolog.ConsoleWriter{
@@ -31,7 +37,7 @@ func ShimLogger() gin.HandlerFunc {
 		},
 	)
 
-	debugHTTP := os.Getenv("TRITON_SHIM_DEBUG_HTTP")
+	debugHTTP := debugMode()
 
 	return func(c *gin.Context) {
 		var bodyWriter *bodyLogWriter
@@ -42,7 +48,7 @@ func ShimLogger() gin.HandlerFunc {
 			path = path + "?" + raw
 		}
 
-		if debugHTTP != "" {
+		if debugHTTP {
 			b, err := httputil.DumpRequest(c.Request, true)
 			if err == nil {
 				log.Printf("Request: %s\n", b)
@@ -83,7 +89,7 @@ func ShimLogger() gin.HandlerFunc {
 			}
 		default:
 			dumplogger.Info().Msg(msg)
-			if debugHTTP != "" {
+			if debugHTTP {
 				log.Logger.Debug().Msg("Response: " + bodyWriter.Body.String())
 			}
 		}
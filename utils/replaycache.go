@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readOnlyActionPrefixes are the prefixes of the actions which do not change
+// anything, so replaying them does no harm
+var readOnlyActionPrefixes = []string{"Describe", "Get", "List"}
+
+// requestAction returns the name of the action performed by the request,
+// given by the Action parameter of query APIs or the X-Amz-Target header of
+// JSON APIs. REST APIs, like Route 53, have no action name.
+func requestAction(r *http.Request, body io.ReadSeeker) string {
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		return target[strings.LastIndex(target, ".")+1:]
+	}
+	if action := r.URL.Query().Get("Action"); action != "" {
+		return action
+	}
+	if body != nil && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		content, err := ioutil.ReadAll(body)
+		body.Seek(0, io.SeekStart)
+		if form, formErr := url.ParseQuery(string(content)); err == nil && formErr == nil {
+			return form.Get("Action")
+		}
+	}
+	return ""
+}
+
+// isMutatingRequest tells if the request may change resources, which the
+// replays of the request must not do again
+func isMutatingRequest(r *http.Request, body io.ReadSeeker) bool {
+	action := requestAction(r, body)
+	if action == "" {
+		return r.Method != http.MethodGet && r.Method != http.MethodHead
+	}
+	for _, prefix := range readOnlyActionPrefixes {
+		if strings.HasPrefix(action, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// replayCache remembers the signatures of the requests received, per access
+// key, until the requests expire. Expired requests are rejected anyway, so
+// their signatures are forgotten.
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]map[string]time.Time
+}
+
+// newReplayCache returns an empty replay cache
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]map[string]time.Time)}
+}
+
+// replayed records the signature of a request signed with the access key,
+// which expires at the given time, and tells if it was already recorded
+func (cache *replayCache) replayed(accessKeyID string, signature string, expires time.Time, now time.Time) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	signatures, found := cache.seen[accessKeyID]
+	if !found {
+		signatures = make(map[string]time.Time)
+		cache.seen[accessKeyID] = signatures
+	}
+	for seenSignature, seenExpires := range signatures {
+		if now.After(seenExpires) {
+			delete(signatures, seenSignature)
+		}
+	}
+
+	if _, found := signatures[signature]; found {
+		return true
+	}
+	signatures[signature] = expires
+	return false
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/joyent/triton-shim/store"
+	tritonutils "github.com/joyent/triton-shim/utils/triton"
+)
+
+// Temporary credentials are issued by the STS actions to principals which
+// already have a Triton access key. They are kept into the shim store until
+// they expire, and only sign requests of the region they were issued in,
+// together with their session token.
+
+// sessionsCollection is the store collection for the temporary credentials
+const sessionsCollection = "session-credentials"
+
+// sessionAccessKeyPrefix is the prefix of temporary access key IDs, which
+// tells them apart from Triton access keys, like AWS does
+const sessionAccessKeyPrefix = "ASIA"
+
+// ErrExpiredToken The temporary credentials have expired
+var ErrExpiredToken = errors.New("expired session token")
+
+// ErrInvalidToken The session token does not belong to the access key, the
+// temporary credentials were issued in another region, or a Triton access
+// key was given a session token
+var ErrInvalidToken = errors.New("invalid session token")
+
+// ErrNoAccount Temporary credentials are only issued to principals of a
+// Triton account, so the unit testing key cannot get any
+var ErrNoAccount = errors.New("principal without account")
+
+// SessionCredentials are the temporary credentials issued to a principal
+type SessionCredentials struct {
+	AccessKeyID     string    `json:"access_key_id"`
+	SecretAccessKey string    `json:"secret_access_key"`
+	SessionToken    string    `json:"session_token"`
+	Expiration      time.Time `json:"expiration"`
+	AccountID       string    `json:"account_id"`
+	Account         string    `json:"account"`
+	UserID          string    `json:"user_id"`
+	User            string    `json:"user"`
+	Role            string    `json:"role"`
+	Region          string    `json:"region"`
+}
+
+// randomString returns a random string of the given length made of the
+// given characters
+func randomString(length int, chars string) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = chars[int(b)%len(chars)]
+	}
+	return string(buf), nil
+}
+
+// isSessionAccessKey tells if the access key is a temporary one
+func isSessionAccessKey(accessKeyID string) bool {
+	return strings.HasPrefix(accessKeyID, sessionAccessKeyPrefix)
+}
+
+// expireSessions removes the temporary credentials expired at the given time
+func expireSessions(db *store.Store, now time.Time) {
+	for _, id := range db.Keys(sessionsCollection) {
+		var session SessionCredentials
+		if err := db.Get(sessionsCollection, id, &session); err != nil {
+			continue
+		}
+		if now.After(session.Expiration) {
+			db.Delete(sessionsCollection, id)
+		}
+	}
+}
+
+// IssueSessionCredentials issues temporary credentials acting as the
+// principal in the given region, with the given role if any, for the given
+// duration
+func IssueSessionCredentials(region string, principal *tritonutils.Principal, role string,
+	duration time.Duration) (*SessionCredentials, error) {
+	if principal == nil || principal.Account == "" || principal.AccountID == "" {
+		return nil, ErrNoAccount
+	}
+
+	db, err := store.Default()
+	if err != nil {
+		return nil, err
+	}
+
+	const alphanumeric = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	id, err := randomString(16, alphanumeric)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomString(40, alphanumeric+"abcdefghijklmnopqrstuvwxyz")
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 96)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	expireSessions(db, now)
+
+	session := &SessionCredentials{
+		AccessKeyID:     sessionAccessKeyPrefix + id,
+		SecretAccessKey: secret,
+		SessionToken:    base64.StdEncoding.EncodeToString(token),
+		Expiration:      now.Add(duration).Truncate(time.Second),
+		AccountID:       principal.AccountID,
+		Account:         principal.Account,
+		UserID:          principal.UserID,
+		User:            principal.User,
+		Role:            role,
+		Region:          region,
+	}
+	if err := db.Put(sessionsCollection, session.AccessKeyID, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// lookupSession returns the principal of temporary credentials, which are
+// only valid with their session token, in the region they were issued in,
+// and until they expire
+func lookupSession(region string, accessKeyID string, sessionToken string, now time.Time) (*tritonutils.Principal, error) {
+	db, err := store.Default()
+	if err != nil {
+		return nil, err
+	}
+
+	var session SessionCredentials
+	err = db.Get(sessionsCollection, accessKeyID, &session)
+	if err == store.ErrNotFound {
+		return nil, tritonutils.ErrUnknownAccessKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal([]byte(sessionToken), []byte(session.SessionToken)) || session.Region != region {
+		return nil, ErrInvalidToken
+	}
+	if now.After(session.Expiration) {
+		return nil, ErrExpiredToken
+	}
+
+	return &tritonutils.Principal{
+		AccountID:       session.AccountID,
+		Account:         session.Account,
+		UserID:          session.UserID,
+		User:            session.User,
+		AccessKeyID:     session.AccessKeyID,
+		SecretAccessKey: session.SecretAccessKey,
+		SessionToken:    session.SessionToken,
+		Role:            session.Role,
+	}, nil
+}
@@ -1,30 +1,23 @@
 package tritonutils
 
 import (
-	triton "github.com/joyent/triton-go/v2"
 	tritonaccount "github.com/joyent/triton-go/v2/account"
-	tritonauth "github.com/joyent/triton-go/v2/authentication"
 )
 
 // GetTritonAccountClient is a Helper to return a CloudAPI account client used to manipulate
-// AccessKeys.
-// TODO: Modify to accept account and user names, since we plan to access multiple accounts
-// from single application, not only the ENV account.
-func GetTritonAccountClient() (*tritonaccount.AccountClient, error) {
-	var err error
-	var signer *tritonauth.Signer
-	signer, err = GetTritonAuthSigner()
-
+// AccessKeys. Accounts are shared by all the datacenters, but some settings, like the
+// default network, belong to the region the client is created for. The client acts as
+// the account of the principal (see clientConfig).
+func GetTritonAccountClient(region string, principal *Principal) (*tritonaccount.AccountClient, error) {
+	config, err := clientConfig(region, principal)
 	if err != nil {
 		return nil, err
 	}
 
-	config := &triton.ClientConfig{
-		TritonURL:   triton.GetEnv("URL"),
-		AccountName: triton.GetEnv("ACCOUNT"),
-		Username:    triton.GetEnv("USER"),
-		Signers:     []tritonauth.Signer{*signer},
+	client, err := tritonaccount.NewClient(config)
+	if err != nil {
+		return nil, err
 	}
-
-	return tritonaccount.NewClient(config)
+	actAsRole(client.Client, principal)
+	return client, nil
 }
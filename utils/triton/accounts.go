@@ -0,0 +1,181 @@
+package tritonutils
+
+import (
+	"errors"
+	"net/http"
+
+	triton "github.com/joyent/triton-go/v2"
+	tritonauth "github.com/joyent/triton-go/v2/authentication"
+	tritonclient "github.com/joyent/triton-go/v2/client"
+)
+
+// ErrUnsupportedUser The sub-user has no key the shim can act with, or an
+// account owner has a role, which would not restrict it
+var ErrUnsupportedUser = errors.New("unsupported sub-user")
+
+// ErrNoAccount The principal does not belong to any account, so the shim
+// cannot act as it
+var ErrNoAccount = errors.New("principal without account")
+
+// AccountConfig describes the CloudAPI key of one of the accounts of the JSON
+// file given by TRITON_SHIM_ACCOUNTS_FILE, keyed by account login. The key
+// material is either a private key file path or the private key itself, and
+// the optional user is the sub-user owning the key. For example:
+//
+//    {
+//        "alice": {
+//            "key_id": "d0:6d:7d:10:97:45:93:a0:54:c8:e8:a2:53:8b:4d:c8",
+//            "key_material": "/etc/triton-shim/keys/alice"
+//        }
+//    }
+type AccountConfig struct {
+	KeyID       string `json:"key_id"`
+	KeyMaterial string `json:"key_material"`
+	User        string `json:"user"`
+}
+
+// accountsFile is the JSON file given by TRITON_SHIM_ACCOUNTS_FILE
+var accountsFile = &configFile{envVar: "TRITON_SHIM_ACCOUNTS_FILE", name: "accounts"}
+
+// LoadAccountsConfig reads TRITON_SHIM_ACCOUNTS_FILE, unless it did not
+// change since the last time. When it is not set, nil is returned. The
+// accounts must not be modified.
+func LoadAccountsConfig() (map[string]*AccountConfig, error) {
+	value, err := accountsFile.load(func() interface{} {
+		return &map[string]*AccountConfig{}
+	})
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return *value.(*map[string]*AccountConfig), nil
+}
+
+// principalKey returns the key the CloudAPI requests of the principal are
+// signed with: nil for the TRITON_ACCOUNT key, either acting as
+// TRITON_ACCOUNT or on behalf of another account, or the principal entry of
+// the accounts file. Keys never act with more rights than the principal, so
+// sub-users can only use the key of the same sub-user, while account owners
+// can use any key of their account. Without a principal, the shim acts as
+// itself.
+func principalKey(principal *Principal) (*AccountConfig, error) {
+	if principal == nil {
+		return nil, nil
+	}
+	if principal.Account == "" {
+		return nil, ErrNoAccount
+	}
+	// Triton RBAC roles only restrict sub-users
+	if principal.Role != "" && principal.User == "" {
+		return nil, ErrUnsupportedUser
+	}
+	if principal.Account == triton.GetEnv("ACCOUNT") &&
+		(principal.User == "" || principal.User == triton.GetEnv("USER")) {
+		return nil, nil
+	}
+
+	accounts, err := LoadAccountsConfig()
+	if err != nil {
+		return nil, err
+	}
+	account, found := accounts[principal.Account]
+	if found && account != nil && (principal.User == "" || principal.User == account.User) {
+		return account, nil
+	}
+
+	// Impersonating the account would grant its sub-users the rights of
+	// the account owner
+	if principal.User != "" {
+		return nil, ErrUnsupportedUser
+	}
+	return nil, nil
+}
+
+// CheckPrincipal tells whether the CloudAPI requests of the principal can be
+// signed, which fails with ErrNoAccount for principals without account, and
+// ErrUnsupportedUser for sub-users without a key of their own
+func CheckPrincipal(principal *Principal) error {
+	_, err := principalKey(principal)
+	return err
+}
+
+// clientConfig returns the CloudAPI client configuration acting as the
+// account of the principal in the given region. Without a principal, meant
+// for the shim own requests, or for the principal of TRITON_ACCOUNT itself,
+// the client acts as TRITON_ACCOUNT. Principals without account are
+// rejected. Accounts of the accounts file use their own key, and any
+// other account is impersonated by TRITON_ACCOUNT, which must then be an
+// operator. Sub-users are only served by their own key (see principalKey).
+func clientConfig(region string, principal *Principal) (*triton.ClientConfig, error) {
+	url, err := RegionURL(region)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := principalKey(principal)
+	if err != nil {
+		return nil, err
+	}
+	if account != nil {
+		signer, err := newAuthSigner(principal.Account, account.User,
+			account.KeyID, account.KeyMaterial)
+		if err != nil {
+			return nil, err
+		}
+		return &triton.ClientConfig{
+			TritonURL:   url,
+			AccountName: principal.Account,
+			Username:    account.User,
+			Signers:     []tritonauth.Signer{*signer},
+		}, nil
+	}
+
+	signer, err := GetTritonAuthSigner()
+	if err != nil {
+		return nil, err
+	}
+	accountName := triton.GetEnv("ACCOUNT")
+	if principal == nil || principal.Account == accountName {
+		return &triton.ClientConfig{
+			TritonURL:   url,
+			AccountName: accountName,
+			Username:    triton.GetEnv("USER"),
+			Signers:     []tritonauth.Signer{*signer},
+		}, nil
+	}
+
+	// The operator key signs the requests, which are sent to the paths of
+	// the principal account
+	return &triton.ClientConfig{
+		TritonURL:   url,
+		AccountName: principal.Account,
+		Signers:     []tritonauth.Signer{*signer},
+	}, nil
+}
+
+// roleTransport adds the as-role parameter to the CloudAPI requests, so
+// they only have the permissions of the role. CloudAPI only signs the date
+// header, so the parameter can be added to signed requests.
+type roleTransport struct {
+	role string
+	next http.RoundTripper
+}
+
+func (t *roleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Set("as-role", t.role)
+	req.URL.RawQuery = query.Encode()
+	return t.next.RoundTrip(req)
+}
+
+// actAsRole makes the requests of the client act as the role of the
+// principal, if any, like AssumeRole credentials require
+func actAsRole(client *tritonclient.Client, principal *Principal) {
+	if principal == nil || principal.Role == "" {
+		return
+	}
+	client.HTTPClient.Transport = &roleTransport{
+		role: principal.Role,
+		next: client.HTTPClient.Transport,
+	}
+}
@@ -1,27 +1,22 @@
 package tritonutils
 
 import (
-	triton "github.com/joyent/triton-go/v2"
-	tritonauth "github.com/joyent/triton-go/v2/authentication"
 	tritoncompute "github.com/joyent/triton-go/v2/compute"
 )
 
-// GetTritonComputeClient is a Helper to return a CloudAPI compute client.
-func GetTritonComputeClient() (*tritoncompute.ComputeClient, error) {
-	var err error
-	var signer *tritonauth.Signer
-	signer, err = GetTritonAuthSigner()
-
+// GetTritonComputeClient is a Helper to return a CloudAPI compute client for
+// the given region (see RegionURL), acting as the account of the principal
+// (see clientConfig).
+func GetTritonComputeClient(region string, principal *Principal) (*tritoncompute.ComputeClient, error) {
+	config, err := clientConfig(region, principal)
 	if err != nil {
 		return nil, err
 	}
 
-	config := &triton.ClientConfig{
-		TritonURL:   triton.GetEnv("URL"),
-		AccountName: triton.GetEnv("ACCOUNT"),
-		Username:    triton.GetEnv("USER"),
-		Signers:     []tritonauth.Signer{*signer},
+	client, err := tritoncompute.NewClient(config)
+	if err != nil {
+		return nil, err
 	}
-
-	return tritoncompute.NewClient(config)
+	actAsRole(client.Client, principal)
+	return client, nil
 }
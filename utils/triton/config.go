@@ -0,0 +1,70 @@
+package tritonutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// configFile is a JSON configuration file given by an environment variable.
+// It is decoded once, and only read again when it changes.
+type configFile struct {
+	envVar string
+	name   string
+
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	value   interface{}
+}
+
+// load returns the decoded file contents, as a value made by newValue. When
+// the environment variable is not set, nil is returned. The value is shared
+// by all the callers, which must not modify it.
+func (f *configFile) load(newValue func() interface{}) (interface{}, error) {
+	path := os.Getenv(f.envVar)
+	if path == "" {
+		return nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s file: %w", f.name, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.value != nil && f.path == path && f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+		return f.value, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s file: %w", f.name, err)
+	}
+
+	value := newValue()
+	if err := json.Unmarshal(content, value); err != nil {
+		return nil, fmt.Errorf("Unable to decode %s file: %w", f.name, err)
+	}
+
+	f.path, f.modTime, f.size, f.value = path, info.ModTime(), info.Size(), value
+	return value, nil
+}
+
+// CheckConfigFiles loads the configuration files, so that malformed ones
+// are reported when the shim starts rather than by every request
+func CheckConfigFiles() error {
+	if _, err := LoadRegionsConfig(); err != nil {
+		return err
+	}
+	if _, err := LoadAccountsConfig(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package tritonutils
+
+import (
+	tritonidentity "github.com/joyent/triton-go/v2/identity"
+)
+
+// GetTritonIdentityClient is a Helper to return a CloudAPI identity client for
+// the given region, used for the RBAC users and roles, acting as the account
+// of the principal (see clientConfig).
+func GetTritonIdentityClient(region string, principal *Principal) (*tritonidentity.IdentityClient, error) {
+	config, err := clientConfig(region, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := tritonidentity.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	actAsRole(client.Client, principal)
+	return client, nil
+}
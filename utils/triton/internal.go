@@ -0,0 +1,71 @@
+package tritonutils
+
+import (
+	"os"
+
+	"github.com/joyent/triton-shim/api"
+)
+
+// Triton internal APIs are only reachable when the shim runs from the Triton
+// admin network (operator mode). Their URLs are taken from the region entry
+// of the regions file or, when not set there, from the environment. When
+// there is no URL at all, constructors will fail with api.ErrMissingURL.
+
+// internalURL returns the URL of an internal API for the given region,
+// picked from the region configuration or the environment variable
+func internalURL(region string, pick func(*RegionConfig) string, envVar string) (string, error) {
+	config, err := regionConfig(region)
+	if err != nil {
+		return "", err
+	}
+
+	if config != nil && pick(config) != "" {
+		return pick(config), nil
+	}
+	return os.Getenv(envVar), nil
+}
+
+// GetImgapiClient is a Helper to return an IMGAPI client using IMGAPI_URL.
+func GetImgapiClient(region string) (*api.ImgapiClient, error) {
+	url, err := internalURL(region, func(r *RegionConfig) string { return r.ImgapiURL }, "IMGAPI_URL")
+	if err != nil {
+		return nil, err
+	}
+	return api.NewImgapi(url)
+}
+
+// GetPapiClient is a Helper to return a PAPI client using PAPI_URL.
+func GetPapiClient(region string) (*api.PapiClient, error) {
+	url, err := internalURL(region, func(r *RegionConfig) string { return r.PapiURL }, "PAPI_URL")
+	if err != nil {
+		return nil, err
+	}
+	return api.NewPapi(url)
+}
+
+// GetCnapiClient is a Helper to return a CNAPI client using CNAPI_URL.
+func GetCnapiClient(region string) (*api.CnapiClient, error) {
+	url, err := internalURL(region, func(r *RegionConfig) string { return r.CnapiURL }, "CNAPI_URL")
+	if err != nil {
+		return nil, err
+	}
+	return api.NewCnapi(url)
+}
+
+// GetVmapiClient is a Helper to return a VMAPI client using VMAPI_URL.
+func GetVmapiClient(region string) (*api.VmapiClient, error) {
+	url, err := internalURL(region, func(r *RegionConfig) string { return r.VmapiURL }, "VMAPI_URL")
+	if err != nil {
+		return nil, err
+	}
+	return api.NewVmapi(url)
+}
+
+// GetMahiClient is a Helper to return a Mahi client using MAHI_URL.
+func GetMahiClient(region string) (*api.MahiClient, error) {
+	url, err := internalURL(region, func(r *RegionConfig) string { return r.MahiURL }, "MAHI_URL")
+	if err != nil {
+		return nil, err
+	}
+	return api.NewMahi(url)
+}
@@ -0,0 +1,22 @@
+package tritonutils
+
+import (
+	tritonnetwork "github.com/joyent/triton-go/v2/network"
+)
+
+// GetTritonNetworkClient is a Helper to return a CloudAPI network client for
+// the given region, used for networks, fabrics and firewall rules, acting as
+// the account of the principal (see clientConfig).
+func GetTritonNetworkClient(region string, principal *Principal) (*tritonnetwork.NetworkClient, error) {
+	config, err := clientConfig(region, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := tritonnetwork.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	actAsRole(client.Client, principal)
+	return client, nil
+}
@@ -0,0 +1,317 @@
+package tritonutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	tritonaccount "github.com/joyent/triton-go/v2/account"
+	tritonclient "github.com/joyent/triton-go/v2/client"
+
+	"github.com/joyent/triton-shim/api"
+)
+
+// ErrUnknownAccessKey No account or sub-user owns the access key
+var ErrUnknownAccessKey = errors.New("unknown access key")
+
+// ErrInactiveAccessKey The access key has been disabled
+var ErrInactiveAccessKey = errors.New("inactive access key")
+
+// Principal is the Triton account, and the sub-user if any, owning the
+// access key used to sign a request. Temporary access keys also have a
+// session token, and a role when they were issued by AssumeRole.
+type Principal struct {
+	AccountID       string
+	Account         string
+	UserID          string
+	User            string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Role            string
+}
+
+// accessKeyActive is the status of the access keys which can sign requests
+const accessKeyActive = "Active"
+
+// Access keys are looked up before the request signature can be checked, so
+// any client could make the shim send lookup requests. Lookups are cached,
+// including those of unknown and inactive keys, and the CloudAPI access keys
+// are listed at most once per accessKeysRefreshInterval.
+const (
+	accessKeyCacheTTL         = time.Minute
+	accessKeyCacheSize        = 10000
+	accessKeysRefreshInterval = 10 * time.Second
+)
+
+// accessKeyLookup is a cached access key lookup, which found either the
+// principal or that the key cannot be used
+type accessKeyLookup struct {
+	principal *Principal
+	err       error
+	expires   time.Time
+}
+
+// accessKeyCache caches the lookups by region and access key ID
+var accessKeyCache = struct {
+	sync.Mutex
+	lookups map[string]*accessKeyLookup
+}{lookups: make(map[string]*accessKeyLookup)}
+
+// cachedAccessKeyLookup returns the cached lookup of an access key, if any
+func cachedAccessKeyLookup(key string, now time.Time) *accessKeyLookup {
+	accessKeyCache.Lock()
+	defer accessKeyCache.Unlock()
+
+	lookup, found := accessKeyCache.lookups[key]
+	if !found || now.After(lookup.expires) {
+		return nil
+	}
+	return lookup
+}
+
+// cacheAccessKeyLookup caches the lookup of an access key. When the cache is
+// full, the expired lookups are dropped, or all of them if none expired.
+func cacheAccessKeyLookup(key string, lookup *accessKeyLookup, now time.Time) {
+	accessKeyCache.Lock()
+	defer accessKeyCache.Unlock()
+
+	if len(accessKeyCache.lookups) >= accessKeyCacheSize {
+		for other, cached := range accessKeyCache.lookups {
+			if now.After(cached.expires) {
+				delete(accessKeyCache.lookups, other)
+			}
+		}
+		if len(accessKeyCache.lookups) >= accessKeyCacheSize {
+			accessKeyCache.lookups = make(map[string]*accessKeyLookup)
+		}
+	}
+	accessKeyCache.lookups[key] = lookup
+}
+
+// LookupAccessKey finds the owner of an access key. Access keys are looked
+// up into Mahi, which knows about the access keys of every account, when the
+// region has a Mahi URL (see GetMahiClient). Otherwise, they are looked up
+// through CloudAPI, which only knows about the access keys of the shim
+// account (TRITON_ACCOUNT) and its sub-users. Lookups are cached for a
+// minute, so disabled keys may still be used during that time.
+func LookupAccessKey(region string, accessKeyID string) (*Principal, error) {
+	now := time.Now()
+	cacheKey := region + "/" + accessKeyID
+	if lookup := cachedAccessKeyLookup(cacheKey, now); lookup != nil {
+		return lookup.principal, lookup.err
+	}
+
+	var principal *Principal
+	mahi, err := GetMahiClient(region)
+	switch {
+	case errors.Is(err, api.ErrMissingURL):
+		principal, err = lookupCloudAPIAccessKey(region, accessKeyID, now)
+	case err != nil:
+		return nil, fmt.Errorf("Unable to create Mahi client: %w", err)
+	default:
+		principal, err = lookupMahiAccessKey(mahi, accessKeyID)
+	}
+
+	// Other errors are not about the access key, and are not cached
+	if err == nil || err == ErrUnknownAccessKey || err == ErrInactiveAccessKey {
+		cacheAccessKeyLookup(cacheKey, &accessKeyLookup{
+			principal: principal,
+			err:       err,
+			expires:   now.Add(accessKeyCacheTTL),
+		}, now)
+	}
+	return principal, err
+}
+
+// lookupMahiAccessKey finds the owner of an access key using Mahi
+func lookupMahiAccessKey(mahi *api.MahiClient, accessKeyID string) (*Principal, error) {
+	info, err := mahi.GetAccessKeyAuthInfo(context.Background(), accessKeyID)
+	if err != nil {
+		var apiErr *api.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return nil, ErrUnknownAccessKey
+		}
+		return nil, fmt.Errorf("Unable to get access key from Mahi: %w", err)
+	}
+
+	key := info.AccessKey(accessKeyID)
+	if info.Account == nil || key == nil || key.Secret == "" {
+		return nil, ErrUnknownAccessKey
+	}
+	// Like CloudAPI keys, keys without status are active
+	if key.Status != "" && key.Status != accessKeyActive {
+		return nil, ErrInactiveAccessKey
+	}
+
+	principal := &Principal{
+		AccountID:       info.Account.UUID,
+		Account:         info.Account.Login,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: key.Secret,
+	}
+	if info.User != nil {
+		principal.UserID = info.User.UUID
+		principal.User = info.User.Login
+	}
+	return principal, nil
+}
+
+// cloudAPIUser is a CloudAPI sub-user
+type cloudAPIUser struct {
+	ID    string `json:"id"`
+	Login string `json:"login"`
+}
+
+// listUserAccessKeys lists the access keys of a sub-user of the account,
+// which triton-go does not support yet
+func listUserAccessKeys(client *tritonaccount.AccountClient, user string) ([]*tritonaccount.AccessKey, error) {
+	respReader, err := client.Client.ExecuteRequest(context.Background(), tritonclient.RequestInput{
+		Method: http.MethodGet,
+		Path:   path.Join("/", client.Client.AccountName, "users", user, "accesskeys"),
+	})
+	if respReader != nil {
+		defer respReader.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*tritonaccount.AccessKey
+	if err := json.NewDecoder(respReader).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("Unable to decode user access keys: %w", err)
+	}
+	return keys, nil
+}
+
+// listUsers lists the sub-users of the account
+func listUsers(client *tritonaccount.AccountClient) ([]*cloudAPIUser, error) {
+	respReader, err := client.Client.ExecuteRequest(context.Background(), tritonclient.RequestInput{
+		Method: http.MethodGet,
+		Path:   path.Join("/", client.Client.AccountName, "users"),
+	})
+	if respReader != nil {
+		defer respReader.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*cloudAPIUser
+	if err := json.NewDecoder(respReader).Decode(&users); err != nil {
+		return nil, fmt.Errorf("Unable to decode users: %w", err)
+	}
+	return users, nil
+}
+
+// cloudAPIAccessKey is one of the access keys of the shim account or its
+// sub-users, with its owner
+type cloudAPIAccessKey struct {
+	key  *tritonaccount.AccessKey
+	user *cloudAPIUser
+}
+
+// cloudAPIAccessKeys are the access keys of the shim account and its
+// sub-users, by region, with when they were listed
+var cloudAPIAccessKeys = struct {
+	sync.Mutex
+	regions map[string]*cloudAPIAccessKeysList
+}{regions: make(map[string]*cloudAPIAccessKeysList)}
+
+// cloudAPIAccessKeysList lists the access keys of a region by ID
+type cloudAPIAccessKeysList struct {
+	account *tritonaccount.Account
+	keys    map[string]*cloudAPIAccessKey
+	listed  time.Time
+}
+
+// listCloudAPIAccessKeys lists the access keys of the shim account and its
+// sub-users
+func listCloudAPIAccessKeys(region string, now time.Time) (*cloudAPIAccessKeysList, error) {
+	client, err := GetTritonAccountClient(region, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create triton account client: %w", err)
+	}
+
+	account, err := client.Get(context.Background(), &tritonaccount.GetInput{})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get triton account: %w", err)
+	}
+
+	list := &cloudAPIAccessKeysList{
+		account: account,
+		keys:    make(map[string]*cloudAPIAccessKey),
+		listed:  now,
+	}
+
+	keys, err := client.AccessKeys().ListAccessKeys(context.Background(), &tritonaccount.ListAccessKeysInput{})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve triton account keys: %w", err)
+	}
+	for _, key := range keys {
+		list.keys[key.AccessKeyID] = &cloudAPIAccessKey{key: key}
+	}
+
+	users, err := listUsers(client)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list triton users: %w", err)
+	}
+	for _, user := range users {
+		userKeys, err := listUserAccessKeys(client, user.Login)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to retrieve triton user keys: %w", err)
+		}
+		for _, key := range userKeys {
+			list.keys[key.AccessKeyID] = &cloudAPIAccessKey{key: key, user: user}
+		}
+	}
+
+	return list, nil
+}
+
+// lookupCloudAPIAccessKey finds the owner of an access key among the shim
+// account and its sub-users. Their access keys are listed again once they are
+// older than accessKeyCacheTTL, or when the key is not found, but not more
+// than once per accessKeysRefreshInterval.
+func lookupCloudAPIAccessKey(region string, accessKeyID string, now time.Time) (*Principal, error) {
+	cloudAPIAccessKeys.Lock()
+	defer cloudAPIAccessKeys.Unlock()
+
+	list := cloudAPIAccessKeys.regions[region]
+	stale := list == nil || now.Sub(list.listed) >= accessKeyCacheTTL
+	if !stale && list.keys[accessKeyID] == nil {
+		stale = now.Sub(list.listed) >= accessKeysRefreshInterval
+	}
+	if stale {
+		var err error
+		if list, err = listCloudAPIAccessKeys(region, now); err != nil {
+			return nil, err
+		}
+		cloudAPIAccessKeys.regions[region] = list
+	}
+
+	owned := list.keys[accessKeyID]
+	if owned == nil {
+		return nil, ErrUnknownAccessKey
+	}
+	if owned.key.Status != "" && owned.key.Status != accessKeyActive {
+		return nil, ErrInactiveAccessKey
+	}
+
+	principal := &Principal{
+		AccountID:       list.account.ID,
+		Account:         list.account.Login,
+		AccessKeyID:     owned.key.AccessKeyID,
+		SecretAccessKey: owned.key.SecretAccessKey,
+	}
+	if owned.user != nil {
+		principal.UserID = owned.user.ID
+		principal.User = owned.user.Login
+	}
+	return principal, nil
+}
@@ -0,0 +1,90 @@
+package tritonutils
+
+import (
+	"errors"
+	"fmt"
+
+	triton "github.com/joyent/triton-go/v2"
+)
+
+// ErrUnknownRegion The region is not one of the regions file
+var ErrUnknownRegion = errors.New("unknown region")
+
+// RegionConfig describes one of the regions of the JSON file given by
+// TRITON_SHIM_REGIONS_FILE. Regions are Triton datacenters: URL is their
+// CloudAPI endpoint, the optional imgapi, papi, cnapi, vmapi and mahi
+// entries are the URLs of their internal APIs, and Zones maps their availability
+// zone names to the compute node racks (rack_identifier) belonging to
+// them. For example:
+//
+//    {
+//        "us-east-1": {
+//            "url": "https://us-east-1.api.example.com",
+//            "cnapi": "http://10.99.99.22",
+//            "zones": {
+//                "us-east-1a": ["rack-01", "rack-02"],
+//                "us-east-1b": ["rack-03"]
+//            }
+//        }
+//    }
+type RegionConfig struct {
+	URL       string              `json:"url"`
+	ImgapiURL string              `json:"imgapi"`
+	PapiURL   string              `json:"papi"`
+	CnapiURL  string              `json:"cnapi"`
+	VmapiURL  string              `json:"vmapi"`
+	MahiURL   string              `json:"mahi"`
+	Zones     map[string][]string `json:"zones"`
+}
+
+// regionsFile is the JSON file given by TRITON_SHIM_REGIONS_FILE
+var regionsFile = &configFile{envVar: "TRITON_SHIM_REGIONS_FILE", name: "regions"}
+
+// LoadRegionsConfig reads TRITON_SHIM_REGIONS_FILE, unless it did not change
+// since the last time. When it is not set, nil is returned. The regions must
+// not be modified.
+func LoadRegionsConfig() (map[string]*RegionConfig, error) {
+	value, err := regionsFile.load(func() interface{} {
+		return &map[string]*RegionConfig{}
+	})
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return *value.(*map[string]*RegionConfig), nil
+}
+
+// regionConfig returns the configuration of the given region. It is nil
+// when there is no regions file or the region is empty, which stands for
+// the datacenter of TRITON_URL, and ErrUnknownRegion is returned when the
+// file does not include the region.
+func regionConfig(region string) (*RegionConfig, error) {
+	if region == "" {
+		return nil, nil
+	}
+
+	regions, err := LoadRegionsConfig()
+	if err != nil || regions == nil {
+		return nil, err
+	}
+
+	config, found := regions[region]
+	if !found || config == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownRegion, region)
+	}
+	return config, nil
+}
+
+// RegionURL returns the CloudAPI endpoint serving the given region. It is
+// TRITON_URL when there is no regions file, the region is empty or it has
+// no url.
+func RegionURL(region string) (string, error) {
+	config, err := regionConfig(region)
+	if err != nil {
+		return "", err
+	}
+
+	if config != nil && config.URL != "" {
+		return config.URL, nil
+	}
+	return triton.GetEnv("URL"), nil
+}
@@ -10,26 +10,26 @@ import (
 	tritonauth "github.com/joyent/triton-go/v2/authentication"
 )
 
-// TODO: This is currently hard coded to use a TRITON_ACCOUNT, we need to
-// update this to pass through the CloudAPI user authentication.
-// For prototype purposes, the used account should be an admin account if
-// we need to provide access to different accounts' resources.
-// Ideally, we should use either token based auth for the application, or
-// figure out a way to authenticate requests using AccessKeys against CloudAPI.
+// The shim signs CloudAPI requests with the key of TRITON_ACCOUNT, unless the
+// account it acts as has its own key (see LoadAccountsConfig). To act as
+// other accounts with its own key, TRITON_ACCOUNT must be an operator.
 
 // GetTritonAuthSigner is a helper method used to retrieve a triton.Signer object
 // suitable to be used with either triton compute or any other of the triton package
 // clients
 func GetTritonAuthSigner() (*tritonauth.Signer, error) {
+	// skipTLSVerify := triton.GetEnv("TRITON_SKIP_TLS_VERIFY")
+	return newAuthSigner(triton.GetEnv("ACCOUNT"), triton.GetEnv("USER"),
+		triton.GetEnv("KEY_ID"), triton.GetEnv("KEY_MATERIAL"))
+}
+
+// newAuthSigner returns a signer for the given key. Without key material, the
+// key is taken from the SSH agent. The key material is either a private key
+// file path or the private key itself.
+func newAuthSigner(account string, username string, keyID string, keyMaterial string) (*tritonauth.Signer, error) {
 	var err error
 	var signer tritonauth.Signer
 
-	account := triton.GetEnv("ACCOUNT")
-	keyID := triton.GetEnv("KEY_ID")
-	keyMaterial := triton.GetEnv("KEY_MATERIAL")
-	// skipTLSVerify := triton.GetEnv("TRITON_SKIP_TLS_VERIFY")
-	username := triton.GetEnv("USER")
-
 	if keyMaterial == "" {
 		signer, err = tritonauth.NewSSHAgentSigner(tritonauth.SSHAgentSignerInput{
 			KeyID:       keyID,
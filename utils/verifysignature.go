@@ -2,106 +2,187 @@ package utils
 
 import (
 	"bytes"
-	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
 	awsv4signer "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
 	"github.com/gin-gonic/gin"
-	tritonaccount "github.com/joyent/triton-go/v2/account"
+	"github.com/google/uuid"
+	triton "github.com/joyent/triton-go/v2"
+	shimerrors "github.com/joyent/triton-shim/errors"
 	tritonutils "github.com/joyent/triton-shim/utils/triton"
 	"github.com/rs/zerolog/log"
 )
 
 const iSO8601BasicFormat = "20060102T150405Z"
 
+// RegionKey is the gin.Context key holding the region name taken from the
+// request signature credential scope
+const RegionKey = "Region"
+
+// PrincipalKey is the gin.Context key holding the *tritonutils.Principal
+// owning the access key used to sign the request
+const PrincipalKey = "Principal"
+
+// defaultMaxBodySize is the largest request body accepted when
+// TRITON_SHIM_MAX_BODY_SIZE is not set
+const defaultMaxBodySize = 1 << 20
+
+// errBodyTooLarge The request body is larger than maxBodySize
+var errBodyTooLarge = errors.New("The request body is too large")
+
+// maxBodySize returns the largest request body accepted, in bytes
+func maxBodySize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("TRITON_SHIM_MAX_BODY_SIZE"), 10, 64)
+	if err != nil || size <= 0 {
+		return defaultMaxBodySize
+	}
+	return size
+}
+
+// getRawBody reads the whole request body, up to maxBodySize, since the
+// signature covers all of it. The request gets a copy of the body back for
+// the handlers.
 // gin-gonic/gin#1295 since we cannot use `ShouldBindBodyWith`
-func getRawBody(c *gin.Context) io.ReadSeeker {
-	var signBody io.ReadSeeker
-	if strings.ToLower(c.Request.Method) == "post" {
-		buf := make([]byte, 1024)
-		num, _ := c.Request.Body.Read(buf)
-		reqBody := string(buf[0:num])
-		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(reqBody))) // Write body back
-		// Need a Seeker for the signer.Sign function. Let's build one
-		// from the rawBodyString:
-		signBody = bytes.NewReader([]byte(reqBody))
-	}
-	return signBody
-}
-
-func getAccessKeys(c *gin.Context) ([]*tritonaccount.AccessKey, error) {
-	// TODO: Need to get account details from the request so we can
-	// fetch access keys for the provided account, and not the one
-	// we're using to operate as Admin
-	client, err := tritonutils.GetTritonAccountClient()
-	if err != nil {
-		return nil, fmt.Errorf("Unable to create triton account client: %w", err)
+func getRawBody(c *gin.Context) (io.ReadSeeker, error) {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return nil, nil
 	}
-	ctx := context.Background()
-	input := &tritonaccount.ListAccessKeysInput{}
-	accesskeys, err := client.AccessKeys().ListAccessKeys(ctx, input)
+
+	limit := maxBodySize()
+	reqBody, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, limit+1))
 	if err != nil {
-		log.Printf("[ERROR] list accesskeys error: %v\n", err)
-		return nil, fmt.Errorf("Unable to retrieve triton account keys: %w", err)
+		return nil, fmt.Errorf("Unable to read request body: %w", err)
+	}
+	if int64(len(reqBody)) > limit {
+		return nil, errBodyTooLarge
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(reqBody)) // Write body back
+	if len(reqBody) == 0 {
+		return nil, nil
+	}
+	// Need a Seeker for the signer.Sign function
+	return bytes.NewReader(reqBody), nil
+}
+
+// checkContentSha256 compares the body digest given by the
+// X-Amz-Content-Sha256 header, if any, with the actual one. The signer
+// trusts the header, so a body not matching it would go unnoticed.
+func checkContentSha256(r *http.Request, body io.ReadSeeker) bool {
+	digest := r.Header.Get("X-Amz-Content-Sha256")
+	if digest == "" || digest == "UNSIGNED-PAYLOAD" || strings.HasPrefix(digest, "STREAMING-") {
+		return true
+	}
+
+	hash := sha256.New()
+	if body != nil {
+		if _, err := io.Copy(hash, body); err != nil {
+			return false
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return false
+		}
 	}
-	return accesskeys, nil
+	return strings.EqualFold(digest, hex.EncodeToString(hash.Sum(nil)))
 }
 
-// The provided AccessKeyID should be part of the given Auhorization header,
-// exactly right at the begining of the "Credential=" part of the header like:
+// testAccessKeyID is the unit testing access key, which can only be used
+// for mock-region, acting as TRITON_ACCOUNT. Its secret is public, so it is
+// only accepted when gin runs in test mode.
+const testAccessKeyID = "AKID"
+
+// testAccessKeyEnabled tells if the unit testing access key is accepted
+func testAccessKeyEnabled() bool {
+	return gin.Mode() == gin.TestMode
+}
+
+// getAccessKeyID returns the AccessKeyID used to sign the request, which is
+// at the beginning of the "Credential=" part of the Authorization header:
 // Credential=620f1a7322b6a26c9301c6bcc17ccff3/...
-// We'll get it from the header, look for the key into access keys and, if we
-// find it, we'll use to reconstruct the Authorization header for the current
-// request, in order to verify if the provided signature matches.
-func getCurrentKey(authHeader string, accesskeys []*tritonaccount.AccessKey) (*tritonaccount.AccessKey, error) {
+func getAccessKeyID(authHeader string) (string, error) {
 	re := regexp.MustCompile(`Credential=(\w+)`)
 	if !re.MatchString(authHeader) {
-		return nil, errors.New("Unable to find the AccessKeyID used to sign the request")
-
+		return "", errors.New("Unable to find the AccessKeyID used to sign the request")
 	}
+	return re.FindStringSubmatch(authHeader)[1], nil
+}
 
-	credentials := re.FindStringSubmatch(authHeader)
+// getPrincipal returns the owner of the access key used to sign the
+// request, whose secret is used to verify the signature. The unit testing
+// key is handled without any Triton lookup. Only temporary access keys are
+// given a session token (see sessions.go).
+func getPrincipal(region string, accessKeyID string, sessionToken string) (*tritonutils.Principal, error) {
+	if isSessionAccessKey(accessKeyID) {
+		return lookupSession(region, accessKeyID, sessionToken, time.Now())
+	}
+	if sessionToken != "" {
+		return nil, ErrInvalidToken
+	}
 
-	// This is the unit testing key, let's just return an object with the expected values
-	if credentials[1] == "AKID" {
-		return &tritonaccount.AccessKey{
-			AccessKeyID:     "AKID",
+	if accessKeyID == testAccessKeyID && testAccessKeyEnabled() {
+		return &tritonutils.Principal{
+			Account:         triton.GetEnv("ACCOUNT"),
+			AccessKeyID:     testAccessKeyID,
 			SecretAccessKey: "SECRET",
 		}, nil
 	}
 
-	var currentKey *tritonaccount.AccessKey
-
-	for _, aKey := range accesskeys {
-		if aKey.AccessKeyID == credentials[1] {
-			currentKey = aKey
-			break
-		}
+	principal, err := tritonutils.LookupAccessKey(region, accessKeyID)
+	if err != nil {
+		log.Printf("[ERROR] lookup access key %s error: %v\n", accessKeyID, err)
+		return nil, err
 	}
+	return principal, nil
+}
 
-	if currentKey == nil {
-		return nil, errors.New("The provided AccessKey does not belong to this account")
+// getCredentialScope returns the parts of the signature credential scope:
+// AccessKey/Date/Region/Service/aws4_request
+func getCredentialScope(authHeader string) ([]string, error) {
+	credsRe := regexp.MustCompile(`Credential=(\S+),`)
+	if !credsRe.MatchString(authHeader) {
+		return nil, errors.New("Cannot find credential scope")
 	}
-
-	return currentKey, nil
+	creds := credsRe.FindStringSubmatch(authHeader)
+	scope := strings.Split(creds[1], "/")
+	if len(scope) != 5 {
+		return nil, errors.New("Malformed credential scope")
+	}
+	return scope, nil
 }
 
 func getRegion(authHeader string) (string, error) {
-	credsRe := regexp.MustCompile(`Credential=(\S+),`)
-	if !credsRe.MatchString(authHeader) {
+	scope, err := getCredentialScope(authHeader)
+	if err != nil {
 		return "", errors.New("Cannot find region name")
 	}
-	creds := credsRe.FindStringSubmatch(authHeader)
-	region := strings.Split(creds[1], "/")[2]
-	return region, nil
+	return scope[2], nil
+}
+
+// getService returns the name of the service the request was signed for,
+// like "ec2" or "route53"
+func getService(authHeader string) (string, error) {
+	scope, err := getCredentialScope(authHeader)
+	if err != nil {
+		return "", errors.New("Cannot find service name")
+	}
+	return scope[3], nil
 }
 
 func getSignedHeaders(authHeader string) ([]string, error) {
@@ -116,80 +197,440 @@ func getSignedHeaders(authHeader string) ([]string, error) {
 	return signedHeaders, nil
 }
 
-func compareSignatures(providedSignature string, calculatedSignature string) bool {
+// getSignature returns the signature of the Authorization header
+func getSignature(authHeader string) (string, error) {
 	signatureRe := regexp.MustCompile(`Signature=(\w+)`)
-	if !signatureRe.MatchString(providedSignature) {
-		return false
+	if !signatureRe.MatchString(authHeader) {
+		return "", errors.New("Unable to find request signature")
+	}
+	return signatureRe.FindStringSubmatch(authHeader)[1], nil
+}
+
+// compareSignatures compares the signatures in constant time, so the time
+// taken does not tell how much of the provided signature is right
+func compareSignatures(providedSignature string, calculatedSignature string) bool {
+	return providedSignature != "" &&
+		hmac.Equal([]byte(providedSignature), []byte(calculatedSignature))
+}
+
+// Presigned requests carry their signature into the query string instead of
+// the Authorization header
+const (
+	algorithmQueryKey     = "X-Amz-Algorithm"
+	credentialQueryKey    = "X-Amz-Credential"
+	dateQueryKey          = "X-Amz-Date"
+	expiresQueryKey       = "X-Amz-Expires"
+	signedHeadersQueryKey = "X-Amz-SignedHeaders"
+	signatureQueryKey     = "X-Amz-Signature"
+)
+
+// signatureAlgorithm is the only signing algorithm supported
+const signatureAlgorithm = "AWS4-HMAC-SHA256"
+
+// maxPresignExpires is the longest validity of a presigned request
+const maxPresignExpires = 7 * 24 * time.Hour
+
+// requestSignature is the signature of a request, taken from either its
+// Authorization header or, for presigned requests, its query string
+type requestSignature struct {
+	accessKeyID   string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	date          time.Time
+	// expires is how long presigned requests are valid after their date
+	expires   time.Duration
+	presigned bool
+	// dateHeader is set for the requests dated by their Date header
+	dateHeader bool
+	// sessionToken is the token of temporary access keys
+	sessionToken string
+}
+
+// getHeaderSignature returns the signature of the Authorization header,
+// signed at the time given by the x-amz-date header or, when there is none,
+// the Date header
+func getHeaderSignature(r *http.Request, authHeader string) (*requestSignature, error) {
+	// Infer AccessKey in use from the auth header
+	accessKeyID, err := getAccessKeyID(authHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	region, err := getRegion(authHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := getService(authHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	signedHeaders, err := getSignedHeaders(authHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := getSignature(authHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	// The time used to sign the request can be obtained from x-amz-date header:
+	var t time.Time
+	dateHeader := r.Header.Get("x-amz-date") == ""
+	if dateHeader {
+		t, err = http.ParseTime(r.Header.Get("Date"))
+	} else {
+		t, err = time.Parse(iSO8601BasicFormat, r.Header.Get("x-amz-date"))
+	}
+	if err != nil {
+		return nil, errors.New("Unable to find request time")
+	}
+
+	return &requestSignature{
+		accessKeyID:   accessKeyID,
+		region:        region,
+		service:       service,
+		signedHeaders: signedHeaders,
+		signature:     signature,
+		date:          t.UTC(),
+		dateHeader:    dateHeader,
+		sessionToken:  r.Header.Get("X-Amz-Security-Token"),
+	}, nil
+}
+
+// getQuerySignature returns the signature of a presigned request, whose
+// X-Amz-Credential is AccessKey/Date/Region/Service/aws4_request
+func getQuerySignature(query url.Values) (*requestSignature, error) {
+	if query.Get(algorithmQueryKey) != signatureAlgorithm {
+		return nil, fmt.Errorf("Unsupported signature algorithm %q", query.Get(algorithmQueryKey))
+	}
+
+	scope := strings.Split(query.Get(credentialQueryKey), "/")
+	if len(scope) != 5 || scope[0] == "" {
+		return nil, errors.New("Malformed credential scope")
+	}
+
+	signedHeaders := query.Get(signedHeadersQueryKey)
+	if signedHeaders == "" {
+		return nil, errors.New("Unable to find signed headers")
+	}
+
+	signature := query.Get(signatureQueryKey)
+	if signature == "" {
+		return nil, errors.New("Unable to find request signature")
+	}
+
+	t, err := time.Parse(iSO8601BasicFormat, query.Get(dateQueryKey))
+	if err != nil {
+		return nil, errors.New("Unable to find request time")
+	}
+
+	seconds, err := strconv.Atoi(query.Get(expiresQueryKey))
+	expires := time.Duration(seconds) * time.Second
+	if err != nil || expires <= 0 || expires > maxPresignExpires {
+		return nil, errors.New("Invalid presigned request expiration")
+	}
+
+	return &requestSignature{
+		accessKeyID:   scope[0],
+		region:        scope[2],
+		service:       scope[3],
+		signedHeaders: strings.Split(signedHeaders, ";"),
+		signature:     signature,
+		date:          t,
+		expires:       expires,
+		presigned:     true,
+		sessionToken:  query.Get("X-Amz-Security-Token"),
+	}, nil
+}
+
+// getRequestSignature returns the signature of the request, given by either
+// its Authorization header or its query string when it is presigned
+func getRequestSignature(r *http.Request) (*requestSignature, error) {
+	// Get the Authorization header:
+	authHeader := r.Header.Get("Authorization")
+	log.Printf("[Authorization Header]: %s\n", authHeader)
+
+	if authHeader != "" {
+		return getHeaderSignature(r, authHeader)
+	}
+	if r.URL.Query().Get(signatureQueryKey) != "" {
+		return getQuerySignature(r.URL.Query())
+	}
+	return nil, errors.New("No Authentication header provided")
+}
+
+// calculatedSignature is the signature of the request copy, together with
+// the canonical request and string to sign it was calculated from when they
+// are requested
+type calculatedSignature struct {
+	signature       string
+	canonicalString string
+	stringToSign    string
+}
+
+// signingInfoRe matches the signing details logged by the signer
+var signingInfoRe = regexp.MustCompile(`(?s)---\[ CANONICAL STRING  \]-*\n(.*)\n---\[ STRING TO SIGN \]-*\n(.*?)\n---`)
+
+// signingLogger keeps the signing details logged by the signer
+type signingLogger struct {
+	calculated *calculatedSignature
+}
+
+func (l signingLogger) Log(args ...interface{}) {
+	if match := signingInfoRe.FindStringSubmatch(fmt.Sprint(args...)); match != nil {
+		l.calculated.canonicalString = match[1]
+		l.calculated.stringToSign = match[2]
+	}
+}
+
+// calculateSignature signs the request copy the same way the provided
+// signature was. The canonical request and string to sign are only kept in
+// debug mode.
+func calculateSignature(r *http.Request, body io.ReadSeeker, sig *requestSignature, principal *tritonutils.Principal, debug bool) (*calculatedSignature, error) {
+	// The session token is part of the query string of presigned requests,
+	// which the signer builds from the credentials
+	sessionToken := ""
+	if sig.presigned {
+		sessionToken = sig.sessionToken
+	}
+	creds := awscredentials.NewStaticCredentials(principal.AccessKeyID, principal.SecretAccessKey, sessionToken)
+	signer := awsv4signer.NewSigner(creds)
+
+	if sig.dateHeader {
+		calculated, err := calculateDateHeaderSignature(r, body, sig, principal)
+		if err == nil && !debug {
+			calculated.canonicalString, calculated.stringToSign = "", ""
+		}
+		return calculated, err
+	}
+
+	calculated := &calculatedSignature{}
+	if debug {
+		signer.Debug = aws.LogDebugWithSigning
+		signer.Logger = signingLogger{calculated: calculated}
+	}
+
+	if !sig.presigned {
+		if _, err := signer.Sign(r, body, sig.service, sig.region, sig.date); err != nil {
+			return nil, err
+		}
+		log.Printf("[Calculated Authorization Header]: %s\n", r.Header.Get("Authorization"))
+
+		signature, err := getSignature(r.Header.Get("Authorization"))
+		if err != nil {
+			return nil, err
+		}
+		calculated.signature = signature
+		return calculated, nil
+	}
+
+	// The signer would otherwise consider the request as already signed
+	query := r.URL.Query()
+	query.Del(signatureQueryKey)
+	r.URL.RawQuery = query.Encode()
+
+	if _, err := signer.Presign(r, body, sig.service, sig.region, sig.expires, sig.date); err != nil {
+		return nil, err
+	}
+	log.Printf("[Calculated Presigned URL]: %s\n", r.URL.String())
+	calculated.signature = r.URL.Query().Get(signatureQueryKey)
+	return calculated, nil
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data
+func hmacSHA256(key []byte, data string) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(data))
+	return hash.Sum(nil)
+}
+
+// calculateDateHeaderSignature signs the request copy of requests dated by
+// their Date header. The SDK signer cannot be used for them, since it always
+// signs an X-Amz-Date header.
+func calculateDateHeaderSignature(r *http.Request, body io.ReadSeeker, sig *requestSignature, principal *tritonutils.Principal) (*calculatedSignature, error) {
+	bodyDigest := r.Header.Get("X-Amz-Content-Sha256")
+	if bodyDigest == "" {
+		hash := sha256.New()
+		if body != nil {
+			if _, err := io.Copy(hash, body); err != nil {
+				return nil, err
+			}
+		}
+		bodyDigest = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	// The request copy only has the signed headers left
+	headers := []string{"host"}
+	values := map[string]string{"host": r.Host}
+	if r.Host == "" {
+		values["host"] = r.URL.Host
+	}
+	for name, value := range r.Header {
+		name = strings.ToLower(name)
+		headers = append(headers, name)
+		values[name] = strings.Join(strings.Fields(strings.Join(value, ",")), " ")
+	}
+	sort.Strings(headers)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+
+	uri := r.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
 	}
-	provided := signatureRe.FindStringSubmatch(providedSignature)
 
-	if !signatureRe.MatchString(calculatedSignature) {
-		return false
+	calculated := &calculatedSignature{}
+	calculated.canonicalString = strings.Join([]string{
+		r.Method,
+		rest.EscapePath(uri, false),
+		strings.Replace(r.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		strings.Join(headers, ";"),
+		bodyDigest,
+	}, "\n")
+
+	day := sig.date.Format("20060102")
+	scope := strings.Join([]string{day, sig.region, sig.service, "aws4_request"}, "/")
+	canonicalDigest := sha256.Sum256([]byte(calculated.canonicalString))
+	calculated.stringToSign = strings.Join([]string{
+		signatureAlgorithm,
+		sig.date.Format(iSO8601BasicFormat),
+		scope,
+		hex.EncodeToString(canonicalDigest[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+principal.SecretAccessKey), day)
+	key = hmacSHA256(key, sig.region)
+	key = hmacSHA256(key, sig.service)
+	key = hmacSHA256(key, "aws4_request")
+	calculated.signature = hex.EncodeToString(hmacSHA256(key, calculated.stringToSign))
+	return calculated, nil
+}
+
+// signatureDoesNotMatchMessage is the message of SignatureDoesNotMatch
+// errors, which tells the expected canonical request and string to sign in
+// debug mode
+func signatureDoesNotMatchMessage(calculated *calculatedSignature) string {
+	msg := "The request signature we calculated does not match the signature you provided. " +
+		"Check your AWS Secret Access Key and signing method."
+	if calculated.canonicalString == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s\n\nThe Canonical String for this request should have been\n'%s'\n\n"+
+		"The String-to-Sign should have been\n'%s'\n",
+		msg, calculated.canonicalString, calculated.stringToSign)
+}
+
+// abortWithAuthError sends an error response in the format of the service
+// the request was signed for, since no action handled the request yet, and
+// stops processing the request
+func abortWithAuthError(c *gin.Context, status int, service string, code string, message string) {
+	c.Error(errors.New(message))
+
+	reqID := uuid.New().String()
+	switch service {
+	case "route53", "sts":
+		c.Header("x-amzn-RequestId", reqID)
+		c.XML(status, shimerrors.RestXMLError(code, message, reqID))
+	case "ec2-instance-connect":
+		body, _ := json.Marshal(shimerrors.JSONError(code, message))
+		c.Header("x-amzn-RequestId", reqID)
+		c.Data(status, "application/x-amz-json-1.1", body)
+	default:
+		c.XML(status, shimerrors.ResponseError(code, message, reqID))
+	}
+	c.Abort()
+}
+
+// maxRequestSkew is how far from the current time requests can be dated,
+// like EC2 does
+const maxRequestSkew = 15 * time.Minute
+
+// signatureExpiry returns the time the signature expires at
+func signatureExpiry(sig *requestSignature) time.Time {
+	if sig.presigned {
+		return sig.date.Add(sig.expires)
 	}
-	calculated := signatureRe.FindStringSubmatch(calculatedSignature)
+	return sig.date.Add(maxRequestSkew)
+}
 
-	return provided[1] == calculated[1]
+// expired tells if the signature is expired at the given time, or dated
+// too far into the future
+func expired(sig *requestSignature, now time.Time) bool {
+	return now.After(signatureExpiry(sig)) || sig.date.After(now.Add(maxRequestSkew))
 }
 
 // VerifySignature middleware preloads access keys for the provided account,
 // verifies that one of those keys is used to sign the HTTP Request and the
-// correctness of the provided Signature
+// correctness of the provided Signature, given by either the Authorization
+// header or the query string of presigned requests
 func VerifySignature() gin.HandlerFunc {
+	var replays *replayCache
+	if os.Getenv("TRITON_SHIM_REPLAY_CACHE") != "" {
+		replays = newReplayCache()
+	}
+
 	return func(c *gin.Context) {
 		// We'll use a copy of the current request to re-sign it and
 		// verify if the provided signature matches with the one we
 		// calculate
 		dupeRequest := c.Request.Clone(c.Request.Context())
 
-		// Load all the access keys:
-		accesskeys, err := getAccessKeys(c)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
-		// Get the Authorization header:
-		authHeader := c.Request.Header.Get("Authorization")
-		log.Printf("[Authorization Header]: %s\n", authHeader)
-
-		if authHeader == "" {
-			c.AbortWithError(http.StatusUnauthorized,
-				errors.New("No Authentication header provided"))
-			return
-		}
-		// Infer AccessKey in use from the auth header
-		currentKey, err := getCurrentKey(authHeader, accesskeys)
-		if err != nil {
-			c.AbortWithError(http.StatusUnauthorized, err)
-			return
-		}
-
-		region, err := getRegion(authHeader)
+		sig, err := getRequestSignature(c.Request)
 		if err != nil {
 			c.AbortWithError(http.StatusUnauthorized, err)
 			return
 		}
+		accessKeyID, region := sig.accessKeyID, sig.region
 
 		// Verify that if we're trying to use unit testing key, we're also using
 		// mock-region:
-		if currentKey.AccessKeyID == "AKID" {
+		if accessKeyID == testAccessKeyID && testAccessKeyEnabled() {
 			if region != "mock-region" {
 				c.AbortWithError(http.StatusUnauthorized,
 					errors.New("Test AccessKey can be used only for the mock-region"))
 				return
 			}
+		} else if _, err := tritonutils.RegionURL(region); err != nil {
+			// Every other region must be served by a known datacenter
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
 		}
 
-		signedHeaders, err := getSignedHeaders(authHeader)
-		if err != nil {
-			c.AbortWithError(http.StatusUnauthorized, err)
+		// Requests must be received within maxRequestSkew of their date, and
+		// presigned ones can only be used until they expire
+		if expired(sig, time.Now()) {
+			abortWithAuthError(c, http.StatusBadRequest, sig.service,
+				"RequestExpired", "Request has expired.")
 			return
 		}
 
-		// The time used to sign the request can be obtained from x-amz-date header:
-		t, err := time.Parse(iSO8601BasicFormat, c.GetHeader("x-amz-date"))
-		if err != nil {
+		principal, err := getPrincipal(region, accessKeyID, sig.sessionToken)
+		if errors.Is(err, tritonutils.ErrUnknownAccessKey) || errors.Is(err, tritonutils.ErrInactiveAccessKey) {
 			c.AbortWithError(http.StatusUnauthorized,
-				errors.New("Unable to find request time"))
+				errors.New("The provided AccessKey is not valid"))
+			return
+		}
+		if errors.Is(err, ErrInvalidToken) {
+			abortWithAuthError(c, http.StatusForbidden, sig.service, "InvalidClientTokenId",
+				"The security token included in the request is invalid.")
+			return
+		}
+		if errors.Is(err, ErrExpiredToken) {
+			abortWithAuthError(c, http.StatusBadRequest, sig.service, "ExpiredToken",
+				"The security token included in the request is expired")
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
@@ -199,7 +640,7 @@ func VerifySignature() gin.HandlerFunc {
 		for hdr := range dupeRequest.Header {
 			hdrName := strings.ToLower(hdr)
 			found := func(find string) bool {
-				for _, val := range signedHeaders {
+				for _, val := range sig.signedHeaders {
 					if val == find {
 						return true
 					}
@@ -212,25 +653,74 @@ func VerifySignature() gin.HandlerFunc {
 			}
 		}
 
-		creds := awscredentials.NewStaticCredentials(currentKey.AccessKeyID, currentKey.SecretAccessKey, "")
-		signer := awsv4signer.NewSigner(creds)
-		signBody := getRawBody(c)
+		signBody, err := getRawBody(c)
+		if errors.Is(err, errBodyTooLarge) {
+			abortWithAuthError(c, http.StatusRequestEntityTooLarge, sig.service,
+				"RequestEntityTooLarge", err.Error())
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if !checkContentSha256(c.Request, signBody) {
+			abortWithAuthError(c, http.StatusBadRequest, sig.service, "XAmzContentSHA256Mismatch",
+				"The provided 'x-amz-content-sha256' header does not match what was computed.")
+			return
+		}
 
-		_, err = signer.Sign(dupeRequest, signBody, "ec2", region, t)
+		calculated, err := calculateSignature(dupeRequest, signBody, sig, principal, debugMode())
 		if err != nil {
 			c.AbortWithError(http.StatusUnauthorized,
 				errors.New("Unable to verify request signature"))
 			return
 		}
-		log.Printf("[Calculated Authorization Header]: %s\n", dupeRequest.Header.Get("Authorization"))
 
-		if !compareSignatures(authHeader, dupeRequest.Header.Get("Authorization")) {
-			c.AbortWithError(http.StatusUnauthorized,
-				errors.New("The provided request signature is not correct"))
+		if !compareSignatures(sig.signature, calculated.signature) {
+			abortWithAuthError(c, http.StatusForbidden, sig.service, "SignatureDoesNotMatch",
+				signatureDoesNotMatchMessage(calculated))
+			return
+		}
+
+		// Sub-users can only act with a key of their own, so they are not
+		// given the rights of the account owner. The unit testing key acts
+		// as TRITON_ACCOUNT, which the Triton clients check when created.
+		if accessKeyID != testAccessKeyID {
+			err := tritonutils.CheckPrincipal(principal)
+			if errors.Is(err, tritonutils.ErrUnsupportedUser) && principal.User == "" {
+				abortWithAuthError(c, http.StatusForbidden, sig.service, "AccessDenied",
+					"Roles may not be assumed by root accounts.")
+				return
+			}
+			if errors.Is(err, tritonutils.ErrUnsupportedUser) {
+				abortWithAuthError(c, http.StatusForbidden, sig.service, "AccessDenied",
+					fmt.Sprintf("User %s of account %s is not authorized to use the shim.",
+						principal.User, principal.Account))
+				return
+			}
+			if errors.Is(err, tritonutils.ErrNoAccount) {
+				abortWithAuthError(c, http.StatusForbidden, sig.service, "AccessDenied",
+					"The access key does not belong to any account.")
+				return
+			}
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		// When the replay cache is enabled, mutating requests are only
+		// accepted once
+		if replays != nil && isMutatingRequest(c.Request, signBody) &&
+			replays.replayed(accessKeyID, sig.signature, signatureExpiry(sig), time.Now()) {
+			abortWithAuthError(c, http.StatusUnauthorized, sig.service, "AuthFailure",
+				"The request was already received and cannot be replayed.")
 			return
 		}
 
-		// TODO: The same thing but for QueryString Auth instead of Authentication Header
+		c.Set(RegionKey, region)
+		c.Set(PrincipalKey, principal)
 
 		c.Next()
 	}